@@ -0,0 +1,53 @@
+package apicall
+
+import (
+	"context"
+	"time"
+
+	"github.com/circle-makotom/orbs-sync/metrics"
+)
+
+// Run a call to the CircleCI API, giving up waiting for it once the context is done
+// circleci-cli does not take contexts, so an abandoned call keeps running in the background until it returns; results of such calls must not be used
+// The call is counted in the metrics by the operation name
+func Run(ctx context.Context, operation string, call func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	startedAt := time.Now()
+	defer func() {
+		metrics.GraphQLRequestSeconds.Add(time.Since(startedAt).Seconds(), operation)
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- call()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			metrics.GraphQLRequests.Inc(operation, "error")
+		} else {
+			metrics.GraphQLRequests.Inc(operation, "success")
+		}
+		return err
+	case <-ctx.Done():
+		metrics.GraphQLRequests.Inc(operation, "cancelled")
+		return ctx.Err()
+	}
+}
+
+// Sleep for the duration, or until the context is done
+func Sleep(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
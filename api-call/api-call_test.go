@@ -0,0 +1,79 @@
+package apicall
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	callErr := errors.New("failure calling GraphQL API")
+
+	cases := []struct {
+		name     string
+		err      error
+		expected error
+	}{
+		{"success", nil, nil},
+		{"error", callErr, callErr},
+	}
+
+	for _, c := range cases {
+		if err := Run(context.Background(), "Test", func() error { return c.err }); err != c.expected {
+			t.Errorf("%s: error = %v; expected %v", c.name, err, c.expected)
+		}
+	}
+}
+
+// Calls in flight are abandoned once the context is done, and calls are never made with contexts done already
+func TestRunCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+
+	returned := make(chan error, 1)
+	go func() {
+		returned <- Run(ctx, "Test", func() error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+
+	<-started
+	cancel()
+
+	select {
+	case err := <-returned:
+		if err != context.Canceled {
+			t.Errorf("error = %v; expected %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the call was not abandoned on cancellation")
+	}
+
+	called := false
+	if err := Run(ctx, "Test", func() error { called = true; return nil }); err != context.Canceled || called {
+		t.Errorf("error = %v and called = %t; expected %v without the call", err, called, context.Canceled)
+	}
+}
+
+func TestSleep(t *testing.T) {
+	if err := Sleep(context.Background(), time.Millisecond); err != nil {
+		t.Errorf("error = %v; expected nil", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	startedAt := time.Now()
+	if err := Sleep(ctx, time.Hour); err != context.DeadlineExceeded {
+		t.Errorf("error = %v; expected %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(startedAt); elapsed > 5*time.Second {
+		t.Errorf("slept for %v after the deadline", elapsed)
+	}
+}
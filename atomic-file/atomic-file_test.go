@@ -0,0 +1,80 @@
+package atomicfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Assert that the directory contains only the given files, i.e., no temporary files are left
+func assertFiles(t *testing.T, dir string, expected ...string) {
+	t.Helper()
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if len(names) != len(expected) {
+		t.Errorf("directory contains %q; expected %q", names, expected)
+		return
+	}
+	for idx := range names {
+		if names[idx] != expected[idx] {
+			t.Errorf("directory contains %q; expected %q", names, expected)
+			return
+		}
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "orbs.txt")
+
+	for _, contents := range []string{"first", "second, replacing the first"} {
+		if err := WriteFile(filename, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if written, err := ioutil.ReadFile(filename); err != nil {
+			t.Fatal(err)
+		} else if string(written) != contents {
+			t.Errorf("file contains %q; expected %q", written, contents)
+		}
+		assertFiles(t, dir, "orbs.txt")
+	}
+
+	if info, err := os.Stat(filename); err != nil {
+		t.Fatal(err)
+	} else if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("permission = %v; expected %v", perm, os.FileMode(0600))
+	}
+}
+
+// Failing to rename leaves the existing file as-is, and removes the temporary file
+func TestWriteFileFailing(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "orbs")
+	if err := os.Mkdir(filename, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(filename, "kept.txt"), []byte("kept"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteFile(filename, []byte("contents"), 0644); err == nil {
+		t.Error("a directory was replaced by a file")
+	}
+
+	assertFiles(t, dir, "orbs")
+	assertFiles(t, filename, "kept.txt")
+
+	if err := WriteFile(filepath.Join(dir, "missing", "orbs.txt"), []byte("contents"), 0644); err == nil {
+		t.Error("a file was written in a missing directory")
+	}
+}
@@ -1,11 +1,12 @@
 package bulkimporter
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"net/http"
-	"os"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -13,6 +14,12 @@ import (
 	circleapi "github.com/CircleCI-Public/circleci-cli/api"
 	circleql "github.com/CircleCI-Public/circleci-cli/api/graphql"
 
+	apicall "github.com/circle-makotom/orbs-sync/api-call"
+	"github.com/circle-makotom/orbs-sync/collector"
+	depresolver "github.com/circle-makotom/orbs-sync/dependency-resolver"
+	"github.com/circle-makotom/orbs-sync/events"
+	"github.com/circle-makotom/orbs-sync/logging"
+	"github.com/circle-makotom/orbs-sync/metrics"
 	"github.com/circle-makotom/orbs-sync/types"
 )
 
@@ -20,16 +27,160 @@ var (
 	maxImportRetries    = 3
 	sleepBetweenRetries = 200 * time.Millisecond
 
-	logger = log.New(os.Stderr, "bulk-importer: ", 7)
+	logger = logging.NewSwappable(logging.New("bulk-importer"))
+
+	metricOrbsImported  = metrics.NewCounterVec("orbs_sync_orbs_imported_total", "Versioned orbs imported to the destination")
+	metricOrbsDropped   = metrics.NewCounterVec("orbs_sync_orbs_dropped_total", "Versioned orbs dropped while importing by the error category", "category")
+	metricOrbsRemaining = metrics.NewGaugeVec("orbs_sync_orbs_remaining", "Versioned orbs left remaining by the last import because of the deadline, cancellation or an error aborting it")
+	metricRetries       = metrics.NewCounterVec("orbs_sync_retries_total", "Retries of orbs by the operation, which is one of import, validate and verify", "operation")
 )
 
+// Replace the logger of the importer, e.g., to route progress and drops of orbs to the logger of the programme using it
+// Workers of an import in progress pick up the new logger from their next entry on
+func SetLogger(l logging.Printer) {
+	logger.Set(l)
+}
+
+type DroppedOrb struct {
+	Ref      string
+	Category ErrorCategory
+	Err      error
+
+	// Dependency is the dropped orb which made this orb dropped, if Category is CategoryDependencyDropped
+	Dependency string
+}
+
+type OrbStatus string
+
+const (
+	StatusImported       OrbStatus = "imported"
+	StatusAlreadyPresent OrbStatus = "already-present"
+	StatusDropped        OrbStatus = "dropped"
+
+	// Orbs are skipped, i.e., dropped without any attempt, if their dependencies are dropped
+	StatusSkipped OrbStatus = "skipped"
+)
+
+// OrbRecord describes what happened to an orb while importing
+type OrbRecord struct {
+	Ref      string
+	Status   OrbStatus
+	Attempts int
+	Duration time.Duration
+
+	// Whether the namespace or the orb family was created while importing this orb
+	NamespaceCreated bool
+	OrbCreated       bool
+}
+
+type Result struct {
+	Available []string
+	Dropped   []*DroppedOrb
+
+	// Records lists all the processed orbs in the processed order
+	Records []*OrbRecord
+
+	// Failed lists orbs dropped because of errors not specific to them, which abort the import unless KeepGoing is set
+	Failed []string
+
+	// Validation is the compatibility report, available if Validate is set
+	Validation []*ValidationResult
+
+	// Verification tells whether sources of imported orbs on the destination match those imported, available if Verify is set
+	Verification []*VerificationResult
+
+	// Remaining lists orbs not attempted because of the deadline, cancellation or an error aborting the import, in the order they would have been imported
+	// Orbs interrupted by cancellation are remaining as well, as it is unknown whether they were imported
+	Remaining []string
+}
+
+// FailedOrbsError is returned along with the result if any orbs failed in the keep-going mode
+type FailedOrbsError struct {
+	Refs []string
+}
+
+func (e *FailedOrbsError) Error() string {
+	return fmt.Sprintf("%d orb(s) failed to be imported: %s", len(e.Refs), strings.Join(e.Refs, ", "))
+}
+
+// IncompleteError is returned along with the result if the import stopped at the deadline or was cancelled
+// It takes precedence over FailedOrbsError, carrying orbs failed in the keep-going mode as well
+type IncompleteError struct {
+	Remaining []string
+
+	// Failed lists orbs failed before the import stopped in the keep-going mode
+	Failed []string
+
+	// Err is the error of the context if the import was cancelled, or nil if it stopped at the deadline
+	Err error
+}
+
+func (e *IncompleteError) Error() string {
+	msg := fmt.Sprintf("import stopped at the deadline, leaving %d orb(s) remaining", len(e.Remaining))
+	if e.Err != nil {
+		msg = fmt.Sprintf("import was cancelled (%v), leaving %d orb(s) remaining", e.Err, len(e.Remaining))
+	}
+
+	if len(e.Failed) > 0 {
+		msg += fmt.Sprintf(", after %d orb(s) failed to be imported: %s", len(e.Failed), strings.Join(e.Failed, ", "))
+	}
+
+	return msg
+}
+
+func (e *IncompleteError) Unwrap() error {
+	return e.Err
+}
+
+type ImportOpts struct {
+	// Concurrency is the number of orbs imported at once in each dependency level
+	// Orbs are imported one-by-one in the given order if this is 1 or less
+	Concurrency int
+
+	// KeepGoing makes the importer record errors not specific to orbs against the orbs and continue, instead of aborting
+	// Dependents of such orbs are dropped without any attempt
+	KeepGoing bool
+
+	// Validate makes the importer validate orbs on the destination before any mutations, and exclude incompatible ones
+	Validate bool
+
+	// Inventory of the destination, which saves lookups of each namespace, orb and version
+	// One of the namespaces of the orbs is taken at the beginning if nil, rather than one of the whole destination
+	Inventory *collector.Inventory
+
+	// Inventories older than this are not trusted, and namespaces, orbs and versions are looked up one-by-one instead
+	// Zero means no limit
+	MaxInventoryAge time.Duration
+
+	// NamespacePolicy blocks orbs in namespaces not allowed by it, if given
+	NamespacePolicy *NamespacePolicy
+
+	// Verify makes the importer fetch sources of imported orbs from the destination and compare them with those imported
+	Verify bool
+
+	// Quarantined orbs are skipped, and their dependents are dropped as well
+	Quarantined []string
+
+	// No new orbs are started after Deadline, while those in flight are finished; zero means no deadline
+	Deadline time.Time
+
+	// LevelOf maps orbs to their dependency levels given by depresolver.ResolveLevels, which concurrent imports follow
+	// Levels are computed from sources of orbs instead unless given for all the orbs
+	LevelOf map[string]int
+
+	// Priority reorders orbs, keeping dependencies of each orb before the orb
+	// Popularity maps orb names to the popularity statistics for the weighted mode
+	Priority   depresolver.PriorityMode
+	Popularity map[string]int
+}
+
 // Combination of OrbID and OrbExists
 // Return a non-zero-length string, representing orb ID, if the orb exists, or a zero-length string if not
 // Errors come from the underlying communication channel
 //
 // cf. https://github.com/CircleCI-Public/circleci-cli/blob/5297a1935de7cf25a0ee09b3a2baf5090ebc2020/api/api.go#L722-L758
 // cf. https://github.com/CircleCI-Public/circleci-cli/blob/5297a1935de7cf25a0ee09b3a2baf5090ebc2020/api/api.go#L691-L719
-func OrbIDUnsafe(cl *circleql.Client, orbName string) (string, error) {
+func OrbIDUnsafe(ctx context.Context, cl *circleql.Client, orbName string) (string, error) {
 	var response circleapi.OrbIDResponse
 
 	query := `
@@ -44,148 +195,718 @@ func OrbIDUnsafe(cl *circleql.Client, orbName string) (string, error) {
 	request.SetToken(cl.Token)
 	request.Var("name", orbName)
 
-	if err := cl.Run(request, &response); err != nil {
+	if err := apicall.Run(ctx, "OrbID", func() error { return cl.Run(request, &response) }); err != nil {
 		return "", errors.Wrap(err, "GraphQL query failed")
 	}
 
 	return response.Orb.ID, nil
 }
 
-func ImportOrbsWithRetries(cl *circleql.Client, orbs []*types.VersionedOrb) ([]string, []string, error) {
-	logger.Printf("importing listed orbs")
+// keyedMutex serializes operations on the same key, e.g., creation of the same namespace by multiple workers
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func (km *keyedMutex) lock(key string) func() {
+	km.mu.Lock()
+	if km.locks == nil {
+		km.locks = make(map[string]*sync.Mutex)
+	}
+	lock, ok := km.locks[key]
+	if !ok {
+		lock = &sync.Mutex{}
+		km.locks[key] = lock
+	}
+	km.mu.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+type importer struct {
+	cl   *circleql.Client
+	opts *ImportOpts
+
+	// inventory is nil if namespaces, orbs and versions have to be looked up one-by-one
+	// Those missing in the inventory are looked up or created, and conflicts tell that they were created after the inventory was taken
+	inventory *collector.Inventory
+
+	// satisfiers maps each orb to its dependencies, each of which is mapped to orbs satisfying it
+	satisfiers  map[string]map[string][]string
+	unavailable map[string]bool
+
+	mu       sync.Mutex
+	nsExists map[string]bool
+	orbIDs   map[string]string
+
+	nsLocks  keyedMutex
+	orbLocks keyedMutex
+}
+
+func newImporter(cl *circleql.Client, orbs []*types.VersionedOrb, opts *ImportOpts, inventory *collector.Inventory) *importer {
+	return &importer{
+		cl:          cl,
+		opts:        opts,
+		inventory:   inventory,
+		satisfiers:  depresolver.MapDependencySatisfiers(orbs),
+		unavailable: make(map[string]bool),
+		nsExists:    make(map[string]bool),
+		orbIDs:      make(map[string]string),
+	}
+}
+
+// Ensure that the namespace exists; create one if needed
+// Return whether the namespace is created by this call
+func (im *importer) ensureNamespace(ctx context.Context, ns string) (bool, error) {
+	defer im.nsLocks.lock(ns)()
+
+	im.mu.Lock()
+	_, nsVisited := im.nsExists[ns]
+	im.mu.Unlock()
+
+	if nsVisited {
+		return false, nil
+	}
+
+	if im.inventory != nil && im.inventory.Namespaces[ns] {
+		im.mu.Lock()
+		im.nsExists[ns] = true
+		im.mu.Unlock()
+
+		return false, nil
+	}
+
+	created := false
+
+	// cf. https://github.com/CircleCI-Public/circleci-cli/blob/5297a1935de7cf25a0ee09b3a2baf5090ebc2020/cmd/orb_import.go#L98-L105
+	var doesExist bool
+	err := apicall.Run(ctx, "NamespaceExists", func() (err error) {
+		doesExist, err = circleapi.NamespaceExists(im.cl, ns)
+		return err
+	})
+	if err = categorizeError(err); err != nil {
+		return false, errors.Wrapf(err, "error while querying namespace %q", ns)
+	}
+
+	if !doesExist {
+		// Orbs are checked against the policy beforehand, but the namespace may have been deleted in the meantime
+		if im.opts.NamespacePolicy != nil && im.opts.NamespacePolicy.NeverCreate {
+			return false, &ImportError{Category: CategoryNamespaceBlocked, Err: fmt.Errorf("namespace %q does not exist, and the policy forbids creating namespaces", ns)}
+		}
+
+		// cf. https://github.com/CircleCI-Public/circleci-cli/blob/master/cmd/orb_import.go#L137-L140
+		err := apicall.Run(ctx, "CreateNamespace", func() error {
+			_, err := circleapi.CreateImportedNamespace(im.cl, ns)
+			return err
+		})
+		if err != nil {
+			// Someone else may have created the namespace in the meantime
+			if err = categorizeError(err); CategoryOf(err) != CategoryVersionConflict {
+				return false, errors.Wrapf(err, "error while creating namespace %q", ns)
+			}
+
+			logger.Debugf("namespace %q turned out to exist already", ns)
+		} else {
+			created = true
+			logger.Infof("new namespace %q created", ns)
+		}
+	}
+
+	im.mu.Lock()
+	im.nsExists[ns] = true
+	im.mu.Unlock()
+	logger.Debugf("cached namespace %q", ns)
+
+	return created, nil
+}
+
+// Ensure that the orb family is registered; register one if needed
+// Return the orb ID and whether the orb family is registered by this call
+func (im *importer) ensureOrbID(ctx context.Context, orb *types.VersionedOrb, ns, shortname string) (string, bool, error) {
+	defer im.orbLocks.lock(orb.Name)()
+
+	im.mu.Lock()
+	orbID, familyVisited := im.orbIDs[orb.Name]
+	im.mu.Unlock()
+
+	if familyVisited {
+		return orbID, false, nil
+	}
+
+	if im.inventory != nil && im.inventory.OrbIDs[orb.Name] != "" {
+		orbID = im.inventory.OrbIDs[orb.Name]
+
+		im.mu.Lock()
+		im.orbIDs[orb.Name] = orbID
+		im.mu.Unlock()
+
+		return orbID, false, nil
+	}
+
+	created := false
+
+	// cf. https://github.com/CircleCI-Public/circleci-cli/blob/5297a1935de7cf25a0ee09b3a2baf5090ebc2020/cmd/orb_import.go#L109-L116
+	orbID, err := OrbIDUnsafe(ctx, im.cl, orb.Name)
+	if err = categorizeError(err); err != nil {
+		return "", false, errors.Wrapf(err, "error while querying orb %q", ns)
+	}
+
+	if orbID == "" {
+		// https://github.com/CircleCI-Public/circleci-cli/blob/5297a1935de7cf25a0ee09b3a2baf5090ebc2020/cmd/orb_import.go#L144-L147
+		var resp *circleapi.ImportOrbResponse
+		err := apicall.Run(ctx, "CreateOrb", func() (err error) {
+			resp, err = circleapi.CreateImportedOrb(im.cl, ns, shortname)
+			return err
+		})
+		if err = categorizeError(err); CategoryOf(err) == CategoryVersionConflict {
+			// Someone else may have registered the orb in the meantime
+			if orbID, err = OrbIDUnsafe(ctx, im.cl, orb.Name); err != nil {
+				return "", false, errors.Wrapf(categorizeError(err), "error while querying orb %q", orb.Name)
+			} else if orbID == "" {
+				return "", false, &ImportError{Category: CategoryUnknown, Err: fmt.Errorf("orb %q could be neither registered nor found", orb.Name)}
+			}
+
+			logger.Debugf("orb %q turned out to be registered already with ID %q", orb.Name, orbID)
+		} else if err != nil {
+			return "", false, errors.Wrapf(err, "error while registering orb %q", orb.Name)
+		} else {
+			orbID = resp.ImportOrb.Orb.ID
+			created = true
+
+			logger.Infof("new orb %q registered with ID %q", orb.Name, orbID)
+		}
+	}
+
+	im.mu.Lock()
+	im.orbIDs[orb.Name] = orbID
+	im.mu.Unlock()
+	logger.Debugf("cached orb %q with ID %q", orb.Name, orbID)
+
+	return orbID, created, nil
+}
+
+// Find a dependency of the orb, all the orbs satisfying which are unavailable
+// Return the dependency and one of the unavailable orbs satisfying it
+func (im *importer) findUnavailableDependency(orb *types.VersionedOrb) (string, string, bool) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+
+	for dependency, satisfyingRefs := range im.satisfiers[orb.Ref] {
+		isUnavailable := true
+		for _, satisfyingRef := range satisfyingRefs {
+			if !im.unavailable[satisfyingRef] {
+				isUnavailable = false
+				break
+			}
+		}
+
+		if isUnavailable {
+			return dependency, satisfyingRefs[0], true
+		}
+	}
+
+	return "", "", false
+}
+
+// Tell whether the versioned orb is on the destination, by the inventory if any
+// Versions missing in the inventory are not looked up unless the inventory cannot tell; importing them fails with a conflict if they were imported after the inventory was taken
+func (im *importer) versionExists(ctx context.Context, orb *types.VersionedOrb) (bool, error) {
+	if im.inventory != nil {
+		if exists, known := im.inventory.Lookup(orb.Ref); known {
+			return exists, nil
+		}
+	}
+
+	// cf. https://github.com/CircleCI-Public/circleci-cli/blob/5297a1935de7cf25a0ee09b3a2baf5090ebc2020/cmd/orb_import.go#L120-L127
+	err := apicall.Run(ctx, "OrbInfo", func() error {
+		_, err := circleapi.OrbInfo(im.cl, orb.Ref)
+		return err
+	})
+	if _, ok := err.(*circleapi.ErrOrbVersionNotExists); ok {
+		return false, nil
+	} else if err = categorizeError(err); err != nil {
+		return false, errors.Wrapf(err, "error while querying orb info %q", orb.Ref)
+	}
+
+	return true, nil
+}
+
+func (im *importer) markUnavailable(orbRef string) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+
+	im.unavailable[orbRef] = true
+}
+
+// Drop an orb up front without any attempt; its dependents will be dropped as well
+func (im *importer) dropUpFront(result *Result, orbRef string, status OrbStatus, category ErrorCategory, err error) {
+	im.markUnavailable(orbRef)
+	metricOrbsDropped.Inc(string(category))
+	events.Emit(&events.Event{Type: events.ImportDropped, Ref: orbRef, Category: string(category), Error: err.Error()})
+
+	result.Dropped = append(result.Dropped, &DroppedOrb{Ref: orbRef, Category: category, Err: err})
+	result.Records = append(result.Records, &OrbRecord{Ref: orbRef, Status: status})
+}
+
+// Import a versioned orb unless any of its dependencies are unavailable
+// Return values are the same as importOne
+func (im *importer) importIfSatisfied(ctx context.Context, orb *types.VersionedOrb, record *OrbRecord) (*DroppedOrb, error) {
+	if dependency, unavailableRef, ok := im.findUnavailableDependency(orb); ok {
+		logger.Warnf("dropping %q without any attempt as its dependency %q was dropped", orb.Ref, unavailableRef)
+		record.Status = StatusSkipped
+
+		return &DroppedOrb{
+			Ref:        orb.Ref,
+			Category:   CategoryDependencyDropped,
+			Err:        fmt.Errorf("dependency %q (as %q) was dropped", unavailableRef, dependency),
+			Dependency: unavailableRef,
+		}, nil
+	}
+
+	return im.importOne(ctx, orb, record)
+}
+
+// Import a versioned orb with retries; permanent errors are never retried
+// Return nil if the orb is available in the end, or the reason if the orb is dropped
+// Errors are those which are not specific to the orb, e.g., communication errors, or the error of the context if it is done in the middle
+// The record is filled with attempts made and the status
+//
+// cf. https://github.com/CircleCI-Public/circleci-cli/blob/5297a1935de7cf25a0ee09b3a2baf5090ebc2020/cmd/orb_import.go#L135-L167
+func (im *importer) importOne(ctx context.Context, orb *types.VersionedOrb, record *OrbRecord) (*DroppedOrb, error) {
+	var lastErr error
+
+	logger.Debugf("examining %q", orb.Ref)
+	events.Emit(&events.Event{Type: events.ImportStarted, Ref: orb.Ref})
+
+	record.Status = StatusDropped
+
+	for iter := 0; iter < maxImportRetries; iter += 1 {
+		if iter > 0 {
+			if err := apicall.Sleep(ctx, sleepBetweenRetries); err != nil {
+				return nil, err
+			}
+			metricRetries.Inc("import")
+			events.Emit(&events.Event{Type: events.ImportRetried, Ref: orb.Ref, Attempt: iter + 1, Category: string(CategoryOf(lastErr)), Error: lastErr.Error()})
+		}
+
+		logger.Debugf("attempt %d of %d for %q", iter+1, maxImportRetries, orb.Ref)
+		record.Attempts = iter + 1
+
+		// cf. https://github.com/CircleCI-Public/circleci-cli/blob/5297a1935de7cf25a0ee09b3a2baf5090ebc2020/references/references.go#L10
+		// cf. https://github.com/CircleCI-Public/circleci-cli/blob/5297a1935de7cf25a0ee09b3a2baf5090ebc2020/api/api.go#L454-L462
+		orbNameParts := strings.Split(orb.Name, "/")
+		ns := orbNameParts[0]
+		shortname := strings.Join(orbNameParts[1:], "/")
+
+		nsCreated, err := im.ensureNamespace(ctx, ns)
+		record.NamespaceCreated = record.NamespaceCreated || nsCreated
+		if lastErr = err; lastErr != nil {
+			if isPermanent(lastErr) || ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		orbID, orbCreated, err := im.ensureOrbID(ctx, orb, ns, shortname)
+		record.OrbCreated = record.OrbCreated || orbCreated
+		if lastErr = err; lastErr != nil {
+			if isPermanent(lastErr) || ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		// Import the versioned orb if/only-if it is not imported yet
+		exists, err := im.versionExists(ctx, orb)
+		if lastErr = err; lastErr != nil {
+			if isPermanent(lastErr) || ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		if exists {
+			record.Status = StatusAlreadyPresent
+			return nil, nil
+		}
+
+		logger.Debugf("importing version %q of orb %q having ID %q", orb.Version, orb.Name, orbID)
 
-	availableOrbRefs := []string{}
-	droppedOrbRefs := []string{}
+		err = apicall.Run(ctx, "ImportOrbVersion", func() error {
+			_, err := circleapi.OrbImportVersion(im.cl, orb.Source, orbID, orb.Version)
+			return err
+		})
+		if err = categorizeError(err); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
 
-	nsExists := make(map[string]bool)
-	orbIDs := make(map[string]string)
+			category := CategoryOf(err)
+
+			// Someone else has imported the same version in the meantime, or after the inventory was taken
+			if category == CategoryVersionConflict {
+				logger.Debugf("%q turned out to be imported already", orb.Ref)
+				record.Status = StatusAlreadyPresent
+				return nil, nil
+			}
+
+			msg := fmt.Sprintf("unable to publish versioned orb %q", orb.Ref)
+			if category == CategoryUnsupportedSyntax {
+				msg += "; possibly because the orb is using unsupported syntax for your server instance"
+			}
+			lastErr = errors.Wrap(err, msg)
+
+			logger.Warnf("error happened while importing %q (%s): %v", orb.Ref, category, lastErr)
+
+			if isPermanent(err) || iter+1 == maxImportRetries {
+				logger.Warnf("giving up to import %q; dropping it to continue", orb.Ref)
+				return &DroppedOrb{Ref: orb.Ref, Category: category, Err: lastErr}, nil
+			}
+
+			continue
+		}
+
+		logger.Infof("imported %q without errors", orb.Ref)
+		metricOrbsImported.Inc()
+		record.Status = StatusImported
+		return nil, nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if isPermanent(lastErr) {
+		return nil, errors.Wrapf(lastErr, "attempted import of %q, but couldn't complete due to a permanent error (%s)", orb.Ref, CategoryOf(lastErr))
+	}
+
+	return nil, errors.Wrapf(lastErr, "attempted import of %q %d time(s), but couldn't complete", orb.Ref, maxImportRetries)
+}
+
+// Group orbs into the given dependency levels, keeping the order in each level; return nil unless levels of all the orbs are given
+func groupIntoKnownLevels(orbs []*types.VersionedOrb, levelOf map[string]int) [][]*types.VersionedOrb {
+	if len(levelOf) == 0 {
+		return nil
+	}
+
+	levels := make(map[int][]*types.VersionedOrb)
+	indices := []int{}
 
-	// cf. https://github.com/CircleCI-Public/circleci-cli/blob/5297a1935de7cf25a0ee09b3a2baf5090ebc2020/cmd/orb_import.go#L135-L167
 	for _, orb := range orbs {
-		var lastErr error
+		level, ok := levelOf[orb.Ref]
+		if !ok {
+			return nil
+		}
 
-		logger.Printf("examining %q", orb.Ref)
+		if _, ok := levels[level]; !ok {
+			indices = append(indices, level)
+		}
+		levels[level] = append(levels[level], orb)
+	}
 
-		for iter := 0; iter < maxImportRetries; iter += 1 {
-			logger.Printf("attempt %d of %d for %q", iter+1, maxImportRetries, orb.Ref)
+	// Orbs may have been excluded from some levels altogether
+	sort.Ints(indices)
 
-			// cf. https://github.com/CircleCI-Public/circleci-cli/blob/5297a1935de7cf25a0ee09b3a2baf5090ebc2020/references/references.go#L10
-			// cf. https://github.com/CircleCI-Public/circleci-cli/blob/5297a1935de7cf25a0ee09b3a2baf5090ebc2020/api/api.go#L454-L462
-			orbNameParts := strings.Split(orb.Name, "/")
-			ns := orbNameParts[0]
-			shortname := strings.Join(orbNameParts[1:], "/")
+	ret := [][]*types.VersionedOrb{}
+	for _, level := range indices {
+		ret = append(ret, levels[level])
+	}
 
-			// Ensure that the namespace exists; create one if needed
-			if _, nsVisited := nsExists[ns]; !nsVisited {
-				// cf. https://github.com/CircleCI-Public/circleci-cli/blob/5297a1935de7cf25a0ee09b3a2baf5090ebc2020/cmd/orb_import.go#L98-L105
-				doesExist, err := circleapi.NamespaceExists(cl, ns)
-				if err != nil {
-					lastErr = errors.Wrapf(err, "error while querying namespace %q", ns)
-					time.Sleep(sleepBetweenRetries)
-					continue
-				}
+	return ret
+}
 
-				if !doesExist {
-					// cf. https://github.com/CircleCI-Public/circleci-cli/blob/master/cmd/orb_import.go#L137-L140
-					_, err := circleapi.CreateImportedNamespace(cl, ns)
-					if err != nil {
-						lastErr = errors.Wrapf(err, "error while creating namespace %q", ns)
-						time.Sleep(sleepBetweenRetries)
-						continue
-					}
+func (im *importer) isPastDeadline() bool {
+	return !im.opts.Deadline.IsZero() && time.Now().After(im.opts.Deadline)
+}
 
-					logger.Printf("new namespace %q created", ns)
+// Import orbs in a dependency level by the given number of workers
+// Return the reasons of dropped orbs, whether each orb failed and records of orbs, in the same order as the given orbs, or the first error happened
+// Records are nil for orbs not started because of the deadline or cancellation, and for those interrupted by cancellation
+func (im *importer) importLevel(ctx context.Context, orbs []*types.VersionedOrb, concurrency int) ([]*DroppedOrb, []bool, []*OrbRecord, error) {
+	dropped := make([]*DroppedOrb, len(orbs))
+	failed := make([]bool, len(orbs))
+	records := make([]*OrbRecord, len(orbs))
+
+	var (
+		wg       sync.WaitGroup
+		errMu    sync.Mutex
+		firstErr error
+	)
+
+	hasFailed := func() bool {
+		errMu.Lock()
+		defer errMu.Unlock()
+		return firstErr != nil
+	}
+
+	jobs := make(chan int)
+
+	for worker := 0; worker < concurrency; worker += 1 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for idx := range jobs {
+				// Orbs handed over while another orb was aborting the import are left remaining
+				if hasFailed() {
+					continue
 				}
 
-				nsExists[ns] = true
-				logger.Printf("cached namespace %q", ns)
-			}
+				records[idx] = &OrbRecord{Ref: orbs[idx].Ref}
 
-			// Ensure that the orb family is registered; register one if needed
-			orbID, familyVisited := orbIDs[orb.Name]
-			if !familyVisited {
-				var err error
+				startedAt := time.Now()
+				droppedOrb, err := im.importIfSatisfied(ctx, orbs[idx], records[idx])
+				records[idx].Duration = time.Since(startedAt)
 
-				// cf. https://github.com/CircleCI-Public/circleci-cli/blob/5297a1935de7cf25a0ee09b3a2baf5090ebc2020/cmd/orb_import.go#L109-L116
-				orbID, err = OrbIDUnsafe(cl, orb.Name)
-				if err != nil {
-					lastErr = errors.Wrapf(err, "error while querying orb %q", ns)
-					time.Sleep(sleepBetweenRetries)
+				// It is unknown whether interrupted orbs were imported; they are looked up again in the next run
+				if err != nil && ctx.Err() != nil {
+					logger.Warnf("import of %q was interrupted; leaving it remaining", orbs[idx].Ref)
+					records[idx] = nil
 					continue
 				}
 
-				if orbID == "" {
-					// https://github.com/CircleCI-Public/circleci-cli/blob/5297a1935de7cf25a0ee09b3a2baf5090ebc2020/cmd/orb_import.go#L144-L147
-					resp, err := circleapi.CreateImportedOrb(cl, ns, shortname)
-					if err != nil {
-						lastErr = errors.Wrapf(err, "error while registering orb %q", orb.Name)
-						time.Sleep(sleepBetweenRetries)
-						continue
+				// The failure is recorded against the orb even if it aborts the import, so that the partial result tells it
+				if err != nil {
+					droppedOrb = &DroppedOrb{Ref: orbs[idx].Ref, Category: CategoryOf(err), Err: err}
+					failed[idx] = true
+
+					if im.opts.KeepGoing {
+						logger.Errorf("recording the failure against %q to continue: %v", orbs[idx].Ref, err)
+					} else {
+						errMu.Lock()
+						if firstErr == nil {
+							firstErr = err
+						}
+						errMu.Unlock()
 					}
-					orbID = resp.ImportOrb.Orb.ID
+				}
 
-					logger.Printf("new orb %q registered with ID %q", orb.Name, orbID)
+				// Dependents of dropped orbs will be dropped without any attempt
+				if droppedOrb != nil {
+					im.markUnavailable(orbs[idx].Ref)
+					metricOrbsDropped.Inc(string(droppedOrb.Category))
+					events.Emit(&events.Event{Type: events.ImportDropped, Ref: orbs[idx].Ref, Category: string(droppedOrb.Category), Error: droppedOrb.Err.Error()})
+				} else {
+					events.Emit(&events.Event{Type: events.ImportSucceeded, Ref: orbs[idx].Ref, Status: string(records[idx].Status)})
 				}
 
-				orbIDs[orb.Name] = orbID
-				logger.Printf("cached orb %q with ID %q", orb.Name, orbID)
+				dropped[idx] = droppedOrb
+			}
+		}()
+	}
+
+	for idx := range orbs {
+		if hasFailed() {
+			break
+		}
+		if ctx.Err() != nil {
+			logger.Warnf("cancelled; interrupting orbs in flight without starting new ones")
+			break
+		}
+		if im.isPastDeadline() {
+			logger.Warnf("deadline reached; finishing orbs in flight without starting new ones")
+			break
+		}
+		jobs <- idx
+	}
+	close(jobs)
+
+	wg.Wait()
+
+	return dropped, failed, records, firstErr
+}
+
+// Import orbs in the given order, which must be the resolved order
+// In the keep-going mode, the result comes along with FailedOrbsError if any orbs failed
+// The result comes along with IncompleteError instead if the import stopped at the deadline or the context is done in the middle
+// Otherwise, errors not specific to orbs abort the import, and the partial result comes along with the error; orbs not attempted are remaining then
+func ImportOrbsWithRetries(ctx context.Context, cl *circleql.Client, orbs []*types.VersionedOrb, opts *ImportOpts) (*Result, error) {
+	logger.Infof("importing listed orbs")
+
+	defer metrics.PhaseDuration.SetSince(time.Now(), "import")
+	defer events.StartPhase("import")()
+
+	result := &Result{
+		Available: []string{},
+		Dropped:   []*DroppedOrb{},
+		Records:   []*OrbRecord{},
+		Failed:    []string{},
+	}
+
+	inventory := opts.Inventory
+	if inventory == nil {
+		namespaces := []string{}
+		hasNamespace := make(map[string]bool)
+		for _, orb := range orbs {
+			if ns := namespaceOf(orb); !hasNamespace[ns] {
+				hasNamespace[ns] = true
+				namespaces = append(namespaces, ns)
 			}
+		}
 
-			// Import the versioned orb if/only-if it is not imported yet
-			// cf. https://github.com/CircleCI-Public/circleci-cli/blob/5297a1935de7cf25a0ee09b3a2baf5090ebc2020/cmd/orb_import.go#L120-L127
-			_, err := circleapi.OrbInfo(cl, orb.Ref)
-			if _, ok := err.(*circleapi.ErrOrbVersionNotExists); ok {
-				logger.Printf("importing version %q of orb %q having ID %q", orb.Version, orb.Name, orbID)
+		var err error
+		if inventory, err = collector.FetchNamespaceInventory(ctx, cl, namespaces); err != nil {
+			logger.Warnf("could not take inventory of the destination; looking up orbs one-by-one instead: %v", err)
+		}
+	}
+	if inventory != nil && opts.MaxInventoryAge > 0 && inventory.Age() > opts.MaxInventoryAge {
+		logger.Warnf("inventory of the destination is stale (taken %v ago); looking up orbs one-by-one instead", inventory.Age().Round(time.Second))
+		inventory = nil
+	}
 
-				_, err = circleapi.OrbImportVersion(cl, orb.Source, orbID, orb.Version)
-				if err != nil {
-					msg := fmt.Sprintf("unable to publish versioned orb %q", orb.Ref)
-					if strings.HasPrefix(err.Error(), "ERROR IN CONFIG FILE") {
-						msg += "; possibly because the orb is using unsupported syntax for your server instance"
-					}
-					lastErr = errors.Wrap(err, msg)
+	im := newImporter(cl, orbs, opts, inventory)
+
+	// Skip quarantined orbs
+	if len(opts.Quarantined) > 0 {
+		isQuarantined := make(map[string]bool)
+		for _, orbRef := range opts.Quarantined {
+			isQuarantined[orbRef] = true
+		}
+
+		unquarantinedOrbs := []*types.VersionedOrb{}
+		for _, orb := range orbs {
+			if isQuarantined[orb.Ref] {
+				im.dropUpFront(result, orb.Ref, StatusSkipped, CategoryQuarantined, fmt.Errorf("%q is quarantined", orb.Ref))
+			} else {
+				unquarantinedOrbs = append(unquarantinedOrbs, orb)
+			}
+		}
 
-					logger.Printf("error happend while importing %q", orb.Ref)
-					logger.Println(lastErr)
+		logger.Infof("%d of %d orb(s) skipped as quarantined", len(orbs)-len(unquarantinedOrbs), len(orbs))
+		orbs = unquarantinedOrbs
+	}
 
-					if iter+1 == maxImportRetries {
-						logger.Printf("giving up to import %q; dropping it to continue", orb.Ref)
-						droppedOrbRefs = append(droppedOrbRefs, orb.Ref)
-						lastErr = nil
+	// Exclude orbs in namespaces blocked by the policy up front, before any mutations
+	if opts.NamespacePolicy != nil {
+		blocked := im.checkNamespacePolicy(ctx, orbs)
 
-						break
-					} else {
-						time.Sleep(sleepBetweenRetries)
-						continue
-					}
-				} else {
-					logger.Printf("imported %q without errors", orb.Ref)
-					availableOrbRefs = append(availableOrbRefs, orb.Ref)
-					lastErr = nil
+		allowedOrbs := []*types.VersionedOrb{}
+		for _, orb := range orbs {
+			if reason, ok := blocked[namespaceOf(orb)]; ok {
+				im.dropUpFront(result, orb.Ref, StatusDropped, CategoryNamespaceBlocked, reason)
+			} else {
+				allowedOrbs = append(allowedOrbs, orb)
+			}
+		}
 
-					break
-				}
-			} else if err != nil {
-				lastErr = errors.Wrapf(err, "error while querying orb info %q", orb.Ref)
-				time.Sleep(sleepBetweenRetries)
+		logger.Infof("%d of %d orb(s) blocked by the namespace policy", len(orbs)-len(allowedOrbs), len(orbs))
+		orbs = allowedOrbs
+	}
+
+	// Exclude incompatible orbs up front
+	if opts.Validate {
+		result.Validation = ValidateOrbs(ctx, cl, orbs, opts.Concurrency)
+
+		compatibleOrbs := []*types.VersionedOrb{}
+		for idx, validationResult := range result.Validation {
+			if validationResult.Compatibility == Incompatible {
+				im.dropUpFront(result, validationResult.Ref, StatusDropped, CategoryUnsupportedSyntax, fmt.Errorf("validation failed: %s", strings.Join(validationResult.Errors, "; ")))
+			} else {
+				compatibleOrbs = append(compatibleOrbs, orbs[idx])
+			}
+		}
+
+		logger.Infof("%d of %d orb(s) excluded as incompatible", len(orbs)-len(compatibleOrbs), len(orbs))
+		orbs = compatibleOrbs
+	}
+
+	orbs = depresolver.Prioritize(orbs, opts.Priority, opts.Popularity)
+
+	concurrency := opts.Concurrency
+	levels := [][]*types.VersionedOrb{orbs}
+	if concurrency > 1 {
+		if levels = groupIntoKnownLevels(orbs, opts.LevelOf); levels == nil {
+			levels = depresolver.GroupIntoLevels(orbs)
+		}
+		logger.Infof("importing orbs in %d dependency level(s) with concurrency %d", len(levels), concurrency)
+	} else {
+		concurrency = 1
+	}
+
+	imported := []*types.VersionedOrb{}
+
+	for levelIdx, level := range levels {
+		if len(levels) > 1 {
+			logger.Infof("importing %d orb(s) in dependency level %d of %d", len(level), levelIdx+1, len(levels))
+		}
+
+		dropped, failed, records, err := im.importLevel(ctx, level, concurrency)
+
+		for idx, orb := range level {
+			if records[idx] == nil {
+				result.Remaining = append(result.Remaining, orb.Ref)
 				continue
+			}
+
+			result.Records = append(result.Records, records[idx])
+
+			if records[idx].Status == StatusImported {
+				imported = append(imported, orb)
+			}
+
+			if dropped[idx] == nil {
+				result.Available = append(result.Available, orb.Ref)
 			} else {
-				availableOrbRefs = append(availableOrbRefs, orb.Ref)
-				lastErr = nil
-				break
+				result.Dropped = append(result.Dropped, dropped[idx])
 			}
+
+			if failed[idx] {
+				result.Failed = append(result.Failed, orb.Ref)
+			}
+		}
+
+		if err != nil {
+			for _, laterLevel := range levels[levelIdx+1:] {
+				for _, orb := range laterLevel {
+					result.Remaining = append(result.Remaining, orb.Ref)
+				}
+			}
+			metricOrbsRemaining.Set(float64(len(result.Remaining)))
+
+			logger.Errorf("import aborted with %d orb(s) remaining", len(result.Remaining))
+			return result, err
 		}
+	}
 
-		if lastErr != nil {
-			return nil, nil, errors.Wrapf(lastErr, "attempted import of %q %d time(s), but couldn't complete", orb.Ref, maxImportRetries)
+	if opts.Verify && ctx.Err() != nil {
+		logger.Warnf("cancelled; skipping verification")
+	} else if opts.Verify && im.isPastDeadline() {
+		logger.Warnf("deadline reached; skipping verification")
+	} else if opts.Verify {
+		result.Verification = VerifyOrbs(ctx, cl, imported, concurrency)
+
+		nMismatched := 0
+		for _, verificationResult := range result.Verification {
+			if verificationResult.Verification == Mismatched {
+				nMismatched += 1
+			}
 		}
+		logger.Infof("%d of %d imported orb(s) mismatched", nMismatched, len(imported))
+	}
+
+	metricOrbsRemaining.Set(float64(len(result.Remaining)))
+
+	if err := ctx.Err(); err != nil {
+		logger.Warnf("import cancelled with %d orb(s) remaining", len(result.Remaining))
+		return result, &IncompleteError{Remaining: result.Remaining, Failed: result.Failed, Err: err}
+	}
+
+	if len(result.Remaining) > 0 {
+		logger.Warnf("import stopped at the deadline with %d orb(s) remaining", len(result.Remaining))
+		return result, &IncompleteError{Remaining: result.Remaining, Failed: result.Failed}
+	}
+
+	if len(result.Failed) > 0 {
+		logger.Warnf("import completed with %d failure(s)", len(result.Failed))
+		return result, &FailedOrbsError{Refs: result.Failed}
 	}
 
-	logger.Printf("import completed!")
+	logger.Infof("import completed!")
 
-	return availableOrbRefs, droppedOrbRefs, nil
+	return result, nil
 }
 
-func ImportOrbsWithNewClient(orbs []*types.VersionedOrb, hostname, apiEndpoint, token string, debug bool) ([]string, []string, error) {
-	return ImportOrbsWithRetries(circleql.NewClient(&http.Client{}, hostname, apiEndpoint, token, debug), orbs)
+func ImportOrbsWithNewClient(ctx context.Context, orbs []*types.VersionedOrb, hostname, apiEndpoint, token string, debug bool, opts *ImportOpts) (*Result, error) {
+	return ImportOrbsWithRetries(ctx, circleql.NewClient(&http.Client{}, hostname, apiEndpoint, token, debug), orbs, opts)
 }
@@ -0,0 +1,477 @@
+package bulkimporter
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/circle-makotom/orbs-sync/collector"
+	depresolver "github.com/circle-makotom/orbs-sync/dependency-resolver"
+	"github.com/circle-makotom/orbs-sync/types"
+)
+
+// Create an orb depending on the given orb refs, as the fixtures of the dependency resolver do
+func newTestOrb(orbRef string, dependencies ...string) *types.VersionedOrb {
+	refParts := strings.SplitN(orbRef, "@", 2)
+	name, version := refParts[0], refParts[1]
+
+	source := "version: 2.1\n"
+	if len(dependencies) > 0 {
+		source += "orbs:\n"
+		for idx, dependency := range dependencies {
+			source += fmt.Sprintf("  dep%d: %s\n", idx, dependency)
+		}
+	}
+
+	return &types.VersionedOrb{Ref: orbRef, Name: name, Version: version, Source: source}
+}
+
+// Create an inventory of the destination, where the namespace exists and orbs are registered without any versions
+func newEmptyInventory(namespace string, orbs []*types.VersionedOrb) *collector.Inventory {
+	inventory := &collector.Inventory{
+		TakenAt:    time.Now(),
+		Namespaces: map[string]bool{namespace: true},
+		OrbIDs:     make(map[string]string),
+		Versions:   make(map[string]bool),
+	}
+
+	for _, orb := range orbs {
+		inventory.OrbIDs[orb.Name] = orbIDOf(orb.Name)
+	}
+
+	return inventory
+}
+
+func TestImportLevelsInOrder(t *testing.T) {
+	orbs := []*types.VersionedOrb{
+		newTestOrb("ns/top@1.0.0", "ns/mid@1", "ns/side@1.0.0"),
+		newTestOrb("ns/mid@1.0.0", "ns/base@1.0.0", "ns/lib@volatile"),
+		newTestOrb("ns/side@1.0.0", "ns/util@1.2"),
+		newTestOrb("ns/base@1.0.0"),
+		newTestOrb("ns/lib@1.0.0"),
+		newTestOrb("ns/lib@1.1.0"),
+		newTestOrb("ns/util@1.2.0"),
+		newTestOrb("ns/leaf@1.0.0", "ns/top@1.0.0"),
+	}
+
+	levels, _, _, err := depresolver.ResolveLevels(context.Background(), orbs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolvedOrder := []*types.VersionedOrb{}
+	for _, level := range levels {
+		resolvedOrder = append(resolvedOrder, level...)
+	}
+
+	cases := []struct {
+		name    string
+		levelOf map[string]int
+	}{
+		{"levels given by the resolver", depresolver.MapLevels(levels)},
+		{"levels computed from sources", nil},
+	}
+
+	for _, c := range cases {
+		dst := newFakeDestination(t)
+		dst.importDelay = 20 * time.Millisecond
+
+		result, err := ImportOrbsWithRetries(context.Background(), dst.client(), resolvedOrder, &ImportOpts{
+			Concurrency: 4,
+			Inventory:   newEmptyInventory("ns", orbs),
+			LevelOf:     c.levelOf,
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if len(result.Available) != len(orbs) {
+			t.Fatalf("%s: %d of %d orb(s) available", c.name, len(result.Available), len(orbs))
+		}
+
+		// Every orb starts only after all the orbs in preceding levels finished
+		spans := dst.importSpans()
+		for levelIdx, level := range levels {
+			for _, orb := range level {
+				for _, precedingLevel := range levels[:levelIdx] {
+					for _, precedingOrb := range precedingLevel {
+						if !spans[orb.Ref].startedAt.After(spans[precedingOrb.Ref].finishedAt) {
+							t.Errorf("%s: %q started before %q in a preceding level finished", c.name, orb.Ref, precedingOrb.Ref)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestGroupIntoKnownLevels(t *testing.T) {
+	orbs := []*types.VersionedOrb{newTestOrb("ns/c@1.0.0"), newTestOrb("ns/a@1.0.0"), newTestOrb("ns/b@1.0.0")}
+
+	refsOf := func(levels [][]*types.VersionedOrb) [][]string {
+		ret := [][]string{}
+		for _, level := range levels {
+			refs := []string{}
+			for _, orb := range level {
+				refs = append(refs, orb.Ref)
+			}
+			ret = append(ret, refs)
+		}
+		return ret
+	}
+
+	// Levels without any orbs left are skipped, and the order in each level is kept
+	levels := groupIntoKnownLevels(orbs, map[string]int{"ns/a@1.0.0": 0, "ns/b@1.0.0": 3, "ns/c@1.0.0": 0, "ns/excluded@1.0.0": 1})
+	if expected := [][]string{{"ns/c@1.0.0", "ns/a@1.0.0"}, {"ns/b@1.0.0"}}; !reflect.DeepEqual(refsOf(levels), expected) {
+		t.Errorf("levels = %q; expected %q", refsOf(levels), expected)
+	}
+
+	if levels := groupIntoKnownLevels(orbs, map[string]int{"ns/a@1.0.0": 0}); levels != nil {
+		t.Errorf("levels = %q; expected nil for orbs without levels", refsOf(levels))
+	}
+	if levels := groupIntoKnownLevels(orbs, nil); levels != nil {
+		t.Errorf("levels = %q; expected nil without levels", refsOf(levels))
+	}
+}
+
+// Versions missing in the inventory are looked up if the inventory cannot tell, instead of being imported again
+func TestImportLooksUpCappedOrbs(t *testing.T) {
+	orbs := []*types.VersionedOrb{newTestOrb("ns/capped@0.9.0"), newTestOrb("ns/capped@1.0.0"), newTestOrb("ns/listed@1.0.0")}
+
+	dst := newFakeDestination(t)
+	dst.versions["ns/capped"] = map[string]string{"0.9.0": orbs[0].Source}
+	dst.versions["ns/listed"] = map[string]string{}
+	dst.rejectImport = func(orbRef string) (string, int) {
+		if orbRef == "ns/capped@0.9.0" {
+			t.Errorf("%q was imported again", orbRef)
+		}
+		return "", http.StatusOK
+	}
+
+	inventory := newEmptyInventory("ns", orbs)
+	inventory.Capped = map[string]bool{"ns/capped": true}
+
+	result, err := ImportOrbsWithRetries(context.Background(), dst.client(), orbs, &ImportOpts{Inventory: inventory})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]OrbStatus{"ns/capped@0.9.0": StatusAlreadyPresent, "ns/capped@1.0.0": StatusImported, "ns/listed@1.0.0": StatusImported}
+	for _, record := range result.Records {
+		if record.Status != expected[record.Ref] {
+			t.Errorf("status of %q = %q; expected %q", record.Ref, record.Status, expected[record.Ref])
+		}
+	}
+	if len(result.Records) != len(expected) {
+		t.Errorf("%d orb(s) processed; expected %d", len(result.Records), len(expected))
+	}
+}
+
+// Without an inventory given, the importer takes one of the namespaces of the orbs only, and looks up nothing one-by-one
+func TestImportTakesInventoryOfNamespaces(t *testing.T) {
+	orbs := []*types.VersionedOrb{newTestOrb("ns/present@1.0.0"), newTestOrb("ns/present@1.1.0"), newTestOrb("fresh/new@1.0.0")}
+
+	dst := newFakeDestination(t)
+	dst.namespaces["ns"] = true
+	dst.namespaces["unrelated"] = true
+	dst.versions["ns/present"] = map[string]string{"1.0.0": orbs[0].Source}
+	dst.versions["unrelated/orb"] = map[string]string{"1.0.0": orbs[0].Source}
+	dst.failRequest = func(variables map[string]interface{}) int {
+		if _, ok := variables["orbVersionRef"]; ok {
+			t.Errorf("%q was looked up one-by-one", variables["orbVersionRef"])
+		}
+		return http.StatusOK
+	}
+
+	result, err := ImportOrbsWithRetries(context.Background(), dst.client(), orbs, &ImportOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if inventoried := sortedCopy(dst.inventoried); !reflect.DeepEqual(inventoried, []string{"fresh", "ns"}) {
+		t.Errorf("took inventory of %q; expected the namespaces of the orbs", inventoried)
+	}
+
+	expected := map[string]OrbStatus{"ns/present@1.0.0": StatusAlreadyPresent, "ns/present@1.1.0": StatusImported, "fresh/new@1.0.0": StatusImported}
+	for _, record := range result.Records {
+		if record.Status != expected[record.Ref] {
+			t.Errorf("status of %q = %q; expected %q", record.Ref, record.Status, expected[record.Ref])
+		}
+	}
+	if len(result.Records) != len(expected) {
+		t.Errorf("%d orb(s) processed; expected %d", len(result.Records), len(expected))
+	}
+}
+
+func TestIncompleteError(t *testing.T) {
+	cases := []struct {
+		err      *IncompleteError
+		expected string
+	}{
+		{&IncompleteError{Remaining: []string{"ns/a@1.0.0"}}, "import stopped at the deadline, leaving 1 orb(s) remaining"},
+		{&IncompleteError{Remaining: []string{"ns/a@1.0.0"}, Err: context.Canceled}, "import was cancelled (context canceled), leaving 1 orb(s) remaining"},
+		{
+			&IncompleteError{Remaining: []string{"ns/a@1.0.0"}, Failed: []string{"ns/b@1.0.0", "ns/c@1.0.0"}},
+			"import stopped at the deadline, leaving 1 orb(s) remaining, after 2 orb(s) failed to be imported: ns/b@1.0.0, ns/c@1.0.0",
+		},
+	}
+
+	for _, c := range cases {
+		if actual := c.err.Error(); actual != c.expected {
+			t.Errorf("Error() = %q; expected %q", actual, c.expected)
+		}
+	}
+}
+
+// Make retries immediate for the test
+func withoutSleepBetweenRetries(t *testing.T) {
+	original := sleepBetweenRetries
+	sleepBetweenRetries = 0
+	t.Cleanup(func() { sleepBetweenRetries = original })
+}
+
+// Find the dropped orb by the ref
+func droppedOrbOf(result *Result, orbRef string) *DroppedOrb {
+	for _, droppedOrb := range result.Dropped {
+		if droppedOrb.Ref == orbRef {
+			return droppedOrb
+		}
+	}
+
+	return nil
+}
+
+func TestImportKeepGoing(t *testing.T) {
+	withoutSleepBetweenRetries(t)
+
+	orbs := []*types.VersionedOrb{
+		newTestOrb("broken/bad@1.0.0"),
+		newTestOrb("ns/good@1.0.0"),
+		newTestOrb("ns/dependent@1.0.0", "broken/bad@1.0.0"),
+		newTestOrb("ns/transitive@1.0.0", "ns/dependent@1"),
+	}
+
+	for _, concurrency := range []int{1, 2} {
+		dst := newFakeDestination(t)
+
+		// Lookups of the namespace keep failing, which is not specific to the orb
+		dst.failRequest = func(variables map[string]interface{}) int {
+			if variables["name"] == "broken" {
+				return http.StatusServiceUnavailable
+			}
+			return http.StatusOK
+		}
+		dst.rejectImport = func(orbRef string) (string, int) {
+			if orbRef != "ns/good@1.0.0" {
+				t.Errorf("concurrency %d: %q was attempted", concurrency, orbRef)
+			}
+			return "", http.StatusOK
+		}
+
+		result, err := ImportOrbsWithRetries(context.Background(), dst.client(), orbs, &ImportOpts{
+			Concurrency: concurrency,
+			KeepGoing:   true,
+			Inventory:   newEmptyInventory("ns", orbs),
+		})
+
+		var failedErr *FailedOrbsError
+		if !errors.As(err, &failedErr) || !reflect.DeepEqual(failedErr.Refs, []string{"broken/bad@1.0.0"}) {
+			t.Errorf("concurrency %d: error = %v; expected FailedOrbsError of broken/bad@1.0.0", concurrency, err)
+		}
+		if result == nil {
+			t.Fatalf("concurrency %d: no result", concurrency)
+		}
+
+		if !reflect.DeepEqual(result.Failed, []string{"broken/bad@1.0.0"}) {
+			t.Errorf("concurrency %d: failed = %q; expected broken/bad@1.0.0 only", concurrency, result.Failed)
+		}
+		if !reflect.DeepEqual(result.Available, []string{"ns/good@1.0.0"}) {
+			t.Errorf("concurrency %d: available = %q; expected ns/good@1.0.0 only", concurrency, result.Available)
+		}
+
+		// The failure is recorded against the orb, and its dependents are dropped without any attempt
+		if droppedOrb := droppedOrbOf(result, "broken/bad@1.0.0"); droppedOrb == nil || droppedOrb.Category != CategoryTransient || !strings.Contains(droppedOrb.Err.Error(), `namespace "broken"`) {
+			t.Errorf("concurrency %d: broken/bad@1.0.0 dropped as %+v; expected a transient failure of the namespace", concurrency, droppedOrb)
+		}
+		for orbRef, dependency := range map[string]string{"ns/dependent@1.0.0": "broken/bad@1.0.0", "ns/transitive@1.0.0": "ns/dependent@1.0.0"} {
+			if droppedOrb := droppedOrbOf(result, orbRef); droppedOrb == nil || droppedOrb.Category != CategoryDependencyDropped || droppedOrb.Dependency != dependency {
+				t.Errorf("concurrency %d: %q dropped as %+v; expected %s by %q", concurrency, orbRef, droppedOrb, CategoryDependencyDropped, dependency)
+			}
+		}
+	}
+}
+
+// Errors not specific to orbs abort the import, leaving the partial result with orbs not attempted remaining, including those in later levels
+func TestImportAborted(t *testing.T) {
+	withoutSleepBetweenRetries(t)
+
+	orbs := []*types.VersionedOrb{
+		newTestOrb("broken/bad@1.0.0"),
+		newTestOrb("ns/good@1.0.0"),
+		newTestOrb("ns/dependent@1.0.0", "broken/bad@1.0.0"),
+	}
+	levelOf := map[string]int{"broken/bad@1.0.0": 0, "ns/good@1.0.0": 1, "ns/dependent@1.0.0": 1}
+
+	for _, concurrency := range []int{1, 2} {
+		dst := newFakeDestination(t)
+		dst.failRequest = func(variables map[string]interface{}) int {
+			if variables["name"] == "broken" {
+				return http.StatusServiceUnavailable
+			}
+			return http.StatusOK
+		}
+
+		result, err := ImportOrbsWithRetries(context.Background(), dst.client(), orbs, &ImportOpts{
+			Concurrency: concurrency,
+			LevelOf:     levelOf,
+			Inventory:   newEmptyInventory("ns", orbs),
+		})
+
+		if err == nil || !strings.Contains(err.Error(), `namespace "broken"`) {
+			t.Errorf("concurrency %d: error = %v; expected the failure of the namespace", concurrency, err)
+		}
+		var incompleteErr *IncompleteError
+		if errors.As(err, &incompleteErr) {
+			t.Errorf("concurrency %d: aborted import told as incomplete", concurrency)
+		}
+		if result == nil {
+			t.Fatalf("concurrency %d: no partial result", concurrency)
+		}
+
+		if !reflect.DeepEqual(result.Failed, []string{"broken/bad@1.0.0"}) {
+			t.Errorf("concurrency %d: failed = %q; expected broken/bad@1.0.0 only", concurrency, result.Failed)
+		}
+		if droppedOrb := droppedOrbOf(result, "broken/bad@1.0.0"); droppedOrb == nil || droppedOrb.Category != CategoryTransient {
+			t.Errorf("concurrency %d: broken/bad@1.0.0 dropped as %+v; expected a transient failure", concurrency, droppedOrb)
+		}
+		if expected := []string{"ns/good@1.0.0", "ns/dependent@1.0.0"}; !reflect.DeepEqual(result.Remaining, expected) {
+			t.Errorf("concurrency %d: remaining = %q; expected %q", concurrency, result.Remaining, expected)
+		}
+		if len(result.Available) != 0 || len(dst.mutationsSoFar()) != 0 {
+			t.Errorf("concurrency %d: available = %q and mutations = %q; expected nothing imported", concurrency, result.Available, dst.mutationsSoFar())
+		}
+	}
+}
+
+// Orbs rejected permanently drop their dependents transitively without any attempt, while other satisfying versions keep dependents going
+func TestImportDropsDependents(t *testing.T) {
+	orbs := []*types.VersionedOrb{
+		newTestOrb("ns/base@1.0.0"),
+		newTestOrb("ns/lib@1.0.0"),
+		newTestOrb("ns/lib@1.1.0"),
+		newTestOrb("ns/mid@1.0.0", "ns/base@1.0.0"),
+		newTestOrb("ns/loose@1.0.0", "ns/lib@1"),
+		newTestOrb("ns/pinned@1.0.0", "ns/lib@1.1.0"),
+		newTestOrb("ns/top@1.0.0", "ns/mid@1", "ns/loose@1.0.0"),
+		newTestOrb("ns/leaf@1.0.0", "ns/top@1.0.0"),
+	}
+
+	for _, concurrency := range []int{1, 4} {
+		dst := newFakeDestination(t)
+
+		attempted := make(map[string]bool)
+		var mu sync.Mutex
+		dst.rejectImport = func(orbRef string) (string, int) {
+			mu.Lock()
+			attempted[orbRef] = true
+			mu.Unlock()
+
+			if orbRef == "ns/base@1.0.0" || orbRef == "ns/lib@1.1.0" {
+				return "Error in config file: unknown key", http.StatusOK
+			}
+			return "", http.StatusOK
+		}
+
+		result, err := ImportOrbsWithRetries(context.Background(), dst.client(), orbs, &ImportOpts{
+			Concurrency: concurrency,
+			Inventory:   newEmptyInventory("ns", orbs),
+		})
+		if err != nil {
+			t.Fatalf("concurrency %d: %v", concurrency, err)
+		}
+
+		expected := map[string]string{
+			"ns/mid@1.0.0":    "ns/base@1.0.0",
+			"ns/top@1.0.0":    "ns/mid@1.0.0",
+			"ns/leaf@1.0.0":   "ns/top@1.0.0",
+			"ns/pinned@1.0.0": "ns/lib@1.1.0",
+		}
+		for orbRef, dependency := range expected {
+			if attempted[orbRef] {
+				t.Errorf("concurrency %d: %q was attempted", concurrency, orbRef)
+			}
+			if droppedOrb := droppedOrbOf(result, orbRef); droppedOrb == nil || droppedOrb.Category != CategoryDependencyDropped || droppedOrb.Dependency != dependency {
+				t.Errorf("concurrency %d: %q dropped as %+v; expected %s by %q", concurrency, orbRef, droppedOrb, CategoryDependencyDropped, dependency)
+			}
+		}
+
+		for _, orbRef := range []string{"ns/base@1.0.0", "ns/lib@1.1.0"} {
+			if droppedOrb := droppedOrbOf(result, orbRef); droppedOrb == nil || droppedOrb.Category != CategoryUnsupportedSyntax {
+				t.Errorf("concurrency %d: %q dropped as %+v; expected %s", concurrency, orbRef, droppedOrb, CategoryUnsupportedSyntax)
+			}
+		}
+
+		// ns/loose falls back to ns/lib@1.0.0
+		if expectedAvailable := []string{"ns/lib@1.0.0", "ns/loose@1.0.0"}; !reflect.DeepEqual(sortedCopy(result.Available), expectedAvailable) {
+			t.Errorf("concurrency %d: available = %q; expected %q", concurrency, result.Available, expectedAvailable)
+		}
+
+		for _, record := range result.Records {
+			if _, ok := expected[record.Ref]; ok && (record.Status != StatusSkipped || record.Attempts != 0) {
+				t.Errorf("concurrency %d: %q %s after %d attempt(s); expected %s without any", concurrency, record.Ref, record.Status, record.Attempts, StatusSkipped)
+			}
+		}
+	}
+}
+
+func sortedCopy(refs []string) []string {
+	ret := append([]string{}, refs...)
+	sort.Strings(ret)
+
+	return ret
+}
+
+// Orbs dropped up front, e.g., as quarantined, drop their dependents as well
+func TestImportDropsDependentsOfQuarantined(t *testing.T) {
+	orbs := []*types.VersionedOrb{
+		newTestOrb("ns/base@1.0.0"),
+		newTestOrb("ns/mid@1.0.0", "ns/base@1.0.0"),
+		newTestOrb("ns/top@1.0.0", "ns/mid@1"),
+		newTestOrb("ns/other@1.0.0"),
+	}
+
+	dst := newFakeDestination(t)
+	dst.rejectImport = func(orbRef string) (string, int) {
+		if orbRef != "ns/other@1.0.0" {
+			t.Errorf("%q was attempted", orbRef)
+		}
+		return "", http.StatusOK
+	}
+
+	result, err := ImportOrbsWithRetries(context.Background(), dst.client(), orbs, &ImportOpts{
+		Inventory:   newEmptyInventory("ns", orbs),
+		Quarantined: []string{"ns/base@1.0.0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if droppedOrb := droppedOrbOf(result, "ns/base@1.0.0"); droppedOrb == nil || droppedOrb.Category != CategoryQuarantined {
+		t.Errorf("ns/base@1.0.0 dropped as %+v; expected %s", droppedOrb, CategoryQuarantined)
+	}
+	for orbRef, dependency := range map[string]string{"ns/mid@1.0.0": "ns/base@1.0.0", "ns/top@1.0.0": "ns/mid@1.0.0"} {
+		if droppedOrb := droppedOrbOf(result, orbRef); droppedOrb == nil || droppedOrb.Category != CategoryDependencyDropped || droppedOrb.Dependency != dependency {
+			t.Errorf("%q dropped as %+v; expected %s by %q", orbRef, droppedOrb, CategoryDependencyDropped, dependency)
+		}
+	}
+	if !reflect.DeepEqual(result.Available, []string{"ns/other@1.0.0"}) {
+		t.Errorf("available = %q; expected ns/other@1.0.0 only", result.Available)
+	}
+}
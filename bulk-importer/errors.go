@@ -0,0 +1,156 @@
+package bulkimporter
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	circleapi "github.com/CircleCI-Public/circleci-cli/api"
+	circleql "github.com/CircleCI-Public/circleci-cli/api/graphql"
+)
+
+type ErrorCategory string
+
+const (
+	CategoryUnsupportedSyntax ErrorCategory = "unsupported-syntax"
+	CategoryPermissionDenied  ErrorCategory = "permission-denied"
+	CategoryVersionConflict   ErrorCategory = "version-conflict"
+	CategorySizeLimit         ErrorCategory = "size-limit"
+	CategoryTransient         ErrorCategory = "transient"
+	CategoryUnknown           ErrorCategory = "unknown"
+
+	// Orbs are dropped without any attempt if their dependencies are dropped
+	CategoryDependencyDropped ErrorCategory = "dependency-dropped"
+
+	// Orbs are dropped without any attempt if their namespaces are not allowed by the policy
+	CategoryNamespaceBlocked ErrorCategory = "namespace-blocked"
+
+	// Orbs are dropped without any attempt if they are quarantined because of failures in previous runs
+	CategoryQuarantined ErrorCategory = "quarantined"
+)
+
+// ImportError is an error from the destination categorized by its nature
+type ImportError struct {
+	Category ErrorCategory
+	Err      error
+}
+
+func (e *ImportError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ImportError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent errors never go away by retrying; unknown errors are assumed to be transient
+func (e *ImportError) IsPermanent() bool {
+	return e.Category != CategoryTransient && e.Category != CategoryUnknown
+}
+
+// Phrases in GraphQL error messages, checked in this order
+// Only specific phrases are listed, as a broad word may appear in messages of unrelated failures, e.g. in orb sources quoted by the server
+var categoryPhrases = []struct {
+	category ErrorCategory
+	phrases  []string
+}{
+	{CategoryUnsupportedSyntax, []string{"error in config file"}},
+	{CategoryPermissionDenied, []string{"not authorized", "unauthorized", "permission denied", "access denied", "forbidden"}},
+	{CategoryVersionConflict, []string{"already exists"}},
+	{CategorySizeLimit, []string{"too large", "exceeds the maximum size", "size limit"}},
+	{CategoryTransient, []string{"timed out", "too many requests", "rate limit"}},
+}
+
+// circleci-cli reports non-200 responses as errors like "failure calling GraphQL API: 502 Bad Gateway"
+var statusPattern = regexp.MustCompile(`failure calling GraphQL API: (\d{3})`)
+
+// Categorize an HTTP status code returned by the GraphQL API
+func categorizeStatus(statusCode int) ErrorCategory {
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return CategoryPermissionDenied
+	case statusCode == http.StatusConflict:
+		return CategoryVersionConflict
+	case statusCode == http.StatusRequestEntityTooLarge:
+		return CategorySizeLimit
+	case statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests || statusCode >= 500:
+		return CategoryTransient
+	default:
+		return CategoryUnknown
+	}
+}
+
+// Categorize an error returned by circleapi functions or GraphQL queries
+// Return nil if err is nil, or err as-is if it is already categorized
+func categorizeError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var importErr *ImportError
+	if errors.As(err, &importErr) {
+		return err
+	}
+
+	// Failures in connections, including those closed in the middle of responses
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return &ImportError{Category: CategoryTransient, Err: err}
+	}
+
+	// GraphQL errors are reported either out-of-band or in payloads
+	var messages []string
+	var outOfBandErrs circleql.ResponseErrorsCollection
+	var payloadErrs circleapi.GQLErrorsCollection
+	if errors.As(err, &outOfBandErrs) {
+		for _, gqlErr := range outOfBandErrs {
+			messages = append(messages, gqlErr.Message)
+		}
+	} else if errors.As(err, &payloadErrs) {
+		for _, gqlErr := range payloadErrs {
+			messages = append(messages, gqlErr.Message)
+		}
+	} else if match := statusPattern.FindStringSubmatch(err.Error()); match != nil {
+		statusCode, _ := strconv.Atoi(match[1])
+		return &ImportError{Category: categorizeStatus(statusCode), Err: err}
+	} else if strings.Contains(err.Error(), "decoding response: ") {
+		// Responses cut off by proxies or the server going down cannot be decoded
+		return &ImportError{Category: CategoryTransient, Err: err}
+	} else {
+		return &ImportError{Category: CategoryUnknown, Err: err}
+	}
+
+	for _, entry := range categoryPhrases {
+		for _, message := range messages {
+			message = strings.ToLower(message)
+
+			for _, phrase := range entry.phrases {
+				if strings.Contains(message, phrase) {
+					return &ImportError{Category: entry.category, Err: err}
+				}
+			}
+		}
+	}
+
+	return &ImportError{Category: CategoryUnknown, Err: err}
+}
+
+// Return the category of the error, or an empty string if the error is not categorized
+func CategoryOf(err error) ErrorCategory {
+	var importErr *ImportError
+	if errors.As(err, &importErr) {
+		return importErr.Category
+	}
+
+	return ""
+}
+
+func isPermanent(err error) bool {
+	var importErr *ImportError
+	return errors.As(err, &importErr) && importErr.IsPermanent()
+}
@@ -0,0 +1,112 @@
+package bulkimporter
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	circleapi "github.com/CircleCI-Public/circleci-cli/api"
+	circleql "github.com/CircleCI-Public/circleci-cli/api/graphql"
+)
+
+func TestCategorizeError(t *testing.T) {
+	cases := []struct {
+		name     string
+		err      error
+		expected ErrorCategory
+	}{
+		{"bad gateway", fmt.Errorf("failure calling GraphQL API: %s", "502 Bad Gateway"), CategoryTransient},
+		{"unavailable", errors.Wrap(fmt.Errorf("failure calling GraphQL API: %s", "503 Service Unavailable"), "error while querying orb"), CategoryTransient},
+		{"rate limited", fmt.Errorf("failure calling GraphQL API: %s", "429 Too Many Requests"), CategoryTransient},
+		{"unauthorized", fmt.Errorf("failure calling GraphQL API: %s", "401 Unauthorized"), CategoryPermissionDenied},
+		{"forbidden", fmt.Errorf("failure calling GraphQL API: %s", "403 Forbidden"), CategoryPermissionDenied},
+		{"conflict status", fmt.Errorf("failure calling GraphQL API: %s", "409 Conflict"), CategoryVersionConflict},
+		{"too large status", fmt.Errorf("failure calling GraphQL API: %s", "413 Request Entity Too Large"), CategorySizeLimit},
+		{"not found status", fmt.Errorf("failure calling GraphQL API: %s", "404 Not Found"), CategoryUnknown},
+		{"connection refused", &url.Error{Op: "Post", URL: "https://circleci.example.com/graphql-unstable", Err: &net.OpError{Op: "dial", Net: "tcp", Err: fmt.Errorf("connect: connection refused")}}, CategoryTransient},
+		{"cut off response", errors.Wrap(io.ErrUnexpectedEOF, "decoding response"), CategoryTransient},
+		{"unparsable response", errors.Wrap(fmt.Errorf("invalid character '<' looking for beginning of value"), "decoding response"), CategoryTransient},
+		{"out-of-band version conflict", circleql.ResponseErrorsCollection{{Message: "Cannot import an orb version that already exists"}}, CategoryVersionConflict},
+		{"payload version conflict", circleapi.GQLErrorsCollection{{Message: "Orb version 1.0.0 already exists", Type: "ORB_VERSION_EXISTS"}}, CategoryVersionConflict},
+		{"payload config error", circleapi.GQLErrorsCollection{{Message: "ERROR IN CONFIG FILE:\n[#/jobs/build] extraneous key [resource_class] is not permitted"}}, CategoryUnsupportedSyntax},
+		{"payload permission", circleapi.GQLErrorsCollection{{Message: "You are not authorized to import orbs"}}, CategoryPermissionDenied},
+		{"payload size limit", circleapi.GQLErrorsCollection{{Message: "Orb source is too large"}}, CategorySizeLimit},
+		{"out-of-band rate limit", circleql.ResponseErrorsCollection{{Message: "Too many requests, please retry later"}}, CategoryTransient},
+
+		// Broad words in messages do not categorize them
+		{"conflict in a message", circleapi.GQLErrorsCollection{{Message: "Job name conflicts with a command"}}, CategoryUnknown},
+		{"exceeds in a message", circleapi.GQLErrorsCollection{{Message: "Parameter default exceeds the enum values"}}, CategoryUnknown},
+		{"connection in a message", circleql.ResponseErrorsCollection{{Message: "Unknown argument connection on field orbs"}}, CategoryUnknown},
+		{"status code in a message", circleapi.GQLErrorsCollection{{Message: "Value api: 503 is not allowed"}}, CategoryUnknown},
+		{"uncategorized", fmt.Errorf("something went wrong"), CategoryUnknown},
+	}
+
+	for _, c := range cases {
+		if actual := CategoryOf(categorizeError(c.err)); actual != c.expected {
+			t.Errorf("%s: category of %q = %q; expected %q", c.name, c.err, actual, c.expected)
+		}
+	}
+
+	if err := categorizeError(nil); err != nil {
+		t.Errorf("categorizeError(nil) = %v; expected nil", err)
+	}
+}
+
+func TestCategorizeErrorKeepsCategories(t *testing.T) {
+	categorized := &ImportError{Category: CategoryNamespaceBlocked, Err: fmt.Errorf("namespace %q does not exist", "ns")}
+
+	if actual := categorizeError(errors.Wrap(categorized, "error while importing")); CategoryOf(actual) != CategoryNamespaceBlocked {
+		t.Errorf("category of a wrapped categorized error = %q; expected %q", CategoryOf(actual), CategoryNamespaceBlocked)
+	}
+	if actual := CategoryOf(fmt.Errorf("uncategorized")); actual != "" {
+		t.Errorf("CategoryOf(uncategorized) = %q; expected empty", actual)
+	}
+}
+
+// Errors as circleci-cli returns them for responses from the server
+func TestCategorizeErrorFromClient(t *testing.T) {
+	cases := []struct {
+		name     string
+		respond  func(w http.ResponseWriter)
+		expected ErrorCategory
+	}{
+		{"bad gateway", func(w http.ResponseWriter) { w.WriteHeader(http.StatusBadGateway) }, CategoryTransient},
+		{"forbidden", func(w http.ResponseWriter) { w.WriteHeader(http.StatusForbidden) }, CategoryPermissionDenied},
+		{"cut off response", func(w http.ResponseWriter) { fmt.Fprint(w, `{"data": {"orb": `) }, CategoryTransient},
+		{"out-of-band error", func(w http.ResponseWriter) {
+			fmt.Fprint(w, `{"data": null, "errors": [{"message": "Cannot import an orb version that already exists"}]}`)
+		}, CategoryVersionConflict},
+	}
+
+	for _, c := range cases {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { c.respond(w) }))
+
+		cl := circleql.NewClient(server.Client(), server.URL, "graphql-unstable", "token", false)
+		var resp struct{}
+		err := cl.Run(circleql.NewRequest(`query { orb(name: "ns/orb") { id } }`), &resp)
+
+		server.Close()
+
+		if err == nil {
+			t.Errorf("%s: no error returned", c.name)
+		} else if actual := CategoryOf(categorizeError(err)); actual != c.expected {
+			t.Errorf("%s: category of %q = %q; expected %q", c.name, err, actual, c.expected)
+		}
+	}
+
+	// Connections refused by a server gone away
+	server := httptest.NewServer(http.NotFoundHandler())
+	cl := circleql.NewClient(server.Client(), server.URL, "graphql-unstable", "token", false)
+	server.Close()
+
+	var resp struct{}
+	if err := cl.Run(circleql.NewRequest(`query { orb(name: "ns/orb") { id } }`), &resp); CategoryOf(categorizeError(err)) != CategoryTransient {
+		t.Errorf("category of %q = %q; expected %q", err, CategoryOf(categorizeError(err)), CategoryTransient)
+	}
+}
@@ -0,0 +1,266 @@
+package bulkimporter
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	circleql "github.com/CircleCI-Public/circleci-cli/api/graphql"
+
+	"github.com/circle-makotom/orbs-sync/logging"
+)
+
+// importSpan records when the destination received an import of an orb and when it responded
+type importSpan struct {
+	ref        string
+	startedAt  time.Time
+	finishedAt time.Time
+}
+
+// fakeDestination serves the GraphQL API of a CircleCI server instance in memory, for the importer to import orbs to
+type fakeDestination struct {
+	server *httptest.Server
+
+	mu         sync.Mutex
+	namespaces map[string]bool
+	versions   map[string]map[string]string
+	spans      []*importSpan
+
+	// importDelay holds each import, so that concurrent imports overlap
+	importDelay time.Duration
+
+	// rejectImport returns an error message to reject the import of the orb with, or an HTTP status to fail with, if any
+	rejectImport func(orbRef string) (string, int)
+
+	// failRequest returns an HTTP status to fail any request with by its variables, e.g., lookups of a namespace, if other than 200
+	failRequest func(variables map[string]interface{}) int
+
+	// validationErrors returns messages of validation errors for the orb source, if any
+	validationErrors func(source string) []string
+
+	// storeSource returns the source the destination keeps for the imported one, e.g., reformatted
+	storeSource func(orbRef, source string) string
+
+	// mutations lists namespaces, orbs and versions created, in the order they were
+	mutations []string
+
+	// inventoried lists namespaces the importer took inventory of
+	inventoried []string
+}
+
+func newFakeDestination(t *testing.T) *fakeDestination {
+	SetLogger(logging.NewWithWriter("bulk-importer", ioutil.Discard, logging.FormatText, logging.LevelError))
+
+	dst := &fakeDestination{
+		namespaces:   make(map[string]bool),
+		versions:     make(map[string]map[string]string),
+		rejectImport: func(string) (string, int) { return "", http.StatusOK },
+		failRequest:  func(map[string]interface{}) int { return http.StatusOK },
+
+		validationErrors: func(string) []string { return nil },
+		storeSource:      func(_, source string) string { return source },
+	}
+	dst.server = httptest.NewServer(http.HandlerFunc(dst.serveGraphQL))
+	t.Cleanup(dst.server.Close)
+
+	return dst
+}
+
+func (dst *fakeDestination) client() *circleql.Client {
+	return circleql.NewClient(dst.server.Client(), dst.server.URL, "graphql-unstable", "token", false)
+}
+
+func orbIDOf(orbName string) string {
+	return "id:" + orbName
+}
+
+func (dst *fakeDestination) serveGraphQL(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Query     string
+		Variables map[string]interface{}
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if status := dst.failRequest(request.Variables); status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+
+	stringVar := func(name string) string {
+		value, _ := request.Variables[name].(string)
+		return value
+	}
+
+	var data interface{}
+	status := http.StatusOK
+
+	switch {
+	case strings.Contains(request.Query, "importOrbVersion("):
+		orbRef := strings.TrimPrefix(stringVar("orbId"), "id:") + "@" + stringVar("version")
+		data, status = dst.importVersion(orbRef, stringVar("config"))
+	case strings.Contains(request.Query, "orbConfig("):
+		errs := []map[string]string{}
+		for _, message := range dst.validationErrors(stringVar("config")) {
+			errs = append(errs, map[string]string{"message": message})
+		}
+		data = map[string]interface{}{"orbConfig": map[string]interface{}{"valid": len(errs) == 0, "errors": errs, "sourceYaml": stringVar("config"), "outputYaml": ""}}
+	case strings.Contains(request.Query, "importNamespace("):
+		dst.mu.Lock()
+		dst.namespaces[stringVar("name")] = true
+		dst.mutations = append(dst.mutations, "namespace "+stringVar("name"))
+		dst.mu.Unlock()
+		data = map[string]interface{}{"importNamespace": map[string]interface{}{"namespace": map[string]string{"id": "id:" + stringVar("name")}, "errors": []string{}}}
+	case strings.Contains(request.Query, "importOrb("):
+		name := strings.TrimPrefix(stringVar("registryNamespaceId"), "id:") + "/" + stringVar("name")
+		dst.mu.Lock()
+		if _, ok := dst.versions[name]; !ok {
+			dst.versions[name] = make(map[string]string)
+		}
+		dst.mutations = append(dst.mutations, "orb "+name)
+		dst.mu.Unlock()
+		data = map[string]interface{}{"importOrb": map[string]interface{}{"orb": map[string]string{"id": orbIDOf(name)}, "errors": []string{}}}
+	case strings.Contains(request.Query, "ListNamespaceOrbInventory"):
+		data = map[string]interface{}{"registryNamespace": dst.namespaceInventory(stringVar("namespace"))}
+	case strings.Contains(request.Query, "registryNamespace("):
+		dst.mu.Lock()
+		id := ""
+		if dst.namespaces[stringVar("name")] {
+			id = "id:" + stringVar("name")
+		}
+		dst.mu.Unlock()
+		data = map[string]interface{}{"registryNamespace": map[string]string{"id": id}}
+	case strings.Contains(request.Query, "orbVersion("):
+		name, version := strings.Split(stringVar("orbVersionRef"), "@")[0], strings.Split(stringVar("orbVersionRef"), "@")[1]
+		dst.mu.Lock()
+		source, exists := dst.versions[name][version]
+		dst.mu.Unlock()
+		if exists {
+			data = map[string]interface{}{"orbVersion": map[string]interface{}{"id": "id:" + name + "@" + version, "version": version, "source": source, "orb": map[string]string{"id": orbIDOf(name), "name": name}}}
+		} else {
+			data = map[string]interface{}{"orbVersion": nil}
+		}
+	case strings.Contains(request.Query, "orb("):
+		dst.mu.Lock()
+		id := ""
+		if _, ok := dst.versions[stringVar("name")]; ok {
+			id = orbIDOf(stringVar("name"))
+		}
+		dst.mu.Unlock()
+		data = map[string]interface{}{"orb": map[string]string{"id": id}}
+	default:
+		http.Error(w, "unknown query", http.StatusBadRequest)
+		return
+	}
+
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+}
+
+func (dst *fakeDestination) importVersion(orbRef, source string) (interface{}, int) {
+	span := &importSpan{ref: orbRef, startedAt: time.Now()}
+	time.Sleep(dst.importDelay)
+
+	respond := func(errorMessages ...string) interface{} {
+		errs := []map[string]string{}
+		for _, message := range errorMessages {
+			errs = append(errs, map[string]string{"message": message})
+		}
+
+		return map[string]interface{}{"importOrbVersion": map[string]interface{}{"orb": map[string]string{"version": strings.Split(orbRef, "@")[1]}, "errors": errs}}
+	}
+
+	if message, status := dst.rejectImport(orbRef); status != http.StatusOK {
+		return nil, status
+	} else if message != "" {
+		return respond(message), http.StatusOK
+	}
+
+	dst.mu.Lock()
+	defer dst.mu.Unlock()
+
+	name, version := strings.Split(orbRef, "@")[0], strings.Split(orbRef, "@")[1]
+	if _, exists := dst.versions[name][version]; exists {
+		return respond("Cannot import an orb version that already exists"), http.StatusOK
+	}
+	if dst.versions[name] == nil {
+		dst.versions[name] = make(map[string]string)
+	}
+	dst.versions[name][version] = dst.storeSource(orbRef, source)
+	dst.mutations = append(dst.mutations, "version "+orbRef)
+
+	span.finishedAt = time.Now()
+	dst.spans = append(dst.spans, span)
+
+	return respond(), http.StatusOK
+}
+
+// List orbs in the namespace with their versions, all in one page
+func (dst *fakeDestination) namespaceInventory(ns string) interface{} {
+	dst.mu.Lock()
+	defer dst.mu.Unlock()
+
+	dst.inventoried = append(dst.inventoried, ns)
+	if !dst.namespaces[ns] {
+		return nil
+	}
+
+	edges := []interface{}{}
+	for name, versions := range dst.versions {
+		if !strings.HasPrefix(name, ns+"/") {
+			continue
+		}
+
+		versionNodes := []interface{}{}
+		for version := range versions {
+			versionNodes = append(versionNodes, map[string]string{"version": version})
+		}
+		edges = append(edges, map[string]interface{}{"cursor": name, "node": map[string]interface{}{"id": orbIDOf(name), "name": name, "versions": versionNodes}})
+	}
+
+	return map[string]interface{}{"id": "id:" + ns, "orbs": map[string]interface{}{"edges": edges, "pageInfo": map[string]bool{"hasNextPage": false}}}
+}
+
+// Tell whether the version of the orb has been imported
+func (dst *fakeDestination) hasVersion(orbRef string) bool {
+	dst.mu.Lock()
+	defer dst.mu.Unlock()
+
+	name, version := strings.Split(orbRef, "@")[0], strings.Split(orbRef, "@")[1]
+	_, exists := dst.versions[name][version]
+
+	return exists
+}
+
+// Return namespaces, orbs and versions created so far
+func (dst *fakeDestination) mutationsSoFar() []string {
+	dst.mu.Lock()
+	defer dst.mu.Unlock()
+
+	return append([]string{}, dst.mutations...)
+}
+
+// Return the span of each orb imported successfully
+func (dst *fakeDestination) importSpans() map[string]*importSpan {
+	dst.mu.Lock()
+	defer dst.mu.Unlock()
+
+	ret := make(map[string]*importSpan)
+	for _, span := range dst.spans {
+		ret[span.ref] = span
+	}
+
+	return ret
+}
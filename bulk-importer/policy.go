@@ -0,0 +1,110 @@
+package bulkimporter
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	circleapi "github.com/CircleCI-Public/circleci-cli/api"
+
+	apicall "github.com/circle-makotom/orbs-sync/api-call"
+	"github.com/circle-makotom/orbs-sync/types"
+)
+
+// NamespacePolicy tells which namespaces on the destination orbs can be imported into
+// Patterns are namespaces or glob patterns like mirror-*
+type NamespacePolicy struct {
+	// Only namespaces matching any of Allow are allowed, unless Allow is empty
+	Allow []string
+
+	// Namespaces matching any of Deny are never allowed, even if they match Allow
+	Deny []string
+
+	// NeverCreate makes orbs importable only into existing namespaces
+	NeverCreate bool
+}
+
+// Build a policy, or return nil if nothing is restricted
+func NewNamespacePolicy(allow, deny []string, neverCreate bool) (*NamespacePolicy, error) {
+	if len(allow) == 0 && len(deny) == 0 && !neverCreate {
+		return nil, nil
+	}
+
+	for _, pattern := range append(append([]string{}, allow...), deny...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid namespace pattern %q", pattern)
+		}
+	}
+
+	return &NamespacePolicy{Allow: allow, Deny: deny, NeverCreate: neverCreate}, nil
+}
+
+func matchesAny(patterns []string, ns string) bool {
+	for _, pattern := range patterns {
+		if matched, err := path.Match(pattern, ns); err == nil && matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Tell why orbs cannot be imported into the namespace by the allowlist and the denylist, or return nil if they can
+func (p *NamespacePolicy) Check(ns string) error {
+	if matchesAny(p.Deny, ns) {
+		return fmt.Errorf("namespace %q is denied by the policy", ns)
+	}
+
+	if len(p.Allow) > 0 && !matchesAny(p.Allow, ns) {
+		return fmt.Errorf("namespace %q is not allowed by the policy", ns)
+	}
+
+	return nil
+}
+
+func namespaceOf(orb *types.VersionedOrb) string {
+	return strings.Split(orb.Name, "/")[0]
+}
+
+// Check namespaces of the orbs against the policy, before any mutations on the destination
+// Return the reason for each namespace in which orbs are blocked
+// Namespaces which could not be looked up are left to the importer, which never creates namespaces in the NeverCreate mode anyway
+func (im *importer) checkNamespacePolicy(ctx context.Context, orbs []*types.VersionedOrb) map[string]error {
+	blocked := make(map[string]error)
+	policy := im.opts.NamespacePolicy
+
+	for _, orb := range orbs {
+		ns := namespaceOf(orb)
+		if _, checked := blocked[ns]; checked {
+			continue
+		}
+
+		blocked[ns] = policy.Check(ns)
+
+		if blocked[ns] == nil && policy.NeverCreate && (im.inventory == nil || !im.inventory.Namespaces[ns]) {
+			var doesExist bool
+			err := apicall.Run(ctx, "NamespaceExists", func() (err error) {
+				doesExist, err = circleapi.NamespaceExists(im.cl, ns)
+				return err
+			})
+			if err = categorizeError(err); err != nil {
+				logger.Warnf("could not check if namespace %q exists; leaving it to the importer: %v", ns, err)
+			} else if !doesExist {
+				blocked[ns] = fmt.Errorf("namespace %q does not exist, and the policy forbids creating namespaces", ns)
+			}
+		}
+	}
+
+	for ns, reason := range blocked {
+		if reason == nil {
+			delete(blocked, ns)
+		} else {
+			logger.Warnf("%v", reason)
+		}
+	}
+
+	return blocked
+}
@@ -0,0 +1,145 @@
+package bulkimporter
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	nsmapper "github.com/circle-makotom/orbs-sync/namespace-mapper"
+	"github.com/circle-makotom/orbs-sync/types"
+)
+
+func TestNewNamespacePolicy(t *testing.T) {
+	if policy, err := NewNamespacePolicy(nil, nil, false); policy != nil || err != nil {
+		t.Errorf("got %+v, %v; expected no policy without restrictions", policy, err)
+	}
+
+	if _, err := NewNamespacePolicy([]string{"mirror-["}, nil, false); err == nil {
+		t.Error("an invalid pattern was accepted")
+	}
+}
+
+func TestNamespacePolicyCheck(t *testing.T) {
+	cases := []struct {
+		allow   []string
+		deny    []string
+		ns      string
+		blocked bool
+	}{
+		{nil, []string{"internal"}, "circleci", false},
+		{nil, []string{"internal"}, "internal", true},
+		{[]string{"mirror-*"}, nil, "mirror-circleci", false},
+		{[]string{"mirror-*"}, nil, "circleci", true},
+		{[]string{"mirror-*", "tools"}, nil, "tools", false},
+		{[]string{"mirror-*"}, []string{"mirror-internal"}, "mirror-internal", true},
+		{[]string{"mirror-internal"}, []string{"mirror-*"}, "mirror-internal", true},
+	}
+
+	for _, c := range cases {
+		policy := &NamespacePolicy{Allow: c.allow, Deny: c.deny}
+		if err := policy.Check(c.ns); (err != nil) != c.blocked {
+			t.Errorf("allow %q, deny %q: %q got %v; expected blocked = %t", c.allow, c.deny, c.ns, err, c.blocked)
+		}
+	}
+}
+
+// Orbs are checked against the policy by namespaces after the mapping, and nothing is created for blocked ones
+func TestImportNamespacePolicy(t *testing.T) {
+	mapping, err := nsmapper.NewMapping(map[string]string{"circleci": "mirror-circleci", "internal": "mirror-internal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srcOrbs := []*types.VersionedOrb{
+		newTestOrb("circleci/node@1.0.0"),
+		newTestOrb("internal/secret@1.0.0"),
+		newTestOrb("other/tool@1.0.0"),
+	}
+	orbs, err := mapping.MapOrbs(srcOrbs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name       string
+		policy     *NamespacePolicy
+		namespaces []string
+
+		expectedAvailable []string
+		expectedBlocked   []string
+		expectedMutations []string
+	}{
+		{
+			"allow",
+			&NamespacePolicy{Allow: []string{"mirror-*"}},
+			nil,
+			[]string{"mirror-circleci/node@1.0.0", "mirror-internal/secret@1.0.0"},
+			[]string{"other/tool@1.0.0"},
+			[]string{"namespace mirror-circleci", "namespace mirror-internal", "orb mirror-circleci/node", "orb mirror-internal/secret", "version mirror-circleci/node@1.0.0", "version mirror-internal/secret@1.0.0"},
+		},
+		{
+			"deny",
+			&NamespacePolicy{Deny: []string{"other"}},
+			nil,
+			[]string{"mirror-circleci/node@1.0.0", "mirror-internal/secret@1.0.0"},
+			[]string{"other/tool@1.0.0"},
+			[]string{"namespace mirror-circleci", "namespace mirror-internal", "orb mirror-circleci/node", "orb mirror-internal/secret", "version mirror-circleci/node@1.0.0", "version mirror-internal/secret@1.0.0"},
+		},
+		{
+			"deny wins over allow",
+			&NamespacePolicy{Allow: []string{"mirror-*"}, Deny: []string{"mirror-internal"}},
+			nil,
+			[]string{"mirror-circleci/node@1.0.0"},
+			[]string{"mirror-internal/secret@1.0.0", "other/tool@1.0.0"},
+			[]string{"namespace mirror-circleci", "orb mirror-circleci/node", "version mirror-circleci/node@1.0.0"},
+		},
+		{
+			"never create",
+			&NamespacePolicy{NeverCreate: true},
+			[]string{"mirror-circleci"},
+			[]string{"mirror-circleci/node@1.0.0"},
+			[]string{"mirror-internal/secret@1.0.0", "other/tool@1.0.0"},
+			[]string{"orb mirror-circleci/node", "version mirror-circleci/node@1.0.0"},
+		},
+		{
+			"never create nor allow",
+			&NamespacePolicy{Allow: []string{"mirror-*"}, NeverCreate: true},
+			[]string{"mirror-circleci", "other"},
+			[]string{"mirror-circleci/node@1.0.0"},
+			[]string{"mirror-internal/secret@1.0.0", "other/tool@1.0.0"},
+			[]string{"orb mirror-circleci/node", "version mirror-circleci/node@1.0.0"},
+		},
+	}
+
+	for _, c := range cases {
+		dst := newFakeDestination(t)
+		for _, ns := range c.namespaces {
+			dst.namespaces[ns] = true
+		}
+
+		result, err := ImportOrbsWithRetries(context.Background(), dst.client(), orbs, &ImportOpts{NamespacePolicy: c.policy})
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+
+		if available := sortedCopy(result.Available); !reflect.DeepEqual(available, c.expectedAvailable) {
+			t.Errorf("%s: available = %q; expected %q", c.name, available, c.expectedAvailable)
+		}
+
+		blocked := []string{}
+		for _, droppedOrb := range result.Dropped {
+			if droppedOrb.Category != CategoryNamespaceBlocked {
+				t.Errorf("%s: %q dropped as %s; expected %s", c.name, droppedOrb.Ref, droppedOrb.Category, CategoryNamespaceBlocked)
+			}
+			blocked = append(blocked, droppedOrb.Ref)
+		}
+		if blocked = sortedCopy(blocked); !reflect.DeepEqual(blocked, c.expectedBlocked) {
+			t.Errorf("%s: blocked = %q; expected %q", c.name, blocked, c.expectedBlocked)
+		}
+
+		if mutations := sortedCopy(dst.mutationsSoFar()); !reflect.DeepEqual(mutations, c.expectedMutations) {
+			t.Errorf("%s: mutations = %q; expected %q", c.name, mutations, c.expectedMutations)
+		}
+	}
+}
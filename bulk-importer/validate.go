@@ -0,0 +1,165 @@
+package bulkimporter
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	circleapi "github.com/CircleCI-Public/circleci-cli/api"
+	circleql "github.com/CircleCI-Public/circleci-cli/api/graphql"
+
+	apicall "github.com/circle-makotom/orbs-sync/api-call"
+	depresolver "github.com/circle-makotom/orbs-sync/dependency-resolver"
+	"github.com/circle-makotom/orbs-sync/events"
+	"github.com/circle-makotom/orbs-sync/metrics"
+	"github.com/circle-makotom/orbs-sync/types"
+)
+
+type Compatibility string
+
+const (
+	Compatible   Compatibility = "compatible"
+	Incompatible Compatibility = "incompatible"
+
+	// Inconclusive means that validation did not tell anything for sure, e.g., because dependencies are not imported yet
+	Inconclusive Compatibility = "inconclusive"
+)
+
+type ValidationResult struct {
+	Ref           string
+	Compatibility Compatibility
+	Errors        []string
+}
+
+// Validate the source of an orb on the destination, just like `circleci orb validate` does
+// Return messages of validation errors if the orb is invalid
+//
+// cf. https://github.com/CircleCI-Public/circleci-cli/blob/5297a1935de7cf25a0ee09b3a2baf5090ebc2020/api/api.go#L578-L611
+// circleapi.OrbQuery is not used herein because it takes a path to the source rather than the source itself
+func ValidateOrbSource(ctx context.Context, cl *circleql.Client, orbSrc string) ([]string, error) {
+	var response circleapi.OrbConfigResponse
+
+	query := `
+		query ValidateOrb ($config: String!) {
+			orbConfig(orbYaml: $config) {
+				valid,
+				errors { message },
+				sourceYaml,
+				outputYaml
+			}
+		}
+	`
+
+	request := circleql.NewRequest(query)
+	request.SetToken(cl.Token)
+	request.Var("config", orbSrc)
+
+	if err := apicall.Run(ctx, "ValidateOrb", func() error { return cl.Run(request, &response) }); err != nil {
+		return nil, errors.Wrap(err, "GraphQL query failed")
+	}
+
+	messages := []string{}
+	for _, validationErr := range response.OrbConfig.ConfigResponse.Errors {
+		messages = append(messages, validationErr.Message)
+	}
+
+	if !response.OrbConfig.ConfigResponse.Valid && len(messages) == 0 {
+		messages = append(messages, "the orb is invalid for unknown reasons")
+	}
+
+	return messages, nil
+}
+
+func validateOne(ctx context.Context, cl *circleql.Client, orb *types.VersionedOrb) *ValidationResult {
+	var messages []string
+	var err error
+
+	for iter := 0; iter < maxImportRetries; iter += 1 {
+		if iter > 0 {
+			if err = apicall.Sleep(ctx, sleepBetweenRetries); err != nil {
+				break
+			}
+			metricRetries.Inc("validate")
+		}
+
+		messages, err = ValidateOrbSource(ctx, cl, orb.Source)
+		if err = categorizeError(err); err == nil || isPermanent(err) || ctx.Err() != nil {
+			break
+		}
+	}
+
+	if err != nil {
+		logger.Warnf("could not validate %q: %v", orb.Ref, err)
+		return &ValidationResult{Ref: orb.Ref, Compatibility: Inconclusive, Errors: []string{err.Error()}}
+	}
+
+	if len(messages) == 0 {
+		return &ValidationResult{Ref: orb.Ref, Compatibility: Compatible, Errors: []string{}}
+	}
+
+	// Errors mentioning dependencies may go away once the dependencies are imported
+	dependencies, _ := depresolver.ListDependencies(orb)
+	for _, message := range messages {
+		for _, dependency := range dependencies {
+			name := strings.Split(dependency, "@")[0]
+
+			if strings.Contains(message, name) {
+				return &ValidationResult{Ref: orb.Ref, Compatibility: Inconclusive, Errors: messages}
+			}
+		}
+	}
+
+	return &ValidationResult{Ref: orb.Ref, Compatibility: Incompatible, Errors: messages}
+}
+
+// Validate orbs on the destination before any mutations, with the given number of workers
+// Return validation results in the same order as the given orbs
+func ValidateOrbs(ctx context.Context, cl *circleql.Client, orbs []*types.VersionedOrb, concurrency int) []*ValidationResult {
+	logger.Infof("validating %d orb(s) on the destination", len(orbs))
+
+	defer metrics.PhaseDuration.SetSince(time.Now(), "validate")
+	defer events.StartPhase("validate")()
+
+	ret := make([]*ValidationResult, len(orbs))
+
+	runWorkers(len(orbs), concurrency, func(idx int) {
+		ret[idx] = validateOne(ctx, cl, orbs[idx])
+
+		if ret[idx].Compatibility != Compatible {
+			logger.Warnf("%q is %s: %s", orbs[idx].Ref, ret[idx].Compatibility, strings.Join(ret[idx].Errors, "; "))
+		}
+	})
+
+	return ret
+}
+
+// Run the job for each of 0 to n-1 by the given number of workers, and wait for all of them
+func runWorkers(n, concurrency int, job func(idx int)) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var wg sync.WaitGroup
+	jobs := make(chan int)
+
+	for worker := 0; worker < concurrency; worker += 1 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for idx := range jobs {
+				job(idx)
+			}
+		}()
+	}
+
+	for idx := 0; idx < n; idx += 1 {
+		jobs <- idx
+	}
+	close(jobs)
+
+	wg.Wait()
+}
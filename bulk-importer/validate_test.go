@@ -0,0 +1,116 @@
+package bulkimporter
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/circle-makotom/orbs-sync/types"
+)
+
+// Create an orb whose source is marked with its ref, for the fake destination to tell orbs by sources
+func newMarkedTestOrb(orbRef string, dependencies ...string) *types.VersionedOrb {
+	orb := newTestOrb(orbRef, dependencies...)
+	orb.Source += "# " + orbRef + "\n"
+
+	return orb
+}
+
+func TestValidateOne(t *testing.T) {
+	withoutSleepBetweenRetries(t)
+
+	cases := []struct {
+		name     string
+		orb      *types.VersionedOrb
+		messages []string
+		status   int
+		expected Compatibility
+	}{
+		{"valid", newMarkedTestOrb("ns/valid@1.0.0", "ns/lib@1.0.0"), nil, http.StatusOK, Compatible},
+		{"invalid", newMarkedTestOrb("ns/invalid@1.0.0"), []string{"Error in config file: unknown key"}, http.StatusOK, Incompatible},
+		{"invalid mentioning a dependency", newMarkedTestOrb("ns/user@1.0.0", "ns/lib@1.0.0"), []string{"Cannot find orb ns/lib@1.0.0"}, http.StatusOK, Inconclusive},
+		{"invalid mentioning another orb", newMarkedTestOrb("ns/user@1.0.0", "ns/lib@1.0.0"), []string{"Cannot find orb ns/other@1.0.0"}, http.StatusOK, Incompatible},
+		{"validation failing", newMarkedTestOrb("ns/valid@1.0.0"), nil, http.StatusServiceUnavailable, Inconclusive},
+	}
+
+	for _, c := range cases {
+		dst := newFakeDestination(t)
+		dst.validationErrors = func(string) []string { return c.messages }
+		dst.failRequest = func(variables map[string]interface{}) int {
+			if _, ok := variables["config"]; ok {
+				return c.status
+			}
+			return http.StatusOK
+		}
+
+		result := validateOne(context.Background(), dst.client(), c.orb)
+		if result.Ref != c.orb.Ref || result.Compatibility != c.expected {
+			t.Errorf("%s: %q is %s; expected %s", c.name, result.Ref, result.Compatibility, c.expected)
+		}
+		if c.messages != nil && !reflect.DeepEqual(result.Errors, c.messages) {
+			t.Errorf("%s: errors = %q; expected %q", c.name, result.Errors, c.messages)
+		}
+		if c.status != http.StatusOK && len(result.Errors) != 1 {
+			t.Errorf("%s: errors = %q; expected the failure of validation", c.name, result.Errors)
+		}
+	}
+}
+
+// Incompatible orbs are dropped as unsupported syntax before any mutations, and their dependents are dropped as well
+func TestImportValidate(t *testing.T) {
+	orbs := []*types.VersionedOrb{
+		newMarkedTestOrb("ns/lib@1.0.0"),
+		newMarkedTestOrb("fresh/bad@1.0.0"),
+		newMarkedTestOrb("ns/dependent@1.0.0", "fresh/bad@1.0.0"),
+		newMarkedTestOrb("ns/user@1.0.0", "ns/lib@1.0.0"),
+	}
+
+	dst := newFakeDestination(t)
+	dst.namespaces["ns"] = true
+	dst.validationErrors = func(source string) []string {
+		if mutations := dst.mutationsSoFar(); len(mutations) > 0 {
+			t.Errorf("validated after mutations %q", mutations)
+		}
+
+		switch {
+		case strings.Contains(source, "# fresh/bad@"):
+			return []string{"Error in config file: unknown key"}
+		case strings.Contains(source, "# ns/user@"):
+			return []string{"Cannot find orb ns/lib@1.0.0"}
+		default:
+			return nil
+		}
+	}
+
+	result, err := ImportOrbsWithRetries(context.Background(), dst.client(), orbs, &ImportOpts{Validate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compatibility := make(map[string]Compatibility)
+	for _, validationResult := range result.Validation {
+		compatibility[validationResult.Ref] = validationResult.Compatibility
+	}
+	expected := map[string]Compatibility{"ns/lib@1.0.0": Compatible, "fresh/bad@1.0.0": Incompatible, "ns/dependent@1.0.0": Compatible, "ns/user@1.0.0": Inconclusive}
+	if !reflect.DeepEqual(compatibility, expected) {
+		t.Errorf("compatibility = %v; expected %v", compatibility, expected)
+	}
+
+	if droppedOrb := droppedOrbOf(result, "fresh/bad@1.0.0"); droppedOrb == nil || droppedOrb.Category != CategoryUnsupportedSyntax {
+		t.Errorf("fresh/bad@1.0.0 dropped as %+v; expected %s", droppedOrb, CategoryUnsupportedSyntax)
+	}
+	if droppedOrb := droppedOrbOf(result, "ns/dependent@1.0.0"); droppedOrb == nil || droppedOrb.Category != CategoryDependencyDropped {
+		t.Errorf("ns/dependent@1.0.0 dropped as %+v; expected %s", droppedOrb, CategoryDependencyDropped)
+	}
+
+	// Inconclusive orbs are imported anyway, and nothing is created for incompatible ones
+	if expectedAvailable := []string{"ns/lib@1.0.0", "ns/user@1.0.0"}; !reflect.DeepEqual(sortedCopy(result.Available), expectedAvailable) {
+		t.Errorf("available = %q; expected %q", result.Available, expectedAvailable)
+	}
+	expectedMutations := []string{"orb ns/lib", "version ns/lib@1.0.0", "orb ns/user", "version ns/user@1.0.0"}
+	if mutations := dst.mutationsSoFar(); !reflect.DeepEqual(mutations, expectedMutations) {
+		t.Errorf("mutations = %q; expected %q", mutations, expectedMutations)
+	}
+}
@@ -0,0 +1,136 @@
+package bulkimporter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	circleapi "github.com/CircleCI-Public/circleci-cli/api"
+	circleql "github.com/CircleCI-Public/circleci-cli/api/graphql"
+
+	apicall "github.com/circle-makotom/orbs-sync/api-call"
+	"github.com/circle-makotom/orbs-sync/events"
+	"github.com/circle-makotom/orbs-sync/metrics"
+	"github.com/circle-makotom/orbs-sync/types"
+)
+
+type Verification string
+
+const (
+	Matched    Verification = "matched"
+	Mismatched Verification = "mismatched"
+
+	// Unverified means that the source could not be fetched from the destination
+	Unverified Verification = "unverified"
+)
+
+type VerificationResult struct {
+	Ref          string
+	Verification Verification
+
+	// Detail tells the first difference if mismatched, or the error if unverified
+	Detail string
+}
+
+// Normalize an orb source so that differences only in comments, quotes, indents and the order of keys go away
+func normalizeYAML(orbSrc string) (string, error) {
+	var parsed interface{}
+	if err := yaml.Unmarshal([]byte(orbSrc), &parsed); err != nil {
+		return "", err
+	}
+
+	normalized, err := yaml.Marshal(parsed)
+	if err != nil {
+		return "", err
+	}
+
+	return string(normalized), nil
+}
+
+// Describe the first different line between two normalized sources
+func describeDifference(imported, fetched string) string {
+	importedLines := strings.Split(imported, "\n")
+	fetchedLines := strings.Split(fetched, "\n")
+
+	for idx := 0; idx < len(importedLines) || idx < len(fetchedLines); idx += 1 {
+		var importedLine, fetchedLine string
+		if idx < len(importedLines) {
+			importedLine = importedLines[idx]
+		}
+		if idx < len(fetchedLines) {
+			fetchedLine = fetchedLines[idx]
+		}
+
+		if importedLine != fetchedLine {
+			return fmt.Sprintf("line %d of the normalized source: imported %q, but got %q", idx+1, importedLine, fetchedLine)
+		}
+	}
+
+	return ""
+}
+
+func verifyOne(ctx context.Context, cl *circleql.Client, orb *types.VersionedOrb) *VerificationResult {
+	var fetched string
+	var err error
+
+	for iter := 0; iter < maxImportRetries; iter += 1 {
+		if iter > 0 {
+			if err = apicall.Sleep(ctx, sleepBetweenRetries); err != nil {
+				break
+			}
+			metricRetries.Inc("verify")
+		}
+
+		err = apicall.Run(ctx, "OrbSource", func() (err error) {
+			fetched, err = circleapi.OrbSource(cl, orb.Ref)
+			return err
+		})
+		if err = categorizeError(err); err == nil || isPermanent(err) || ctx.Err() != nil {
+			break
+		}
+	}
+
+	if err != nil {
+		return &VerificationResult{Ref: orb.Ref, Verification: Unverified, Detail: err.Error()}
+	}
+
+	normalizedImported, err := normalizeYAML(orb.Source)
+	if err != nil {
+		return &VerificationResult{Ref: orb.Ref, Verification: Unverified, Detail: fmt.Sprintf("could not parse the imported source: %v", err)}
+	}
+
+	normalizedFetched, err := normalizeYAML(fetched)
+	if err != nil {
+		return &VerificationResult{Ref: orb.Ref, Verification: Mismatched, Detail: fmt.Sprintf("could not parse the source on the destination: %v", err)}
+	}
+
+	if normalizedImported != normalizedFetched {
+		return &VerificationResult{Ref: orb.Ref, Verification: Mismatched, Detail: describeDifference(normalizedImported, normalizedFetched)}
+	}
+
+	return &VerificationResult{Ref: orb.Ref, Verification: Matched}
+}
+
+// Verify that sources of the imported orbs on the destination match those imported, with the given number of workers
+// Return verification results in the same order as the given orbs
+func VerifyOrbs(ctx context.Context, cl *circleql.Client, orbs []*types.VersionedOrb, concurrency int) []*VerificationResult {
+	logger.Infof("verifying %d imported orb(s) on the destination", len(orbs))
+
+	defer metrics.PhaseDuration.SetSince(time.Now(), "verify")
+	defer events.StartPhase("verify")()
+
+	ret := make([]*VerificationResult, len(orbs))
+
+	runWorkers(len(orbs), concurrency, func(idx int) {
+		ret[idx] = verifyOne(ctx, cl, orbs[idx])
+
+		if ret[idx].Verification != Matched {
+			logger.Warnf("%q is %s: %s", orbs[idx].Ref, ret[idx].Verification, ret[idx].Detail)
+		}
+	})
+
+	return ret
+}
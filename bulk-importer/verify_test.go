@@ -0,0 +1,116 @@
+package bulkimporter
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/circle-makotom/orbs-sync/types"
+)
+
+const verifiedSource = `version: 2.1
+description: "An orb"
+orbs:
+  node: circleci/node@5.0.0
+commands:
+  greet:
+    steps:
+      - run: echo hello
+`
+
+func TestNormalizeYAML(t *testing.T) {
+	cases := []struct {
+		name   string
+		source string
+		same   bool
+	}{
+		{"as-is", verifiedSource, true},
+		{"comments", "# An orb\n" + strings.Replace(verifiedSource, "description:", "description: # quoted\n   ", 1), true},
+		{"quotes", strings.Replace(strings.Replace(verifiedSource, `"An orb"`, "'An orb'", 1), "circleci/node@5.0.0", `"circleci/node@5.0.0"`, 1), true},
+		{"indents", strings.Replace(strings.Replace(verifiedSource, "\n  ", "\n    ", -1), "\n      - run", "\n        - run", 1), true},
+		{"order of keys", "orbs:\n  node: circleci/node@5.0.0\ncommands:\n  greet:\n    steps:\n      - run: echo hello\ndescription: \"An orb\"\nversion: 2.1\n", true},
+		{"values", strings.Replace(verifiedSource, "echo hello", "echo bye", 1), false},
+		{"order of steps", strings.Replace(verifiedSource, "      - run: echo hello\n", "      - checkout\n      - run: echo hello\n", 1), false},
+		{"types", strings.Replace(verifiedSource, "version: 2.1", `version: "2.1"`, 1), false},
+	}
+
+	expected, err := normalizeYAML(verifiedSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range cases {
+		normalized, err := normalizeYAML(c.source)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+
+		if (normalized == expected) != c.same {
+			t.Errorf("%s: normalized to\n%s\nexpected the same as the original = %t\n%s", c.name, normalized, c.same, expected)
+		}
+	}
+}
+
+func TestImportVerify(t *testing.T) {
+	withoutSleepBetweenRetries(t)
+
+	orbs := []*types.VersionedOrb{
+		{Ref: "ns/reformatted@1.0.0", Name: "ns/reformatted", Version: "1.0.0", Source: verifiedSource},
+		{Ref: "ns/changed@1.0.0", Name: "ns/changed", Version: "1.0.0", Source: verifiedSource},
+		{Ref: "ns/unfetchable@1.0.0", Name: "ns/unfetchable", Version: "1.0.0", Source: verifiedSource},
+	}
+
+	dst := newFakeDestination(t)
+	dst.storeSource = func(orbRef, source string) string {
+		switch orbRef {
+		case "ns/reformatted@1.0.0":
+			return "# Reformatted\n" + strings.Replace(source, `"An orb"`, "'An orb'", 1)
+		case "ns/changed@1.0.0":
+			return strings.Replace(source, "echo hello", "echo bye", 1)
+		default:
+			return source
+		}
+	}
+	// Fetching the source fails, while looking it up before the import does not
+	dst.failRequest = func(variables map[string]interface{}) int {
+		if orbRef, _ := variables["orbVersionRef"].(string); orbRef == "ns/unfetchable@1.0.0" && dst.hasVersion(orbRef) {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	}
+
+	result, err := ImportOrbsWithRetries(context.Background(), dst.client(), orbs, &ImportOpts{Verify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]Verification{"ns/reformatted@1.0.0": Matched, "ns/changed@1.0.0": Mismatched, "ns/unfetchable@1.0.0": Unverified}
+	if len(result.Verification) != len(expected) {
+		t.Fatalf("verified %d orb(s); expected %d", len(result.Verification), len(expected))
+	}
+	for _, verificationResult := range result.Verification {
+		if verificationResult.Verification != expected[verificationResult.Ref] {
+			t.Errorf("%q is %s: %s; expected %s", verificationResult.Ref, verificationResult.Verification, verificationResult.Detail, expected[verificationResult.Ref])
+		}
+	}
+
+	for _, verificationResult := range result.Verification {
+		switch verificationResult.Ref {
+		case "ns/changed@1.0.0":
+			if !strings.HasPrefix(verificationResult.Detail, "line 4 of the normalized source: imported") || !strings.HasSuffix(verificationResult.Detail, `- run: echo bye"`) {
+				t.Errorf("mismatch is described as %q; expected the first different line", verificationResult.Detail)
+			}
+		case "ns/unfetchable@1.0.0":
+			if !strings.Contains(verificationResult.Detail, "503") {
+				t.Errorf("unverified orb is described as %q; expected the error", verificationResult.Detail)
+			}
+		}
+	}
+
+	// Orbs not matching are imported anyway
+	if len(result.Available) != len(orbs) {
+		t.Errorf("available = %q; expected all the orbs", result.Available)
+	}
+}
@@ -1,24 +1,56 @@
 package cmd
 
 import (
-	"io/ioutil"
-	"log"
+	"context"
+	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 
+	atomicfile "github.com/circle-makotom/orbs-sync/atomic-file"
 	bulkimporter "github.com/circle-makotom/orbs-sync/bulk-importer"
+	depresolver "github.com/circle-makotom/orbs-sync/dependency-resolver"
+	"github.com/circle-makotom/orbs-sync/logging"
+	nsmapper "github.com/circle-makotom/orbs-sync/namespace-mapper"
+	"github.com/circle-makotom/orbs-sync/quarantine"
+	"github.com/circle-makotom/orbs-sync/report"
 )
 
 type BulkImportOpts struct {
-	Hostname          string
-	Token             string
-	OrderedListPath   string
-	OrbSrcDirPath     string
-	AvailableListPath string
-	DroppedListPath   string
+	Hostname              string
+	Token                 string
+	OrderedListPath       string
+	OrbSrcDirPath         string
+	AvailableListPath     string
+	DroppedListPath       string
+	Concurrency           int
+	KeepGoing             bool
+	Validate              bool
+	Verify                bool
+	CompatibilityPath     string
+	NamespaceMap          map[string]string
+	ReportPath            string
+	IllegibleListPath     string
+	UnresolvedMapPath     string
+	AllowedNamespaces     []string
+	DeniedNamespaces      []string
+	NeverCreateNamespaces bool
+	QuarantinePath        string
+	QuarantineTTL         time.Duration
+	ServerVersion         string
+	RetryQuarantined      bool
+	Priority              string
+	PopularityPath        string
+	MaxDuration           time.Duration
+	RemainingListPath     string
+	LockPath              string
+	LockTTL               time.Duration
+	LockWait              time.Duration
+	JUnitPath             string
+	MetricsTextfilePath   string
 }
 
 func cmdBulkImport() *cobra.Command {
@@ -27,8 +59,8 @@ func cmdBulkImport() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "bulk-import",
 		Short: "Import multiple orbs at once",
-		RunE: func(_ *cobra.Command, _ []string) error {
-			return BulkImport(opts)
+		RunE: func(c *cobra.Command, _ []string) error {
+			return BulkImport(c.Context(), opts)
 		},
 	}
 
@@ -39,6 +71,31 @@ func cmdBulkImport() *cobra.Command {
 	flags.StringVar(&opts.OrbSrcDirPath, "src", "orbs", "Path to the directory containing orb sources")
 	flags.StringVar(&opts.AvailableListPath, "available", "orbs-available.txt", "Path to the file to put the list of orbs ensured to be available by import")
 	flags.StringVar(&opts.DroppedListPath, "dropped", "orbs-dropped.txt", "Path to the file to put the list of dropped orbs while importing")
+	flags.StringVar(&opts.RemainingListPath, "remaining", "orbs-remaining.txt", "Path to the file to put the list of orbs not attempted because of --max-duration or cancellation, which can be given to --list in the next run")
+	flags.IntVar(&opts.Concurrency, "concurrency", 1, "Number of orbs to import at once in each dependency level")
+	flags.BoolVar(&opts.Validate, "validate", false, "Validate orbs on the destination before importing, and exclude incompatible ones")
+	flags.StringVar(&opts.CompatibilityPath, "compatibility", "orbs-compatibility.txt", "Path to the file to put the compatibility report if --validate is given")
+	flags.BoolVar(&opts.Verify, "verify", false, "Fetch sources of imported orbs from the destination, and report those not matching what was imported")
+	flags.StringToStringVar(&opts.NamespaceMap, "map-namespace", map[string]string{}, "Import orbs under other namespaces on the destination, e.g., circleci=mirror-circleci; references to them in orb sources are rewritten as well")
+	flags.StringVar(&opts.ReportPath, "report", "orbs-report.json", "Path to the file to put the JSON report describing what happened to each orb")
+	flags.StringVar(&opts.JUnitPath, "junit", "", "Path to the file to put the JUnit XML report, where orbs not available in the end are failed test cases, if given")
+	flags.StringVar(&opts.IllegibleListPath, "illegible", "", "Path to the list of orbs caused YAML parser errors, emitted by resolve-dependencies along with --list, to be included in the report if given")
+	flags.StringVar(&opts.UnresolvedMapPath, "unresolved", "", "Path to the map of unresolved orbs, emitted by resolve-dependencies along with --list, to be included in the report if given")
+	flags.StringSliceVar(&opts.AllowedNamespaces, "allow-namespace", []string{}, "Only import orbs into the namespaces on the destination; each value is a namespace or a glob pattern like mirror-*")
+	flags.StringSliceVar(&opts.DeniedNamespaces, "deny-namespace", []string{}, "Never import orbs into the namespaces on the destination; each value is a namespace or a glob pattern like mirror-*")
+	flags.BoolVar(&opts.NeverCreateNamespaces, "never-create-namespace", false, "Only import orbs into existing namespaces on the destination, without creating any")
+	flags.StringVar(&opts.QuarantinePath, "quarantine", "orbs-quarantine.json", "Path to the file to keep orbs dropped because of failures which never go away on the same server version; they are skipped in later runs. Empty to disable")
+	flags.DurationVar(&opts.QuarantineTTL, "quarantine-ttl", 30*24*time.Hour, "How long orbs are kept quarantined")
+	flags.StringVar(&opts.ServerVersion, "server-version", "", "Version of the destination server for the quarantine; it is fingerprinted by the GraphQL schema if not given")
+	flags.BoolVar(&opts.RetryQuarantined, "retry-quarantined", false, "Retry quarantined orbs as well")
+	flags.StringVar(&opts.Priority, "priority", "resolved", "Order to import orbs in, keeping dependencies of each orb before the orb: resolved, newest (latest versions of each orb first) or weighted (by the number of dependents and popularity as well)")
+	flags.StringVar(&opts.PopularityPath, "popularity", "orbs-popularity.txt", "Path to the popularity of orbs, emitted by collect, used for --priority weighted if it exists")
+	flags.DurationVar(&opts.MaxDuration, "max-duration", 0, fmt.Sprintf("Time budget, e.g., 40m; no new orbs are started after 90%% of it is used, and the command exits with code %d if any orbs are remaining", ExitCodeIncomplete))
+	flags.StringVar(&opts.LockPath, "lock", "", "Path to the lock file preventing concurrent runs against the same destination, e.g., on a shared filesystem; a local one in the temporary directory is used if not given")
+	flags.DurationVar(&opts.LockTTL, "lock-ttl", 5*time.Minute, "How long the lock is regarded as held without renewal, e.g., after the holder crashed on another host; the holder renews it every third of this")
+	flags.DurationVar(&opts.LockWait, "lock-wait", 0, "How long to wait for the lock held by another run, e.g., 10m; fail at once if zero")
+	flags.StringVar(&opts.MetricsTextfilePath, "metrics-textfile", "", "Path to the file to put Prometheus metrics for the textfile collector of the node exporter on exit, e.g., /var/lib/node_exporter/orbs-sync.prom, if given")
+	flags.BoolVar(&opts.KeepGoing, "keep-going", false, "Record failures against orbs and continue with others, instead of aborting; exit non-zero in the end if any orbs failed")
 
 	cmd.MarkFlagRequired("host")
 	cmd.MarkFlagRequired("token")
@@ -46,39 +103,237 @@ func cmdBulkImport() *cobra.Command {
 	return cmd
 }
 
-func dumpProcessedOrbRefs(availableListPath, droppedListPath string, available, dropped []string) error {
-	if err := ioutil.WriteFile(availableListPath, []byte(strings.Join(available, "\n")), 0644); err != nil {
-		return errors.Wrap(err, "could not dump available orbs")
+// Format dropped orbs line by line; each line has the ref and the category of the failure separated by a tab
+// Orbs dropped because of their dependencies are followed by the dropped dependency as well
+func formatDroppedOrbs(dropped []*bulkimporter.DroppedOrb) string {
+	contents := []string{}
+
+	for _, droppedOrb := range dropped {
+		if droppedOrb.Dependency != "" {
+			contents = append(contents, fmt.Sprintf("%s\t%s\t%s", droppedOrb.Ref, droppedOrb.Category, droppedOrb.Dependency))
+		} else {
+			contents = append(contents, fmt.Sprintf("%s\t%s", droppedOrb.Ref, droppedOrb.Category))
+		}
+	}
+
+	return strings.Join(contents, "\n")
+}
+
+// Format the compatibility report line by line; each line has the ref, the compatibility and validation errors separated by tabs
+func formatValidationResults(validation []*bulkimporter.ValidationResult) string {
+	contents := []string{}
+
+	for _, validationResult := range validation {
+		line := fmt.Sprintf("%s\t%s", validationResult.Ref, validationResult.Compatibility)
+		if len(validationResult.Errors) > 0 {
+			line += "\t" + strings.Join(strings.Fields(strings.Join(validationResult.Errors, "; ")), " ")
+		}
+
+		contents = append(contents, line)
+	}
+
+	return strings.Join(contents, "\n")
+}
+
+// Format unmatched results of verification line by line; each line has the ref, the verification and the detail separated by tabs
+func formatUnmatchedVerificationResults(verification []*bulkimporter.VerificationResult) string {
+	contents := []string{}
+
+	for _, verificationResult := range verification {
+		if verificationResult.Verification != bulkimporter.Matched {
+			contents = append(contents, fmt.Sprintf("%s\t%s\t%s", verificationResult.Ref, verificationResult.Verification, verificationResult.Detail))
+		}
+	}
+
+	return strings.Join(contents, "\n")
+}
+
+// Dump lists of available, dropped and remaining orbs; lists with empty paths are not dumped
+// The list of remaining orbs is removed if nothing is remaining
+func dumpProcessedOrbRefs(availableListPath, droppedListPath, remainingListPath string, result *bulkimporter.Result) error {
+	if availableListPath != "" {
+		if err := atomicfile.WriteFile(availableListPath, []byte(strings.Join(result.Available, "\n")), 0644); err != nil {
+			return errors.Wrap(err, "could not dump available orbs")
+		}
+	}
+	if droppedListPath != "" {
+		if err := atomicfile.WriteFile(droppedListPath, []byte(formatDroppedOrbs(result.Dropped)), 0644); err != nil {
+			return errors.Wrap(err, "could not dump dropped orbs")
+		}
+	}
+	if remainingListPath != "" && len(result.Remaining) > 0 {
+		if err := atomicfile.WriteFile(remainingListPath, []byte(strings.Join(result.Remaining, "\n")), 0644); err != nil {
+			return errors.Wrap(err, "could not dump remaining orbs")
+		}
+	} else if remainingListPath != "" {
+		// The list left over from a previous run is stale now
+		if err := os.Remove(remainingListPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return errors.Wrap(err, "could not remove the stale list of remaining orbs")
+		}
+	}
+
+	return nil
+}
+
+// Dump the report, including orbs which resolve-dependencies could not resolve if given
+// The lists are opt-in, as those left over from another run would report orbs not related to this one
+func dumpImportReport(opts *BulkImportOpts, importReport *report.Report, result *bulkimporter.Result) error {
+	illegible := []string{}
+	if opts.IllegibleListPath != "" {
+		var err error
+		if illegible, err = readLines(opts.IllegibleListPath); err != nil {
+			return errors.Wrap(err, "could not load the list of orbs caused YAML parser errors")
+		}
+	}
+
+	unresolved := make(map[string][]string)
+	if opts.UnresolvedMapPath != "" {
+		unresolvedLines, err := readLines(opts.UnresolvedMapPath)
+		if err != nil {
+			return errors.Wrap(err, "could not load the map of unresolved orbs")
+		}
+		if unresolved, err = parseUnresolvedMap(unresolvedLines); err != nil {
+			return errors.Wrap(err, "could not parse the map of unresolved orbs")
+		}
+	}
+
+	importReport.AddIllegible(illegible)
+	importReport.AddUnresolved(unresolved)
+	importReport.AddImportResult(result)
+	importReport.Finish()
+
+	return importReport.WriteFile(opts.ReportPath)
+}
+
+// Dump the lists, the compatibility report, the report and the JUnit report of the import, with orbs named as on the source
+func dumpImportOutputs(opts *BulkImportOpts, importReport *report.Report, result *bulkimporter.Result) error {
+	if err := dumpProcessedOrbRefs(opts.AvailableListPath, opts.DroppedListPath, opts.RemainingListPath, result); err != nil {
+		return errors.Wrap(err, "could not dump the lists of processed orbs")
 	}
-	if err := ioutil.WriteFile(droppedListPath, []byte(strings.Join(dropped, "\n")), 0644); err != nil {
-		return errors.Wrap(err, "could not dump dropped orbs")
+	if opts.Validate {
+		if err := atomicfile.WriteFile(opts.CompatibilityPath, []byte(formatValidationResults(result.Validation)), 0644); err != nil {
+			return errors.Wrap(err, "could not dump the compatibility report")
+		}
+	}
+
+	if err := dumpImportReport(opts, importReport, result); err != nil {
+		return errors.Wrap(err, "could not dump the report")
+	}
+	if opts.JUnitPath != "" {
+		if err := importReport.WriteJUnitFile(opts.JUnitPath, "bulk-import"); err != nil {
+			return errors.Wrap(err, "could not dump the JUnit report")
+		}
 	}
 
 	return nil
 }
 
-func BulkImport(opts *BulkImportOpts) error {
-	logger := log.New(os.Stderr, "bulk-import: ", 7)
+func BulkImport(ctx context.Context, opts *BulkImportOpts) (err error) {
+	logger := logging.New("bulk-import")
+	defer func() {
+		err = writeMetricsTextfile(logger, opts.MetricsTextfilePath, "bulk-import", err)
+	}()
+	startedAt := time.Now()
+
+	importReport := report.New()
 
 	// Load orbs
-	logger.Printf("loading orbs")
-	orbs, err := loadListedOrbs(opts.OrderedListPath, opts.OrbSrcDirPath)
+	logger.Infof("loading orbs")
+	orbs, levelOf, err := loadListedOrbs(opts.OrderedListPath, opts.OrbSrcDirPath)
 	if err != nil {
 		return errors.Wrap(err, "could not load orbs")
 	}
 
-	// Import orbs
-	logger.Printf("starting import")
-	available, dropped, err := bulkimporter.ImportOrbsWithNewClient(orbs, opts.Hostname, APIEndpoint, opts.Token, debug)
+	// Map namespaces
+	mapping, err := nsmapper.NewMapping(opts.NamespaceMap)
+	if err != nil {
+		return errors.Wrap(err, "invalid namespace mapping")
+	}
+
+	policy, err := bulkimporter.NewNamespacePolicy(opts.AllowedNamespaces, opts.DeniedNamespaces, opts.NeverCreateNamespaces)
+	if err != nil {
+		return errors.Wrap(err, "invalid namespace policy")
+	}
+
+	priority, err := depresolver.ParsePriorityMode(opts.Priority)
+	if err != nil {
+		return errors.Wrap(err, "invalid priority")
+	}
+
+	popularity := make(map[string]int)
+	if priority == depresolver.PriorityWeighted {
+		if popularity, err = loadPopularity(opts.PopularityPath); err != nil {
+			return errors.Wrap(err, "could not load the popularity of orbs")
+		}
+	}
+
+	// Lock the destination, as concurrent runs race on creation of namespaces and orbs, and on the quarantine
+	destinationLock, err := lockDestination(ctx, opts.LockPath, opts.Hostname, "bulk-import", opts.LockTTL, opts.LockWait)
 	if err != nil {
+		return errors.Wrap(err, "could not lock the destination")
+	}
+	defer func() {
+		err = releaseLock(logger, destinationLock, err)
+	}()
+
+	// Stop importing once the lock is lost to another run
+	ctx, cancel := destinationLock.Context(ctx)
+	defer cancel()
+
+	// Load quarantined orbs
+	var q *quarantine.Quarantine
+	quarantined := []string{}
+	serverVersion := opts.ServerVersion
+	if opts.QuarantinePath != "" {
+		if q, serverVersion, err = loadQuarantine(ctx, logger, opts.QuarantinePath, opts.ServerVersion, opts.Hostname, opts.Token); err != nil {
+			return errors.Wrap(err, "could not load the quarantine")
+		}
+
+		if !opts.RetryQuarantined {
+			quarantined = mapping.MapRefs(q.ActiveRefs(serverVersion))
+		}
+	}
+	if orbs, err = mapping.MapOrbs(orbs); err != nil {
+		return errors.Wrap(err, "could not map namespaces")
+	}
+	levelOf = mapping.MapLevels(levelOf)
+
+	// Import orbs
+	logger.Infof("starting import")
+	result, err := bulkimporter.ImportOrbsWithNewClient(ctx, orbs, opts.Hostname, APIEndpoint, opts.Token, debug, &bulkimporter.ImportOpts{
+		Concurrency:     opts.Concurrency,
+		KeepGoing:       opts.KeepGoing,
+		Validate:        opts.Validate,
+		Verify:          opts.Verify,
+		Quarantined:     quarantined,
+		LevelOf:         levelOf,
+		Priority:        priority,
+		Popularity:      mapping.MapPopularity(popularity),
+		Deadline:        deadlineOf(startedAt, opts.MaxDuration),
+		NamespacePolicy: policy,
+	})
+	if result == nil {
 		return errors.Wrap(err, "import failed")
 	}
+	result = unmapResult(mapping, result)
+
+	if q != nil {
+		if err := updateQuarantine(q, opts.QuarantinePath, serverVersion, opts.QuarantineTTL, result); err != nil {
+			return errors.Wrap(err, "could not update the quarantine")
+		}
+	}
 
 	// Dump available/dropped orbs
-	logger.Printf("outputting results")
-	if err := dumpProcessedOrbRefs(opts.AvailableListPath, opts.DroppedListPath, available, dropped); err != nil {
-		return errors.Wrap(err, "could not dump the lists of processed orbs")
+	logger.Infof("outputting results")
+	if err := dumpImportOutputs(opts, importReport, result); err != nil {
+		return err
 	}
 
-	return nil
+	if opts.Verify {
+		logger.Infof("here is the list of imported orbs not matching on destination\n\n%v\n\n", formatUnmatchedVerificationResults(result.Verification))
+	}
+
+	logger.Infof("%d available, %d dropped, %d failed, %d remaining", len(result.Available), len(result.Dropped), len(result.Failed), len(result.Remaining))
+
+	return wrapIncomplete(err, "import incomplete")
 }
@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	bulkimporter "github.com/circle-makotom/orbs-sync/bulk-importer"
+	nsmapper "github.com/circle-makotom/orbs-sync/namespace-mapper"
+	"github.com/circle-makotom/orbs-sync/quarantine"
+	"github.com/circle-makotom/orbs-sync/report"
+)
+
+func readTestFile(t *testing.T, filename string) string {
+	t.Helper()
+
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(contents)
+}
+
+// Every output of bulk-import names orbs as on the source, even if they are imported under mapped namespaces
+func TestDumpImportOutputsUnderMapping(t *testing.T) {
+	mapping, err := nsmapper.NewMapping(map[string]string{"circleci": "mirror-circleci"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The result as the importer returns, named after the mapping
+	importErr := errors.New("Error in config file: unknown key")
+	result := &bulkimporter.Result{
+		Available: []string{"mirror-circleci/lib@1.0.0", "other/tool@1.0.0"},
+		Dropped: []*bulkimporter.DroppedOrb{
+			{Ref: "mirror-circleci/bad@1.0.0", Category: bulkimporter.CategoryUnsupportedSyntax, Err: importErr},
+			{Ref: "mirror-circleci/user@1.0.0", Category: bulkimporter.CategoryDependencyDropped, Err: importErr, Dependency: "mirror-circleci/bad@1.0.0"},
+		},
+		Records: []*bulkimporter.OrbRecord{
+			{Ref: "mirror-circleci/lib@1.0.0", Status: bulkimporter.StatusImported, Attempts: 1, Duration: time.Second},
+			{Ref: "other/tool@1.0.0", Status: bulkimporter.StatusImported, Attempts: 1, Duration: time.Second},
+			{Ref: "mirror-circleci/bad@1.0.0", Status: bulkimporter.StatusDropped, Attempts: 1},
+			{Ref: "mirror-circleci/user@1.0.0", Status: bulkimporter.StatusSkipped},
+		},
+		Validation: []*bulkimporter.ValidationResult{
+			{Ref: "mirror-circleci/lib@1.0.0", Compatibility: bulkimporter.Compatible},
+			{Ref: "mirror-circleci/bad@1.0.0", Compatibility: bulkimporter.Incompatible, Errors: []string{importErr.Error()}},
+		},
+		Remaining: []string{"mirror-circleci/late@1.0.0"},
+	}
+
+	dir := t.TempDir()
+	opts := &BulkImportOpts{
+		AvailableListPath: filepath.Join(dir, "orbs-available.txt"),
+		DroppedListPath:   filepath.Join(dir, "orbs-dropped.txt"),
+		RemainingListPath: filepath.Join(dir, "orbs-remaining.txt"),
+		Validate:          true,
+		CompatibilityPath: filepath.Join(dir, "orbs-compatibility.txt"),
+		ReportPath:        filepath.Join(dir, "orbs-report.json"),
+		IllegibleListPath: filepath.Join(dir, "orbs-illegible.txt"),
+		UnresolvedMapPath: filepath.Join(dir, "orbs-unresolved.txt"),
+		JUnitPath:         filepath.Join(dir, "orbs-junit.xml"),
+		QuarantinePath:    filepath.Join(dir, "orbs-quarantine.json"),
+	}
+
+	// Lists of resolve-dependencies name orbs as on the source
+	if err := ioutil.WriteFile(opts.IllegibleListPath, []byte("circleci/broken@1.0.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(opts.UnresolvedMapPath, []byte(formatUnresolvedMap(map[string][]string{"circleci/orphan@1.0.0": {"circleci/gone@1.0.0"}})), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	unmapped := unmapResult(mapping, result)
+	if err := dumpImportOutputs(opts, report.New(), unmapped); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := quarantine.Load(opts.QuarantinePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := updateQuarantine(q, opts.QuarantinePath, "v1", time.Hour, unmapped); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedLists := map[string]string{
+		opts.AvailableListPath: "circleci/lib@1.0.0\nother/tool@1.0.0",
+		opts.DroppedListPath:   "circleci/bad@1.0.0\tunsupported-syntax\ncircleci/user@1.0.0\tdependency-dropped\tcircleci/bad@1.0.0",
+		opts.RemainingListPath: "circleci/late@1.0.0",
+	}
+	for filename, expected := range expectedLists {
+		if contents := readTestFile(t, filename); contents != expected {
+			t.Errorf("%s contains %q; expected %q", filepath.Base(filename), contents, expected)
+		}
+	}
+
+	if compatibility := readTestFile(t, opts.CompatibilityPath); !strings.HasPrefix(compatibility, "circleci/lib@1.0.0\tcompatible\ncircleci/bad@1.0.0\tincompatible\t") {
+		t.Errorf("compatibility report contains %q; expected source names", compatibility)
+	}
+
+	var written struct {
+		Orbs []*report.Entry `json:"orbs"`
+	}
+	if err := json.Unmarshal([]byte(readTestFile(t, opts.ReportPath)), &written); err != nil {
+		t.Fatal(err)
+	}
+	reported := []string{}
+	for _, entry := range written.Orbs {
+		reported = append(reported, entry.Ref+" "+entry.Dependency)
+	}
+	sort.Strings(reported)
+	expectedReported := []string{
+		"circleci/bad@1.0.0 ",
+		"circleci/broken@1.0.0 ",
+		"circleci/late@1.0.0 ",
+		"circleci/lib@1.0.0 ",
+		"circleci/orphan@1.0.0 circleci/gone@1.0.0",
+		"circleci/user@1.0.0 circleci/bad@1.0.0",
+		"other/tool@1.0.0 ",
+	}
+	if !reflect.DeepEqual(reported, expectedReported) {
+		t.Errorf("report lists %q; expected %q", reported, expectedReported)
+	}
+
+	if junit := readTestFile(t, opts.JUnitPath); strings.Contains(junit, "mirror-circleci") || !strings.Contains(junit, "circleci/bad") {
+		t.Errorf("JUnit report names orbs after the mapping\n%s", junit)
+	}
+
+	if refs := q.ActiveRefs("v1"); !reflect.DeepEqual(refs, []string{"circleci/bad@1.0.0"}) {
+		t.Errorf("quarantined %q; expected source names", refs)
+	}
+
+	// The importer is given quarantined orbs after the mapping again
+	if refs := mapping.MapRefs(q.ActiveRefs("v1")); !reflect.DeepEqual(refs, []string{"mirror-circleci/bad@1.0.0"}) {
+		t.Errorf("quarantined orbs given to the importer are %q; expected mapped names", refs)
+	}
+}
+
+func TestUnmapResultWithoutMapping(t *testing.T) {
+	result := &bulkimporter.Result{Available: []string{"ns/a@1.0.0"}}
+
+	if unmapped := unmapResult(nsmapper.Mapping{}, result); unmapped != result {
+		t.Errorf("result was copied without a mapping")
+	}
+}
@@ -1,27 +1,34 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 
+	atomicfile "github.com/circle-makotom/orbs-sync/atomic-file"
 	"github.com/circle-makotom/orbs-sync/collector"
+	"github.com/circle-makotom/orbs-sync/logging"
 )
 
 type CollectOpts struct {
-	Hostname           string
-	Token              string
-	ListPath           string
-	SrcDirPath         string
-	ListOnly           bool
-	BeSlow             bool
-	IncludeUncertified bool
-	KnownHiddenOrbs    []string
+	Hostname            string
+	Token               string
+	ListPath            string
+	SrcDirPath          string
+	ListOnly            bool
+	BeSlow              bool
+	IncludeUncertified  bool
+	KnownHiddenOrbs     []string
+	PopularityPath      string
+	MetricsTextfilePath string
 }
 
 func cmdCollect() *cobra.Command {
@@ -30,8 +37,8 @@ func cmdCollect() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "collect",
 		Short: "List and fetch orbs",
-		RunE: func(_ *cobra.Command, _ []string) error {
-			return CollectOrbs(opts)
+		RunE: func(c *cobra.Command, _ []string) error {
+			return CollectOrbs(c.Context(), opts)
 		},
 	}
 
@@ -44,29 +51,78 @@ func cmdCollect() *cobra.Command {
 	flags.BoolVar(&opts.BeSlow, "slow", false, "This does nothing (being left for backward compatibility)")
 	flags.BoolVar(&opts.IncludeUncertified, "include-uncertified", false, "Fetch uncertified orbs as well")
 	flags.StringSliceVar(&opts.KnownHiddenOrbs, "must-include", knownHiddenOrbs, "Orbs to be included regardlessly - used for well-known hidden orbs")
+	flags.StringVar(&opts.PopularityPath, "popularity", "", "Path to the file to put the popularity of orbs, e.g., orbs-popularity.txt, used by bulk-import --priority weighted; fetched from the statistics of orbs only if given")
+	flags.StringVar(&opts.MetricsTextfilePath, "metrics-textfile", "", "Path to the file to put Prometheus metrics for the textfile collector of the node exporter on exit, e.g., /var/lib/node_exporter/orbs-sync.prom, if given")
 
 	cmd.MarkFlagRequired("token")
 
 	return cmd
 }
 
-func CollectOrbs(opts *CollectOpts) error {
-	logger := log.New(os.Stderr, "collect: ", 7)
+// Dump the popularity line by line; each line has the orb name and the number of projects using it in the last 30 days separated by a tab
+func dumpPopularity(filename string, popularity map[string]int) error {
+	contents := []string{}
 
-	logger.Printf("start collecting orbs")
+	for name, count := range popularity {
+		contents = append(contents, fmt.Sprintf("%s\t%d", name, count))
+	}
+	sort.Strings(contents)
+
+	return atomicfile.WriteFile(filename, []byte(strings.Join(contents, "\n")), 0644)
+}
+
+// Load the popularity dumped by dumpPopularity if the file exists
+func loadPopularity(filename string) (map[string]int, error) {
+	ret := make(map[string]int)
+
+	lines, err := readLinesIfExists(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range lines {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("malformed line %q", line)
+		}
+
+		count, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "malformed line %q", line)
+		}
+
+		ret[fields[0]] = count
+	}
+
+	return ret, nil
+}
+
+func CollectOrbs(ctx context.Context, opts *CollectOpts) (err error) {
+	logger := logging.New("collect")
+	defer func() {
+		err = writeMetricsTextfile(logger, opts.MetricsTextfilePath, "collect", err)
+	}()
+
+	logger.Infof("start collecting orbs")
 
 	// Fetch orbs
-	orbs, err := collector.ListAllVersionedOrbsWithNewClient(opts.Hostname, APIEndpoint, opts.Token, opts.KnownHiddenOrbs, !opts.ListOnly, opts.IncludeUncertified, opts.BeSlow, debug)
+	orbs, err := collector.ListAllVersionedOrbsWithNewClient(ctx, opts.Hostname, APIEndpoint, opts.Token, opts.KnownHiddenOrbs, !opts.ListOnly, opts.IncludeUncertified, opts.BeSlow, debug)
 	if err != nil {
 		return errors.Wrap(err, "could not fetch orbs")
 	}
 
-	logger.Printf("collection done; proceeding to outputting")
+	logger.Infof("collection done; proceeding to outputting")
 
-	// Create a file to put the list of orbs
-	listFile, err := os.Create(opts.ListPath)
-	if err != nil {
-		return errors.Wrap(err, "could not create a file for the list of orbs")
+	// Dump the popularity of orbs
+	if opts.PopularityPath != "" {
+		popularity, err := collector.FetchPopularityWithNewClient(ctx, opts.Hostname, APIEndpoint, opts.Token, opts.IncludeUncertified, debug)
+		if err != nil {
+			return errors.Wrap(err, "could not fetch the popularity of orbs")
+		}
+
+		if err := dumpPopularity(opts.PopularityPath, popularity); err != nil {
+			return errors.Wrap(err, "could not dump the popularity of orbs")
+		}
 	}
 
 	if !opts.ListOnly {
@@ -77,16 +133,15 @@ func CollectOrbs(opts *CollectOpts) error {
 	}
 
 	// Walk through each orb
-	logger.Printf("walking through each orb")
+	logger.Infof("walking through each orb")
+	orbRefs := []string{}
 	for _, orb := range orbs {
-		logger.Printf("processing %q", orb.Ref)
+		logger.Debugf("processing %q", orb.Ref)
 
-		_, err := listFile.Write([]byte(fmt.Sprintf("%s\n", orb.Ref)))
-		if err != nil {
-			return errors.Wrapf(err, "failed to add %q to the list of orbs", orb.Ref)
-		}
+		orbRefs = append(orbRefs, orb.Ref)
 
 		// Dump orb sources unless requested not to
+		// They are written plainly rather than atomically for speed, as the list written at last tells which of them are complete
 		if !opts.ListOnly {
 			if err := ioutil.WriteFile(path.Join(opts.SrcDirPath, getSafeOrbSrcFileName(orb.Ref)), []byte(orb.Source), 0644); err != nil {
 				return errors.Wrapf(err, "failed to dump the source of %q", orb.Ref)
@@ -94,5 +149,10 @@ func CollectOrbs(opts *CollectOpts) error {
 		}
 	}
 
+	// The list is written at last, so that it never lists orbs whose sources are missing
+	if err := atomicfile.WriteFile(opts.ListPath, []byte(strings.Join(orbRefs, "\n")+"\n"), 0644); err != nil {
+		return errors.Wrap(err, "could not dump the list of orbs")
+	}
+
 	return nil
 }
@@ -1,17 +1,26 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
-	"github.com/circle-makotom/orbs-sync/types"
 	"github.com/pkg/errors"
+
+	bulkimporter "github.com/circle-makotom/orbs-sync/bulk-importer"
+	"github.com/circle-makotom/orbs-sync/lock"
+	"github.com/circle-makotom/orbs-sync/logging"
+	"github.com/circle-makotom/orbs-sync/metrics"
+	nsmapper "github.com/circle-makotom/orbs-sync/namespace-mapper"
+	"github.com/circle-makotom/orbs-sync/quarantine"
+	"github.com/circle-makotom/orbs-sync/types"
 )
 
 // https://github.com/CircleCI-Public/circleci-cli/blob/6ec121d68a6b12f46c604cc0f44d1e18d8bb2b52/cmd/root.go#L16
@@ -19,18 +28,27 @@ const APIEndpoint = "graphql-unstable"
 
 var knownHiddenOrbs = []string{"circleci/welcome-orb", "circleci/artifactory", "circleci/hello-build"}
 
+// Server version for the quarantine if it can be neither fingerprinted nor given
+const unknownServerVersion = "unknown"
+
+// Failures which never go away on the same server version, making orbs quarantined
+var quarantinedCategories = map[bulkimporter.ErrorCategory]bool{
+	bulkimporter.CategoryUnsupportedSyntax: true,
+	bulkimporter.CategorySizeLimit:         true,
+}
+
 func getSafeOrbSrcFileName(orbRef string) string {
 	return fmt.Sprintf("%s.yml", url.QueryEscape(orbRef))
 }
 
 func loadOrbYAML(orbRef, srcFilePath string) (*types.VersionedOrb, error) {
-	logger := log.New(os.Stderr, "load-orb-yaml: ", 7)
+	logger := logging.New("load-orb-yaml")
 
 	orbRefParts := strings.Split(orbRef, "@")
 	orbName := orbRefParts[0]
 	orbVersion := strings.Join(orbRefParts[1:], "@")
 
-	logger.Printf("loading %q", orbRef)
+	logger.Debugf("loading %q", orbRef)
 
 	orbSrc, err := ioutil.ReadFile(srcFilePath)
 	if err != nil {
@@ -74,23 +92,273 @@ func loadOrbsInDir(orbSrcDirPath string) ([]*types.VersionedOrb, error) {
 	return ret, nil
 }
 
-func loadListedOrbs(orderedListPath, orbSrcDirPath string) ([]*types.VersionedOrb, error) {
+// Load orbs in the list, where blank lines separate dependency levels as resolve-dependencies writes
+// Return the orbs and their levels, or nil levels if the list is not separated into levels
+func loadListedOrbs(orderedListPath, orbSrcDirPath string) ([]*types.VersionedOrb, map[string]int, error) {
 	ret := []*types.VersionedOrb{}
+	levelOf := make(map[string]int)
 
 	orderedListStr, err := ioutil.ReadFile(orderedListPath)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	orderedList := strings.Split(strings.TrimSpace(string(orderedListStr)), "\n")
 
+	level := 0
 	for _, orbRef := range orderedList {
+		if orbRef = strings.TrimSpace(orbRef); orbRef == "" {
+			level += 1
+			continue
+		}
+
 		orb, err := loadOrbYAML(orbRef, path.Join(orbSrcDirPath, getSafeOrbSrcFileName(orbRef)))
 		if err != nil {
-			return nil, errors.Wrapf(err, "could not load orb %q", orbRef)
+			return nil, nil, errors.Wrapf(err, "could not load orb %q", orbRef)
 		}
 
 		ret = append(ret, orb)
+		levelOf[orb.Ref] = level
+	}
+
+	if level == 0 {
+		levelOf = nil
+	}
+
+	return ret, levelOf, nil
+}
+
+// Expand arguments each of which is either an orb ref or a path to a file listing orb refs line by line
+func expandOrbRefArgs(args []string) ([]string, error) {
+	ret := []string{}
+
+	for _, arg := range args {
+		if fileInfo, err := os.Stat(arg); err != nil || fileInfo.IsDir() {
+			ret = append(ret, arg)
+			continue
+		}
+
+		lines, err := readLines(arg)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not read %q", arg)
+		}
+
+		ret = append(ret, lines...)
+	}
+
+	return ret, nil
+}
+
+// Read non-empty lines of the file
+func readLines(filename string) ([]string, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []string{}
+	for _, line := range strings.Split(string(contents), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			ret = append(ret, line)
+		}
 	}
 
 	return ret, nil
 }
+
+// Read non-empty lines of the file if it exists; return nothing otherwise
+func readLinesIfExists(filename string) ([]string, error) {
+	lines, err := readLines(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	}
+
+	return lines, err
+}
+
+// Load the quarantine, releasing expired entries and those recorded against other server versions
+// The server version is fingerprinted unless given; it is regarded as unknown if the schema is not available
+func loadQuarantine(ctx context.Context, logger *logging.Logger, filename, serverVersion, hostname, token string) (*quarantine.Quarantine, string, error) {
+	if serverVersion == "" {
+		var err error
+		if serverVersion, err = quarantine.FetchServerVersionWithNewClient(ctx, hostname, APIEndpoint, token, debug); err != nil {
+			if ctx.Err() != nil {
+				return nil, "", ctx.Err()
+			}
+
+			logger.Warnf("could not fingerprint the server version; quarantining orbs against %q, which is not released by server upgrades until --quarantine-ttl; give --server-version explicitly to avoid this: %v", unknownServerVersion, err)
+			serverVersion = unknownServerVersion
+		}
+	}
+
+	q, err := quarantine.Load(filename)
+	if err != nil {
+		return nil, "", err
+	}
+	q.Prune(serverVersion)
+
+	return q, serverVersion, nil
+}
+
+// Quarantine orbs dropped because of failures which never go away on the same server version, and release those available now
+func updateQuarantine(q *quarantine.Quarantine, filename, serverVersion string, ttl time.Duration, result *bulkimporter.Result) error {
+	for _, droppedOrb := range result.Dropped {
+		if quarantinedCategories[droppedOrb.Category] {
+			q.Add(droppedOrb.Ref, string(droppedOrb.Category), serverVersion, ttl)
+		}
+	}
+
+	for _, orbRef := range result.Available {
+		q.Remove(orbRef)
+	}
+
+	return q.Save(filename)
+}
+
+// Name orbs in the result as on the source, so that every output follows the same convention with or without --map-namespace
+// Such outputs can be given to why and to resolve-dependencies as they are
+func unmapResult(mapping nsmapper.Mapping, result *bulkimporter.Result) *bulkimporter.Result {
+	if len(mapping) == 0 {
+		return result
+	}
+
+	ret := *result
+	ret.Available = mapping.UnmapRefs(result.Available)
+	ret.Failed = mapping.UnmapRefs(result.Failed)
+	ret.Remaining = mapping.UnmapRefs(result.Remaining)
+
+	ret.Dropped = []*bulkimporter.DroppedOrb{}
+	for _, droppedOrb := range result.Dropped {
+		unmapped := *droppedOrb
+		unmapped.Ref = mapping.UnmapRef(droppedOrb.Ref)
+		if droppedOrb.Dependency != "" {
+			unmapped.Dependency = mapping.UnmapRef(droppedOrb.Dependency)
+		}
+		ret.Dropped = append(ret.Dropped, &unmapped)
+	}
+
+	ret.Records = []*bulkimporter.OrbRecord{}
+	for _, record := range result.Records {
+		unmapped := *record
+		unmapped.Ref = mapping.UnmapRef(record.Ref)
+		ret.Records = append(ret.Records, &unmapped)
+	}
+
+	if result.Validation != nil {
+		ret.Validation = []*bulkimporter.ValidationResult{}
+		for _, validationResult := range result.Validation {
+			unmapped := *validationResult
+			unmapped.Ref = mapping.UnmapRef(validationResult.Ref)
+			ret.Validation = append(ret.Validation, &unmapped)
+		}
+	}
+
+	if result.Verification != nil {
+		ret.Verification = []*bulkimporter.VerificationResult{}
+		for _, verificationResult := range result.Verification {
+			unmapped := *verificationResult
+			unmapped.Ref = mapping.UnmapRef(verificationResult.Ref)
+			ret.Verification = append(ret.Verification, &unmapped)
+		}
+	}
+
+	return &ret
+}
+
+// Name orbs in the map of unresolved orbs as on the source, along with their unresolvable dependencies
+func unmapUnresolved(mapping nsmapper.Mapping, unresolved map[string][]string) map[string][]string {
+	ret := make(map[string][]string)
+
+	for orbRef, dependencies := range unresolved {
+		ret[mapping.UnmapRef(orbRef)] = mapping.UnmapRefs(dependencies)
+	}
+
+	return ret
+}
+
+// Stop starting new orbs when 90% of the time budget is used, leaving the rest for orbs in flight and outputs
+// Return zero if there is no time budget
+func deadlineOf(startedAt time.Time, maxDuration time.Duration) time.Time {
+	if maxDuration <= 0 {
+		return time.Time{}
+	}
+
+	return startedAt.Add(maxDuration - maxDuration/10)
+}
+
+// Tell the command stopped at the time budget or was cancelled with the prefix, e.g., "import incomplete", or return err as-is
+// Being incomplete or cancelled decides the exit code over failed orbs, which are told in the message
+func wrapIncomplete(err error, prefix string) error {
+	var incompleteErr *bulkimporter.IncompleteError
+	if !errors.As(err, &incompleteErr) {
+		return err
+	}
+
+	msg := fmt.Sprintf("%d orb(s) remaining", len(incompleteErr.Remaining))
+	if len(incompleteErr.Failed) > 0 {
+		msg += fmt.Sprintf(", %d orb(s) failed", len(incompleteErr.Failed))
+	}
+
+	if incompleteErr.Err != nil {
+		return errors.Wrapf(incompleteErr.Err, "%s: %s", prefix, msg)
+	}
+
+	return errors.Wrapf(ErrIncomplete, "%s: %s", prefix, msg)
+}
+
+// Lock the destination against concurrent runs, by the given lock file or a local one for the destination
+func lockDestination(ctx context.Context, lockPath, hostname, command string, ttl, wait time.Duration) (*lock.Lock, error) {
+	if lockPath == "" {
+		lockPath = filepath.Join(os.TempDir(), fmt.Sprintf("orbs-sync-%s.lock", url.QueryEscape(hostname)))
+	}
+
+	return lock.Acquire(ctx, lockPath, hostname, command, ttl, wait)
+}
+
+// Release the lock, and tell the command the lock was lost while running, or return err as-is
+// Losing the lock cancels the run, but it is a failure rather than a cancellation
+func releaseLock(logger *logging.Logger, destinationLock *lock.Lock, err error) error {
+	if lostErr := destinationLock.Err(); lostErr != nil {
+		if err != nil {
+			return errors.Wrapf(lostErr, "aborted (%v)", err)
+		}
+		return lostErr
+	}
+
+	if err := destinationLock.Release(); err != nil {
+		logger.Warnf("could not release the lock: %v", err)
+	}
+
+	return err
+}
+
+// Tell the result of the command by the error it returned, for the metrics
+func resultOf(err error) string {
+	switch {
+	case err == nil:
+		return "succeeded"
+	case errors.Is(err, context.Canceled):
+		return "cancelled"
+	case errors.Is(err, ErrIncomplete):
+		return "incomplete"
+	default:
+		return "failed"
+	}
+}
+
+// Record the run of the command in the metrics, and write them for the textfile collector of the node exporter if the path is given
+// Return err as-is, or the failure to write the metrics if the command succeeded
+func writeMetricsTextfile(logger *logging.Logger, filename, command string, err error) error {
+	metrics.ObserveRun(command, resultOf(err), time.Now())
+
+	if filename == "" {
+		return err
+	}
+
+	if writeErr := metrics.Default.WriteTextfile(filename); writeErr != nil && err != nil {
+		logger.Warnf("could not write the metrics: %v", writeErr)
+	} else if writeErr != nil {
+		return errors.Wrap(writeErr, "could not write the metrics")
+	}
+
+	return err
+}
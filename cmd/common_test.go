@@ -0,0 +1,236 @@
+package cmd
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	bulkimporter "github.com/circle-makotom/orbs-sync/bulk-importer"
+	"github.com/circle-makotom/orbs-sync/logging"
+	"github.com/circle-makotom/orbs-sync/quarantine"
+	"github.com/circle-makotom/orbs-sync/types"
+)
+
+// Write sources of the orbs into the directory as collect does
+func writeTestOrbSources(t *testing.T, dir string, orbRefs []string) {
+	t.Helper()
+
+	for _, orbRef := range orbRefs {
+		if err := ioutil.WriteFile(filepath.Join(dir, getSafeOrbSrcFileName(orbRef)), []byte("version: 2.1\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func refsOf(orbs []*types.VersionedOrb) []string {
+	ret := []string{}
+	for _, orb := range orbs {
+		ret = append(ret, orb.Ref)
+	}
+
+	return ret
+}
+
+func TestLoadListedOrbs(t *testing.T) {
+	cases := []struct {
+		name     string
+		contents string
+
+		expectedRefs    []string
+		expectedLevelOf map[string]int
+	}{
+		{
+			"flat",
+			"ns/base@1.0.0\nns/mid@1.0.0\nns/top@1.0.0\n",
+			[]string{"ns/base@1.0.0", "ns/mid@1.0.0", "ns/top@1.0.0"},
+			nil,
+		},
+		{
+			"levelled",
+			"ns/base@1.0.0\nns/lib@1.0.0\n\nns/mid@1.0.0\n\nns/top@1.0.0",
+			[]string{"ns/base@1.0.0", "ns/lib@1.0.0", "ns/mid@1.0.0", "ns/top@1.0.0"},
+			map[string]int{"ns/base@1.0.0": 0, "ns/lib@1.0.0": 0, "ns/mid@1.0.0": 1, "ns/top@1.0.0": 2},
+		},
+		{
+			"levelled with CRLF",
+			"ns/base@1.0.0\r\n\r\nns/top@1.0.0\r\n",
+			[]string{"ns/base@1.0.0", "ns/top@1.0.0"},
+			map[string]int{"ns/base@1.0.0": 0, "ns/top@1.0.0": 1},
+		},
+	}
+
+	for _, c := range cases {
+		dir := t.TempDir()
+		writeTestOrbSources(t, dir, c.expectedRefs)
+
+		listPath := filepath.Join(dir, "orbs-resolved.txt")
+		if err := ioutil.WriteFile(listPath, []byte(c.contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		orbs, levelOf, err := loadListedOrbs(listPath, dir)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+
+		if refs := refsOf(orbs); !reflect.DeepEqual(refs, c.expectedRefs) {
+			t.Errorf("%s: loaded %q; expected %q", c.name, refs, c.expectedRefs)
+		}
+		if !reflect.DeepEqual(levelOf, c.expectedLevelOf) {
+			t.Errorf("%s: levels = %v; expected %v", c.name, levelOf, c.expectedLevelOf)
+		}
+	}
+}
+
+// Lists written by resolve-dependencies are loaded by bulk-import in the same order and levels
+func TestDumpResolvedOrbsRoundTrip(t *testing.T) {
+	resolvedLevels := [][]*types.VersionedOrb{
+		{{Ref: "ns/base@1.0.0"}, {Ref: "ns/lib@1.0.0"}},
+		{{Ref: "ns/mid@1.0.0"}},
+		{{Ref: "ns/top@1.0.0"}, {Ref: "ns/side@1.0.0"}},
+	}
+
+	dir := t.TempDir()
+	expectedRefs := []string{}
+	expectedLevelOf := make(map[string]int)
+	for idx, level := range resolvedLevels {
+		for _, orb := range level {
+			expectedRefs = append(expectedRefs, orb.Ref)
+			expectedLevelOf[orb.Ref] = idx
+		}
+	}
+	writeTestOrbSources(t, dir, expectedRefs)
+
+	listPath := filepath.Join(dir, "orbs-resolved.txt")
+	if err := dumpResolvedOrbs(listPath, resolvedLevels); err != nil {
+		t.Fatal(err)
+	}
+
+	orbs, levelOf, err := loadListedOrbs(listPath, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if refs := refsOf(orbs); !reflect.DeepEqual(refs, expectedRefs) {
+		t.Errorf("loaded %q; expected %q", refs, expectedRefs)
+	}
+	if !reflect.DeepEqual(levelOf, expectedLevelOf) {
+		t.Errorf("levels = %v; expected %v", levelOf, expectedLevelOf)
+	}
+
+	// Lines read one by one, as by consumers other than bulk-import, are the orbs once blank lines are skipped
+	lines, err := readLines(listPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(lines, expectedRefs) {
+		t.Errorf("non-empty lines = %q; expected %q", lines, expectedRefs)
+	}
+}
+
+func TestWrapIncomplete(t *testing.T) {
+	failedErr := &bulkimporter.FailedOrbsError{Refs: []string{"ns/a@1.0.0"}}
+	plainErr := errors.New("something went wrong")
+
+	cases := []struct {
+		name     string
+		err      error
+		expected string
+		result   string
+	}{
+		{"deadline", &bulkimporter.IncompleteError{Remaining: []string{"ns/a@1.0.0"}}, "import incomplete: 1 orb(s) remaining: incomplete", "incomplete"},
+		{"failed at the deadline", &bulkimporter.IncompleteError{Remaining: []string{"ns/a@1.0.0"}, Failed: []string{"ns/b@1.0.0"}}, "import incomplete: 1 orb(s) remaining, 1 orb(s) failed: incomplete", "incomplete"},
+		{"cancelled", &bulkimporter.IncompleteError{Remaining: []string{"ns/a@1.0.0"}, Err: context.Canceled}, "import incomplete: 1 orb(s) remaining: context canceled", "cancelled"},
+		{"failed in the keep-going mode", failedErr, failedErr.Error(), "failed"},
+		{"other errors", plainErr, plainErr.Error(), "failed"},
+	}
+
+	for _, c := range cases {
+		err := wrapIncomplete(c.err, "import incomplete")
+		if err.Error() != c.expected {
+			t.Errorf("%s: error = %q; expected %q", c.name, err, c.expected)
+		}
+		if result := resultOf(err); result != c.result {
+			t.Errorf("%s: result = %q; expected %q", c.name, result, c.result)
+		}
+	}
+
+	if err := wrapIncomplete(nil, "import incomplete"); err != nil {
+		t.Errorf("error = %v; expected nil", err)
+	}
+}
+
+// Orbs retried with --retry-quarantined are released once imported, and only orbs failed permanently are quarantined
+func TestUpdateQuarantine(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "orbs-quarantine.json")
+	q := &quarantine.Quarantine{Entries: []*quarantine.Entry{}}
+	q.Add("ns/retried@1.0.0", string(bulkimporter.CategoryUnsupportedSyntax), "v1", time.Hour)
+	q.Add("ns/still@1.0.0", string(bulkimporter.CategoryUnsupportedSyntax), "v1", time.Hour)
+
+	result := &bulkimporter.Result{
+		Available: []string{"ns/retried@1.0.0", "ns/fine@1.0.0"},
+		Dropped: []*bulkimporter.DroppedOrb{
+			{Ref: "ns/still@1.0.0", Category: bulkimporter.CategoryUnsupportedSyntax},
+			{Ref: "ns/large@1.0.0", Category: bulkimporter.CategorySizeLimit},
+			{Ref: "ns/flaky@1.0.0", Category: bulkimporter.CategoryTransient},
+			{Ref: "ns/dependent@1.0.0", Category: bulkimporter.CategoryDependencyDropped, Dependency: "ns/still@1.0.0"},
+		},
+	}
+	if err := updateQuarantine(q, filename, "v1", time.Hour, result); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := quarantine.Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refs, expected := loaded.ActiveRefs("v1"), []string{"ns/still@1.0.0", "ns/large@1.0.0"}; !reflect.DeepEqual(refs, expected) {
+		t.Errorf("quarantined %q; expected %q", refs, expected)
+	}
+}
+
+// Orbs are quarantined against the "unknown" server version if the schema is not available, and entries of other versions are released
+func TestLoadQuarantineUnknownServerVersion(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	filename := filepath.Join(t.TempDir(), "orbs-quarantine.json")
+	saved := &quarantine.Quarantine{Entries: []*quarantine.Entry{}}
+	saved.Add("ns/unknown@1.0.0", string(bulkimporter.CategoryUnsupportedSyntax), unknownServerVersion, time.Hour)
+	saved.Add("ns/known@1.0.0", string(bulkimporter.CategoryUnsupportedSyntax), "schema-0123456789abcdef", time.Hour)
+	if err := saved.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	logger := logging.NewWithWriter("test", ioutil.Discard, logging.FormatText, logging.LevelError)
+
+	q, serverVersion, err := loadQuarantine(context.Background(), logger, filename, "", server.URL, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverVersion != unknownServerVersion {
+		t.Errorf("server version = %q; expected %q", serverVersion, unknownServerVersion)
+	}
+	if refs := q.ActiveRefs(serverVersion); !reflect.DeepEqual(refs, []string{"ns/unknown@1.0.0"}) {
+		t.Errorf("quarantined %q; expected the orb quarantined against the unknown version", refs)
+	}
+
+	// --server-version is taken as-is without the schema
+	q, serverVersion, err = loadQuarantine(context.Background(), logger, filename, "schema-0123456789abcdef", server.URL, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refs := q.ActiveRefs(serverVersion); serverVersion != "schema-0123456789abcdef" || !reflect.DeepEqual(refs, []string{"ns/known@1.0.0"}) {
+		t.Errorf("quarantined %q against %q; expected the orb of the given version", refs, serverVersion)
+	}
+}
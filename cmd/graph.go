@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	atomicfile "github.com/circle-makotom/orbs-sync/atomic-file"
+	depresolver "github.com/circle-makotom/orbs-sync/dependency-resolver"
+	"github.com/circle-makotom/orbs-sync/logging"
+)
+
+type GraphOpts struct {
+	OrbSrcDirPath    string
+	OutputPath       string
+	Format           string
+	Namespace        string
+	Family           string
+	Root             string
+	Depth            int
+	CollapseVersions bool
+}
+
+func cmdGraph() *cobra.Command {
+	opts := &GraphOpts{}
+
+	cmd := &cobra.Command{
+		Use:   "graph",
+		Short: "Export the dependency graph of orbs",
+		RunE: func(_ *cobra.Command, _ []string) error {
+			return ExportGraph(opts)
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&opts.OrbSrcDirPath, "src", "orbs", "Path to the directory containing orb sources")
+	flags.StringVar(&opts.OutputPath, "output", "-", "Path to the file to put the graph; - for the standard output")
+	flags.StringVar(&opts.Format, "format", "dot", "Output format; one of dot, mermaid and json")
+	flags.StringVar(&opts.Namespace, "namespace", "", "Only include orbs in the namespace")
+	flags.StringVar(&opts.Family, "family", "", "Only include versions of the orb, e.g., circleci/node")
+	flags.StringVar(&opts.Root, "root", "", "Only include orbs reachable from the orb; floating references like circleci/node@5 are accepted")
+	flags.IntVar(&opts.Depth, "depth", -1, "Maximum depth to follow dependencies from --root; negative for unlimited")
+	flags.BoolVar(&opts.CollapseVersions, "collapse-versions", false, "Collapse versions into orb families")
+
+	return cmd
+}
+
+func formatGraph(graph *depresolver.Graph, format string) (string, error) {
+	switch format {
+	case "dot":
+		return graph.DOT(), nil
+	case "mermaid":
+		return graph.Mermaid(), nil
+	case "json":
+		serialized, err := json.MarshalIndent(graph, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(serialized) + "\n", nil
+	default:
+		return "", fmt.Errorf("unknown format %q", format)
+	}
+}
+
+func ExportGraph(opts *GraphOpts) error {
+	logger := logging.New("graph")
+
+	// Load orbs
+	logger.Infof("loading orbs")
+	orbs, err := loadOrbsInDir(opts.OrbSrcDirPath)
+	if err != nil {
+		return errors.Wrap(err, "could not load orbs")
+	}
+
+	// Build and filter the graph
+	logger.Infof("building dependency graph")
+	graph, illegible := depresolver.BuildGraph(orbs)
+	if len(illegible) > 0 {
+		logger.Warnf("%d orb(s) excluded because of YAML parser errors", len(illegible))
+	}
+
+	if opts.Root != "" {
+		if graph, err = graph.Reachable(opts.Root, opts.Depth); err != nil {
+			return errors.Wrap(err, "could not pick up orbs from the root")
+		}
+	}
+	if opts.Namespace != "" {
+		graph = graph.FilterNamespace(opts.Namespace)
+	}
+	if opts.Family != "" {
+		graph = graph.FilterFamily(opts.Family)
+	}
+	if opts.CollapseVersions {
+		graph = graph.CollapseFamilies()
+	}
+
+	// Output the graph
+	formatted, err := formatGraph(graph, opts.Format)
+	if err != nil {
+		return errors.Wrap(err, "could not format the graph")
+	}
+
+	if opts.OutputPath == "-" {
+		_, err = os.Stdout.WriteString(formatted)
+	} else {
+		err = atomicfile.WriteFile(opts.OutputPath, []byte(formatted), 0644)
+	}
+
+	return errors.Wrap(err, "could not output the graph")
+}
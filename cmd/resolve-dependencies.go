@@ -1,24 +1,29 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
-	"log"
-	"os"
 	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 
+	atomicfile "github.com/circle-makotom/orbs-sync/atomic-file"
 	depresolver "github.com/circle-makotom/orbs-sync/dependency-resolver"
+	"github.com/circle-makotom/orbs-sync/logging"
+	"github.com/circle-makotom/orbs-sync/report"
 	"github.com/circle-makotom/orbs-sync/types"
 )
 
 type ResolveDependenciesOpts struct {
-	OrbSrcDirPath     string
-	OrderedListPath   string
-	IllegibleListPath string
-	UnresolvedMapPath string
+	OrbSrcDirPath       string
+	OrderedListPath     string
+	IllegibleListPath   string
+	UnresolvedMapPath   string
+	Only                []string
+	AvailableListPath   string
+	JUnitPath           string
+	MetricsTextfilePath string
 }
 
 func cmdResolveDependencies() *cobra.Command {
@@ -27,8 +32,8 @@ func cmdResolveDependencies() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "resolve-dependencies",
 		Short: "Resolve dependencies between orbs and return the order of orbs to import",
-		RunE: func(_ *cobra.Command, _ []string) error {
-			return ResolveDependencies(opts)
+		RunE: func(c *cobra.Command, _ []string) error {
+			return ResolveDependencies(c.Context(), opts)
 		},
 	}
 
@@ -37,22 +42,32 @@ func cmdResolveDependencies() *cobra.Command {
 	flags.StringVar(&opts.OrderedListPath, "ordered", "orbs-resolved.txt", "Path to the file to list resolved/ordered orbs")
 	flags.StringVar(&opts.IllegibleListPath, "illegible", "orbs-illegible.txt", "Path to the file to dump the list of orbs caused YAML parser errors")
 	flags.StringVar(&opts.UnresolvedMapPath, "unresolved", "orbs-unresolved.txt", "Path to the file to dump the map of unresolved orbs")
+	flags.StringVar(&opts.JUnitPath, "junit", "", "Path to the file to put the JUnit XML report, where unresolved and illegible orbs are failed test cases, if given")
+	flags.StringVar(&opts.AvailableListPath, "available", "", "Path to the file listing orbs already available on the destination, e.g., the output of bulk-import; dependencies on them are treated as satisfied")
+	flags.StringSliceVar(&opts.Only, "only", []string{}, "Only resolve the orbs and their dependencies; each value is either an orb ref like circleci/node@5 or a path to a file listing orb refs")
+	flags.StringVar(&opts.MetricsTextfilePath, "metrics-textfile", "", "Path to the file to put Prometheus metrics for the textfile collector of the node exporter on exit, e.g., /var/lib/node_exporter/orbs-sync.prom, if given")
 
 	return cmd
 }
 
-func dumpResolvedOrbs(filename string, resolvedOrder []*types.VersionedOrb) error {
-	contents := []string{}
+// Dump resolved orbs in the order to import, separating dependency levels by blank lines for bulk-import
+func dumpResolvedOrbs(filename string, resolvedLevels [][]*types.VersionedOrb) error {
+	levels := []string{}
+
+	for _, level := range resolvedLevels {
+		contents := []string{}
+		for _, orb := range level {
+			contents = append(contents, orb.Ref)
+		}
 
-	for _, orb := range resolvedOrder {
-		contents = append(contents, orb.Ref)
+		levels = append(levels, strings.Join(contents, "\n"))
 	}
 
-	return ioutil.WriteFile(filename, []byte(strings.Join(contents, "\n")), 0644)
+	return atomicfile.WriteFile(filename, []byte(strings.Join(levels, "\n\n")), 0644)
 }
 
 func dumpIllegibleOrbs(filename string, illegibleOrbRefs []string) error {
-	return ioutil.WriteFile(filename, []byte(strings.Join(illegibleOrbRefs, "\n")), 0644)
+	return atomicfile.WriteFile(filename, []byte(strings.Join(illegibleOrbRefs, "\n")), 0644)
 }
 
 func formatUnresolvedMap(unresolvedMap map[string][]string) string {
@@ -72,28 +87,55 @@ func formatUnresolvedMap(unresolvedMap map[string][]string) string {
 }
 
 func dumpUnresolvedOrbs(filename string, unresolvedMap map[string][]string) error {
-	return ioutil.WriteFile(filename, []byte(formatUnresolvedMap(unresolvedMap)), 0644)
+	return atomicfile.WriteFile(filename, []byte(formatUnresolvedMap(unresolvedMap)), 0644)
 }
 
-func ResolveDependencies(opts *ResolveDependenciesOpts) error {
-	logger := log.New(os.Stderr, "resolve-dependencies: ", 7)
+func ResolveDependencies(ctx context.Context, opts *ResolveDependenciesOpts) (err error) {
+	logger := logging.New("resolve-dependencies")
+	resolveReport := report.New()
+	defer func() {
+		err = writeMetricsTextfile(logger, opts.MetricsTextfilePath, "resolve-dependencies", err)
+	}()
 
 	// Load orbs
-	logger.Printf("loading orbs")
+	logger.Infof("loading orbs")
 	orbs, err := loadOrbsInDir(opts.OrbSrcDirPath)
 	if err != nil {
 		return errors.Wrap(err, "could not load orbs")
 	}
 
+	// Load orbs already available
+	availableRefs := []string{}
+	if opts.AvailableListPath != "" {
+		if availableRefs, err = readLines(opts.AvailableListPath); err != nil {
+			return errors.Wrap(err, "could not load the list of available orbs")
+		}
+	}
+
+	// Narrow down orbs to the dependency closure of the requested ones
+	if len(opts.Only) > 0 {
+		orbRefs, err := expandOrbRefArgs(opts.Only)
+		if err != nil {
+			return errors.Wrap(err, "could not load the list of orbs to resolve")
+		}
+
+		logger.Infof("picking up requested orbs and their dependencies")
+		var notFound []string
+		orbs, notFound = depresolver.Closure(orbs, orbRefs, availableRefs)
+		for _, orbRef := range notFound {
+			logger.Warnf("no orb found for %q", orbRef)
+		}
+	}
+
 	// Resolve dependencies
-	logger.Printf("resolving dependencies")
-	resolvedOrder, illegible, unresolved, err := depresolver.Resolve(orbs)
+	logger.Infof("resolving dependencies")
+	resolvedLevels, illegible, unresolved, err := depresolver.ResolveLevels(ctx, orbs, availableRefs)
 	if err != nil {
 		return errors.Wrap(err, "dependency resolver failed")
 	}
 
 	// Dump results
-	if err := dumpResolvedOrbs(opts.OrderedListPath, resolvedOrder); err != nil {
+	if err := dumpResolvedOrbs(opts.OrderedListPath, resolvedLevels); err != nil {
 		return errors.Wrap(err, "could not dump the list of resolved orbs")
 	}
 	if err := dumpIllegibleOrbs(opts.IllegibleListPath, illegible); err != nil {
@@ -103,5 +145,23 @@ func ResolveDependencies(opts *ResolveDependenciesOpts) error {
 		return errors.Wrap(err, "could not dump the map of unresolved orbs")
 	}
 
+	if opts.JUnitPath != "" {
+		resolvedRefs := []string{}
+		for _, level := range resolvedLevels {
+			for _, orb := range level {
+				resolvedRefs = append(resolvedRefs, orb.Ref)
+			}
+		}
+
+		resolveReport.AddResolved(resolvedRefs)
+		resolveReport.AddIllegible(illegible)
+		resolveReport.AddUnresolved(unresolved)
+		resolveReport.Finish()
+
+		if err := resolveReport.WriteJUnitFile(opts.JUnitPath, "resolve-dependencies"); err != nil {
+			return errors.Wrap(err, "could not dump the JUnit report")
+		}
+	}
+
 	return nil
 }
@@ -1,9 +1,25 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+
+	"github.com/circle-makotom/orbs-sync/events"
+	"github.com/circle-makotom/orbs-sync/logging"
+)
+
+const (
+	// Commands stopped at the time budget exit with this code, leaving the rest for the next run
+	ExitCodeIncomplete = 3
+
+	// Commands cancelled by SIGINT or SIGTERM exit with this code, after writing partial results
+	ExitCodeCancelled = 130
 )
 
 var (
@@ -11,21 +27,172 @@ var (
 	BuildAnnotation = "git"
 
 	debug = false
+
+	logLevel    string
+	logFormat   string
+	logFilePath string
+	quiet       bool
+
+	eventsFormat   string
+	eventsFilePath string
+
+	ErrIncomplete = errors.New("incomplete")
 )
 
 func Execute() error {
+	logger := logging.New("orbs-sync")
+	closeLogFile := func() error { return nil }
+	closeEvents := func() error { return nil }
+
 	cmd := &cobra.Command{
 		Use:          "orbs-sync",
 		Version:      fmt.Sprintf("%s (%s)", BuildName, BuildAnnotation),
 		SilenceUsage: true,
+
+		// Errors are logged in the configured format instead
+		SilenceErrors: true,
+
+		PersistentPreRunE: func(c *cobra.Command, _ []string) error {
+			closeEventsFile, err := configureEvents(c)
+			if err != nil {
+				return err
+			}
+
+			closeEvents = closeEventsFile
+
+			closeFile, err := configureLogging(c)
+			if err != nil {
+				return err
+			}
+
+			closeLogFile = closeFile
+			return nil
+		},
 	}
 
-	cmd.PersistentFlags().BoolVar(&debug, "debug", false, "Show debugging information")
+	flags := cmd.PersistentFlags()
+	flags.BoolVar(&debug, "debug", false, "Show debugging information, including debug logs unless --log-level is given")
+	flags.StringVar(&logLevel, "log-level", "info", "Minimum level of logs: debug, info, warn or error")
+	flags.StringVar(&logFormat, "log-format", "text", "Format of logs: text, or json for a JSON object per line")
+	flags.BoolVar(&quiet, "quiet", false, "Only show warnings and errors on the standard error; --log-file still takes logs of --log-level")
+	flags.StringVar(&logFilePath, "log-file", "", "Path to the file to append logs to as well, if given")
+	flags.StringVar(&eventsFormat, "events", "", "Write lifecycle events of orbs and phases in the format, if given; only ndjson is supported")
+	flags.StringVar(&eventsFilePath, "events-file", "-", "Path to the file to append events to; - for the standard output, which graph and why print their results to")
 
 	cmd.AddCommand(cmdCollect())
 	cmd.AddCommand(cmdResolveDependencies())
 	cmd.AddCommand(cmdBulkImport())
 	cmd.AddCommand(cmdSync())
+	cmd.AddCommand(cmdServeSync())
+	cmd.AddCommand(cmdGraph())
+	cmd.AddCommand(cmdWhy())
+
+	err := cmd.ExecuteContext(contextCancelledBySignals())
+	if err != nil {
+		logger.Errorf("%v", err)
+	}
+
+	if closeErr := closeEvents(); closeErr != nil && err == nil {
+		logger.Errorf("%v", closeErr)
+		err = closeErr
+	}
+
+	if closeErr := closeLogFile(); closeErr != nil && err == nil {
+		return errors.Wrap(closeErr, "could not close the log file")
+	}
+
+	return err
+}
+
+// Configure the logs of all the packages by the flags
+// Return the function to close the log file
+func configureLogging(c *cobra.Command) (func() error, error) {
+	level, err := logging.ParseLevel(logLevel)
+	if err != nil {
+		return nil, err
+	}
+	if debug && !c.Flags().Changed("log-level") {
+		level = logging.LevelDebug
+	}
+
+	format, err := logging.ParseFormat(logFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	closeLogFile, err := logging.Configure(logging.Options{Level: level, Format: format, Quiet: quiet, FilePath: logFilePath})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open the log file")
+	}
+
+	return closeLogFile, nil
+}
+
+// Route events of all the packages to the standard output or the file if requested; logs stay on the standard error
+// Return the function to close the file, which fails if any event could not be written
+func configureEvents(c *cobra.Command) (func() error, error) {
+	if eventsFormat == "" {
+		return func() error { return nil }, nil
+	}
+	if eventsFormat != "ndjson" {
+		return nil, fmt.Errorf("unknown event format %q; only ndjson is supported", eventsFormat)
+	}
+
+	if eventsFilePath == "-" {
+		if printsToStdout(c) {
+			return nil, fmt.Errorf("%s prints its results to the standard output; give --events-file to write events elsewhere", c.Name())
+		}
+
+		sink := events.NewNDJSONSink(os.Stdout)
+		events.SetSink(sink)
+		return sink.Err, nil
+	}
+
+	file, err := os.OpenFile(eventsFilePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open the events file")
+	}
+
+	sink := events.NewNDJSONSink(file)
+	events.SetSink(sink)
+
+	return func() error {
+		if err := sink.Err(); err != nil {
+			file.Close()
+			return err
+		}
+
+		return errors.Wrap(file.Close(), "could not close the events file")
+	}, nil
+}
+
+// Tell whether the command prints its results to the standard output, where events would be mixed into them
+func printsToStdout(c *cobra.Command) bool {
+	if c.Name() == "why" {
+		return true
+	}
+
+	output := c.Flags().Lookup("output")
+	return output != nil && output.Value.String() == "-"
+}
+
+// Return a context cancelled by the first SIGINT or SIGTERM, so that commands stop and write partial results
+// Signals after the first one terminate the programme at once as usual
+func contextCancelledBySignals() context.Context {
+	logger := logging.New("orbs-sync")
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		signal.Stop(signals)
+
+		logger.Warnf("received %v; stopping with partial results. Send it again to quit at once", sig)
+		cancel()
+	}()
 
-	return cmd.Execute()
+	return ctx
 }
@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/circle-makotom/orbs-sync/daemon"
+	"github.com/circle-makotom/orbs-sync/logging"
+	"github.com/circle-makotom/orbs-sync/report"
+	"github.com/circle-makotom/orbs-sync/schedule"
+)
+
+type ServeSyncOpts struct {
+	SyncOpts
+
+	ListenAddress string
+	APIToken      string
+	Interval      time.Duration
+	CronSchedule  string
+	StateDirPath  string
+	RunNow        bool
+}
+
+func cmdServeSync() *cobra.Command {
+	opts := &ServeSyncOpts{}
+
+	cmd := &cobra.Command{
+		Use:   "serve-sync",
+		Short: "Sync orbs on a schedule, serving the status over HTTP",
+		RunE: func(c *cobra.Command, _ []string) error {
+			return ServeSync(c.Context(), opts)
+		},
+	}
+
+	addSyncFlags(cmd, &opts.SyncOpts)
+
+	flags := cmd.Flags()
+	flags.StringVar(&opts.ListenAddress, "listen", "127.0.0.1:8080", "Address to serve the HTTP API on; --api-token is required unless it is a loopback address")
+	flags.StringVar(&opts.APIToken, "api-token", "", "Bearer token required by every endpoint of the HTTP API but /healthz")
+	flags.DurationVar(&opts.Interval, "interval", 6*time.Hour, "Interval between the end of a sync and the start of the next one")
+	flags.StringVar(&opts.CronSchedule, "schedule", "", "Cron expression with five fields in the local time zone to run syncs on, e.g., \"0 */6 * * *\"; overrides --interval")
+	flags.StringVar(&opts.StateDirPath, "state", "orbs-sync-state", "Path to the directory to keep the status and the report of the last sync")
+	flags.BoolVar(&opts.RunNow, "run-now", false, "Run a sync at once on start, without waiting for the schedule")
+
+	return cmd
+}
+
+// Tell whether the address to listen on is reachable only from this host
+func isLoopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func ServeSync(ctx context.Context, opts *ServeSyncOpts) error {
+	logger := logging.New("serve-sync")
+
+	// Anyone reaching the HTTP API could start and cancel syncs otherwise
+	if opts.APIToken == "" && !isLoopbackAddress(opts.ListenAddress) {
+		return fmt.Errorf("--api-token is required to listen on %q, which is not a loopback address", opts.ListenAddress)
+	}
+
+	var sched schedule.Schedule
+	var err error
+	if opts.CronSchedule != "" {
+		sched, err = schedule.ParseCron(opts.CronSchedule)
+	} else {
+		sched, err = schedule.Every(opts.Interval)
+	}
+	if err != nil {
+		return errors.Wrap(err, "invalid schedule")
+	}
+
+	d, err := daemon.New(func(ctx context.Context) (*report.Report, error) {
+		return runSync(ctx, &opts.SyncOpts)
+	}, sched, opts.StateDirPath)
+	if err != nil {
+		return errors.Wrap(err, "could not start the daemon")
+	}
+
+	// Listen before anything else, so that a port in use is reported at once
+	listener, err := net.Listen("tcp", opts.ListenAddress)
+	if err != nil {
+		return errors.Wrap(err, "could not listen for the HTTP API")
+	}
+
+	server := &http.Server{Handler: d.Handler(opts.APIToken)}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Errorf("HTTP API stopped: %v", err)
+		}
+	}()
+	logger.Infof("serving the HTTP API on %s", listener.Addr())
+
+	if opts.RunNow {
+		d.Trigger()
+	}
+
+	// Runs until interrupted; the run in progress is cancelled and writes partial results then
+	if err := d.Run(ctx); err != nil {
+		return err
+	}
+
+	logger.Infof("shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return server.Shutdown(shutdownCtx)
+}
@@ -1,26 +1,55 @@
 package cmd
 
 import (
-	"log"
-	"os"
+	"context"
+	"fmt"
 	"strings"
+	"time"
 
 	bulkimporter "github.com/circle-makotom/orbs-sync/bulk-importer"
 	"github.com/circle-makotom/orbs-sync/collector"
 	depresolver "github.com/circle-makotom/orbs-sync/dependency-resolver"
+	"github.com/circle-makotom/orbs-sync/logging"
+	nsmapper "github.com/circle-makotom/orbs-sync/namespace-mapper"
+	"github.com/circle-makotom/orbs-sync/quarantine"
+	"github.com/circle-makotom/orbs-sync/report"
 	"github.com/circle-makotom/orbs-sync/types"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
 
 type SyncOpts struct {
-	SrcHostname        string
-	SrcToken           string
-	DstHostname        string
-	DstToken           string
-	BeSlow             bool
-	IncludeUncertified bool
-	KnownHiddenOrbs    []string
+	SrcHostname           string
+	SrcToken              string
+	DstHostname           string
+	DstToken              string
+	BeSlow                bool
+	IncludeUncertified    bool
+	KnownHiddenOrbs       []string
+	Concurrency           int
+	KeepGoing             bool
+	Validate              bool
+	Verify                bool
+	NamespaceMap          map[string]string
+	ReportPath            string
+	MaxInventoryAge       time.Duration
+	AllowedNamespaces     []string
+	DeniedNamespaces      []string
+	NeverCreateNamespaces bool
+	QuarantinePath        string
+	QuarantineTTL         time.Duration
+	ServerVersion         string
+	RetryQuarantined      bool
+	Priority              string
+	MaxDuration           time.Duration
+	AvailableListPath     string
+	DroppedListPath       string
+	RemainingListPath     string
+	LockPath              string
+	LockTTL               time.Duration
+	LockWait              time.Duration
+	JUnitPath             string
+	MetricsTextfilePath   string
 }
 
 func cmdSync() *cobra.Command {
@@ -29,11 +58,22 @@ func cmdSync() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "sync",
 		Short: "Sync orbs",
-		RunE: func(_ *cobra.Command, _ []string) error {
-			return Sync(opts)
+		RunE: func(c *cobra.Command, _ []string) error {
+			return Sync(c.Context(), opts)
 		},
 	}
 
+	addSyncFlags(cmd, opts)
+
+	// serve-sync serves these over HTTP instead
+	cmd.Flags().StringVar(&opts.JUnitPath, "junit", "", "Path to the file to put the JUnit XML report, where orbs not available in the end are failed test cases, if given")
+	cmd.Flags().StringVar(&opts.MetricsTextfilePath, "metrics-textfile", "", "Path to the file to put Prometheus metrics for the textfile collector of the node exporter on exit, e.g., /var/lib/node_exporter/orbs-sync.prom, if given")
+
+	return cmd
+}
+
+// Add flags of sync to the command, which is either sync or serve-sync
+func addSyncFlags(cmd *cobra.Command, opts *SyncOpts) {
 	flags := cmd.Flags()
 	flags.StringVar(&opts.SrcHostname, "src-host", "https://circleci.com", "Hostname of the CircleCI instance from where orbs are coming")
 	flags.StringVar(&opts.SrcToken, "src-token", "", "Token for the CircleCI instance from where orbs are coming")
@@ -42,21 +82,41 @@ func cmdSync() *cobra.Command {
 	flags.BoolVar(&opts.BeSlow, "slow", false, "This does nothing (being left for backward compatibility)")
 	flags.BoolVar(&opts.IncludeUncertified, "include-uncertified", false, "Fetch uncertified orbs as well")
 	flags.StringSliceVar(&opts.KnownHiddenOrbs, "must-include", knownHiddenOrbs, "Orbs to be included regardlessly - used for well-known hidden orbs")
+	flags.IntVar(&opts.Concurrency, "concurrency", 1, "Number of orbs to import at once in each dependency level")
+	flags.BoolVar(&opts.Validate, "validate", false, "Validate orbs on the destination before importing, and exclude incompatible ones")
+	flags.BoolVar(&opts.Verify, "verify", false, "Fetch sources of imported orbs from the destination, and report those not matching what was imported")
+	flags.StringToStringVar(&opts.NamespaceMap, "map-namespace", map[string]string{}, "Import orbs under other namespaces on the destination, e.g., circleci=mirror-circleci; references to them in orb sources are rewritten as well")
+	flags.StringVar(&opts.ReportPath, "report", "", "Path to the file to put the JSON report describing what happened to each orb, if given")
+	flags.DurationVar(&opts.MaxInventoryAge, "max-inventory-age", 0, "Look up orbs on the destination one-by-one if the inventory taken at the beginning gets older than this by the time of import, e.g., 1h; zero means no limit")
+	flags.StringSliceVar(&opts.AllowedNamespaces, "allow-namespace", []string{}, "Only import orbs into the namespaces on the destination; each value is a namespace or a glob pattern like mirror-*")
+	flags.StringSliceVar(&opts.DeniedNamespaces, "deny-namespace", []string{}, "Never import orbs into the namespaces on the destination; each value is a namespace or a glob pattern like mirror-*")
+	flags.BoolVar(&opts.NeverCreateNamespaces, "never-create-namespace", false, "Only import orbs into existing namespaces on the destination, without creating any")
+	flags.StringVar(&opts.QuarantinePath, "quarantine", "orbs-quarantine.json", "Path to the file to keep orbs dropped because of failures which never go away on the same server version; they are skipped in later runs. Empty to disable")
+	flags.DurationVar(&opts.QuarantineTTL, "quarantine-ttl", 30*24*time.Hour, "How long orbs are kept quarantined")
+	flags.StringVar(&opts.ServerVersion, "server-version", "", "Version of the destination server for the quarantine; it is fingerprinted by the GraphQL schema if not given")
+	flags.BoolVar(&opts.RetryQuarantined, "retry-quarantined", false, "Retry quarantined orbs as well")
+	flags.StringVar(&opts.Priority, "priority", "resolved", "Order to import orbs in, keeping dependencies of each orb before the orb: resolved, newest (latest versions of each orb first) or weighted (by the number of dependents and popularity as well)")
+	flags.DurationVar(&opts.MaxDuration, "max-duration", 0, fmt.Sprintf("Time budget, e.g., 40m; no new orbs are started after 90%% of it is used, and the command exits with code %d if any orbs are remaining", ExitCodeIncomplete))
+	flags.StringVar(&opts.AvailableListPath, "available", "", "Path to the file to put the list of orbs ensured to be available by import, if given")
+	flags.StringVar(&opts.DroppedListPath, "dropped", "", "Path to the file to put the list of dropped orbs while importing, if given")
+	flags.StringVar(&opts.RemainingListPath, "remaining", "", "Path to the file to put the list of orbs not attempted because of --max-duration or cancellation, if given")
+	flags.StringVar(&opts.LockPath, "lock", "", "Path to the lock file preventing concurrent runs against the same destination, e.g., on a shared filesystem; a local one in the temporary directory is used if not given")
+	flags.DurationVar(&opts.LockTTL, "lock-ttl", 5*time.Minute, "How long the lock is regarded as held without renewal, e.g., after the holder crashed on another host; the holder renews it every third of this")
+	flags.DurationVar(&opts.LockWait, "lock-wait", 0, "How long to wait for the lock held by another run, e.g., 10m; fail at once if zero")
+	flags.BoolVar(&opts.KeepGoing, "keep-going", false, "Record failures against orbs and continue with others, instead of aborting; exit non-zero in the end if any orbs failed")
 
 	cmd.MarkFlagRequired("src-token")
 	cmd.MarkFlagRequired("dst-host")
 	cmd.MarkFlagRequired("dst-token")
-
-	return cmd
 }
 
-func copyOrbsExcept(original, except []*types.VersionedOrb) []*types.VersionedOrb {
+func copyOrbsExcept(original []*types.VersionedOrb, exceptRefs []string) []*types.VersionedOrb {
 	ret := []*types.VersionedOrb{}
 
 	isInException := make(map[string]bool)
 
-	for _, exceptEntry := range except {
-		isInException[exceptEntry.Ref] = true
+	for _, exceptRef := range exceptRefs {
+		isInException[exceptRef] = true
 	}
 
 	for _, originalEntry := range original {
@@ -68,41 +128,213 @@ func copyOrbsExcept(original, except []*types.VersionedOrb) []*types.VersionedOr
 	return ret
 }
 
-func Sync(opts *SyncOpts) error {
-	logger := log.New(os.Stderr, "sync: ", 7)
+// List references of orbs which the given orbs depend on, without duplicates; illegible orbs are left to the resolver
+func listDependencyRefs(orbs []*types.VersionedOrb) []string {
+	ret := []string{}
+	isListed := make(map[string]bool)
+
+	for _, orb := range orbs {
+		dependencies, err := depresolver.ListDependencies(orb)
+		if err != nil {
+			continue
+		}
+
+		for _, dependency := range dependencies {
+			if !isListed[dependency] {
+				isListed[dependency] = true
+				ret = append(ret, dependency)
+			}
+		}
+	}
+
+	return ret
+}
+
+func Sync(ctx context.Context, opts *SyncOpts) error {
+	syncReport, err := runSync(ctx, opts)
+	if err != nil && syncReport != nil {
+		// The import took place but did not complete
+		err = wrapIncomplete(err, "sync incomplete")
+	}
+
+	return writeMetricsTextfile(logging.New("sync"), opts.MetricsTextfilePath, "sync", err)
+}
+
+// Run a sync, returning the report if the import took place
+// Errors of the import are returned as-is along with the report
+func runSync(ctx context.Context, opts *SyncOpts) (_ *report.Report, err error) {
+	logger := logging.New("sync")
+	startedAt := time.Now()
+
+	syncReport := report.New()
+
+	mapping, err := nsmapper.NewMapping(opts.NamespaceMap)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid namespace mapping")
+	}
+
+	policy, err := bulkimporter.NewNamespacePolicy(opts.AllowedNamespaces, opts.DeniedNamespaces, opts.NeverCreateNamespaces)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid namespace policy")
+	}
+
+	priority, err := depresolver.ParsePriorityMode(opts.Priority)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid priority")
+	}
+
+	popularity := make(map[string]int)
+	if priority == depresolver.PriorityWeighted {
+		if popularity, err = collector.FetchPopularityWithNewClient(ctx, opts.SrcHostname, APIEndpoint, opts.SrcToken, opts.IncludeUncertified, debug); err != nil {
+			return nil, errors.Wrap(err, "could not fetch the popularity of orbs from source")
+		}
+	}
+
+	// Lock the destination, as concurrent runs race on creation of namespaces and orbs, and on the quarantine
+	destinationLock, err := lockDestination(ctx, opts.LockPath, opts.DstHostname, "sync", opts.LockTTL, opts.LockWait)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not lock the destination")
+	}
+	defer func() {
+		err = releaseLock(logger, destinationLock, err)
+	}()
+
+	// Stop importing once the lock is lost to another run
+	ctx, cancel := destinationLock.Context(ctx)
+	defer cancel()
+
+	// Load quarantined orbs
+	var q *quarantine.Quarantine
+	quarantined := []string{}
+	serverVersion := opts.ServerVersion
+	if opts.QuarantinePath != "" {
+		if q, serverVersion, err = loadQuarantine(ctx, logger, opts.QuarantinePath, opts.ServerVersion, opts.DstHostname, opts.DstToken); err != nil {
+			return nil, errors.Wrap(err, "could not load the quarantine")
+		}
+
+		if !opts.RetryQuarantined {
+			quarantined = mapping.MapRefs(q.ActiveRefs(serverVersion))
+		}
+	}
 
 	// Fetch orbs from src
-	srcOrbs, err := collector.ListAllVersionedOrbsWithNewClient(opts.SrcHostname, APIEndpoint, opts.SrcToken, opts.KnownHiddenOrbs, true, opts.IncludeUncertified, opts.BeSlow, debug)
+	srcOrbs, err := collector.ListAllVersionedOrbsWithNewClient(ctx, opts.SrcHostname, APIEndpoint, opts.SrcToken, opts.KnownHiddenOrbs, true, opts.IncludeUncertified, opts.BeSlow, debug)
 	if err != nil {
-		return errors.Wrap(err, "could not fetch orbs from source")
+		return nil, errors.Wrap(err, "could not fetch orbs from source")
 	}
 
-	// List orbs on dst
-	dstOrbs, err := collector.ListAllVersionedOrbsWithNewClient(opts.DstHostname, APIEndpoint, opts.DstToken, opts.KnownHiddenOrbs, false, opts.IncludeUncertified, opts.BeSlow, debug)
+	// Map namespaces, so that orbs from src are resolved and compared with those on dst by their names on dst
+	if srcOrbs, err = mapping.MapOrbs(srcOrbs); err != nil {
+		return nil, errors.Wrap(err, "could not map namespaces")
+	}
+
+	// Take inventory of dst, which is used for the importer as well
+	dstInventory, err := collector.FetchInventoryWithNewClient(ctx, opts.DstHostname, APIEndpoint, opts.DstToken, mapping.MapRefs(opts.KnownHiddenOrbs), debug)
 	if err != nil {
-		return errors.Wrap(err, "could not list orbs on destination")
+		return nil, errors.Wrap(err, "could not list orbs on destination")
+	}
+
+	// Versions of orbs having too many versions on dst are not all listed, so look up those depended on by orbs from src
+	if err := dstInventory.LookupCappedWithNewClient(ctx, opts.DstHostname, APIEndpoint, opts.DstToken, listDependencyRefs(srcOrbs), debug); err != nil {
+		return nil, errors.Wrap(err, "could not look up orbs on destination")
 	}
 
-	// Resolve dependencies
-	orbsInResolvedOrder, illegible, unresolved, err := depresolver.Resolve(srcOrbs)
+	// Resolve dependencies; orbs on dst satisfy dependencies as well, even if they are not on src
+	dstOrbRefs := dstInventory.Refs()
+
+	resolvedLevels, illegible, unresolved, err := depresolver.ResolveLevels(ctx, srcOrbs, dstOrbRefs)
 	if err != nil {
-		return errors.Wrap(err, "dependency resolver failed")
+		return nil, errors.Wrap(err, "dependency resolver failed")
+	}
+
+	orbsInResolvedOrder := []*types.VersionedOrb{}
+	for _, level := range resolvedLevels {
+		orbsInResolvedOrder = append(orbsInResolvedOrder, level...)
 	}
 
 	// Filter those already available on destination
-	filteredOrbsInResolvedOrder := copyOrbsExcept(orbsInResolvedOrder, dstOrbs)
+	filteredOrbsInResolvedOrder := copyOrbsExcept(orbsInResolvedOrder, dstOrbRefs)
+
+	filteredOrbRefs := []string{}
+	for _, orb := range filteredOrbsInResolvedOrder {
+		filteredOrbRefs = append(filteredOrbRefs, orb.Ref)
+	}
+
+	alreadyPresent := []string{}
+	for _, orb := range copyOrbsExcept(orbsInResolvedOrder, filteredOrbRefs) {
+		alreadyPresent = append(alreadyPresent, orb.Ref)
+	}
+
+	// Outputs name orbs as on the source, just like those of bulk-import
+	illegible = mapping.UnmapRefs(illegible)
+	unresolved = unmapUnresolved(mapping, unresolved)
+
+	syncReport.AddAlreadyPresent(mapping.UnmapRefs(alreadyPresent))
+	syncReport.AddIllegible(illegible)
+	syncReport.AddUnresolved(unresolved)
 
 	// Import orbs
-	_, dropped, err := bulkimporter.ImportOrbsWithNewClient(filteredOrbsInResolvedOrder, opts.DstHostname, APIEndpoint, opts.DstToken, debug)
-	if err != nil {
-		return errors.Wrap(err, "import failed")
+	result, err := bulkimporter.ImportOrbsWithNewClient(ctx, filteredOrbsInResolvedOrder, opts.DstHostname, APIEndpoint, opts.DstToken, debug, &bulkimporter.ImportOpts{
+		Concurrency:     opts.Concurrency,
+		KeepGoing:       opts.KeepGoing,
+		Validate:        opts.Validate,
+		Verify:          opts.Verify,
+		Quarantined:     quarantined,
+		LevelOf:         depresolver.MapLevels(resolvedLevels),
+		Priority:        priority,
+		Popularity:      mapping.MapPopularity(popularity),
+		Deadline:        deadlineOf(startedAt, opts.MaxDuration),
+		NamespacePolicy: policy,
+		Inventory:       dstInventory,
+		MaxInventoryAge: opts.MaxInventoryAge,
+	})
+	if result == nil {
+		return nil, errors.Wrap(err, "import failed")
+	}
+	result = unmapResult(mapping, result)
+
+	if q != nil {
+		if err := updateQuarantine(q, opts.QuarantinePath, serverVersion, opts.QuarantineTTL, result); err != nil {
+			return nil, errors.Wrap(err, "could not update the quarantine")
+		}
+	}
+
+	logger.Infof("here is the list of orbs caused YAML parser error\n\n%v\n\n", strings.Join(illegible, "\n"))
+	logger.Infof("here is the map of orbs with unresolvable dependencies\n\n%v\n\n", formatUnresolvedMap(unresolved))
+	if opts.Validate {
+		logger.Infof("here is the compatibility report of orbs validated on destination\n\n%v\n\n", formatValidationResults(result.Validation))
+	}
+	logger.Infof("here is the list of orbs dropped during import\n\n%v\n\n", formatDroppedOrbs(result.Dropped))
+	if len(result.Remaining) > 0 {
+		logger.Infof("here is the list of orbs remaining at the deadline or cancellation\n\n%v\n\n", strings.Join(result.Remaining, "\n"))
+	}
+	if opts.Verify {
+		logger.Infof("here is the list of imported orbs not matching on destination\n\n%v\n\n", formatUnmatchedVerificationResults(result.Verification))
+	}
+
+	syncReport.AddImportResult(result)
+	syncReport.Finish()
+
+	if opts.ReportPath != "" {
+		if err := syncReport.WriteFile(opts.ReportPath); err != nil {
+			return nil, errors.Wrap(err, "could not dump the report")
+		}
+	}
+	if opts.JUnitPath != "" {
+		if err := syncReport.WriteJUnitFile(opts.JUnitPath, "sync"); err != nil {
+			return nil, errors.Wrap(err, "could not dump the JUnit report")
+		}
 	}
 
-	logger.Printf("here is the list of orbs caused YAML parser error\n\n%v\n\n", strings.Join(illegible, "\n"))
-	logger.Printf("here is the map of orbs with unresolvable dependencies\n\n%v\n\n", formatUnresolvedMap(unresolved))
-	logger.Printf("here is the list of orbs dropped during import\n\n%v\n\n", strings.Join(dropped, "\n"))
+	if err := dumpProcessedOrbRefs(opts.AvailableListPath, opts.DroppedListPath, opts.RemainingListPath, result); err != nil {
+		return nil, errors.Wrap(err, "could not dump the lists of processed orbs")
+	}
+
+	if err != nil {
+		return syncReport, err
+	}
 
-	logger.Println("sync completed!")
+	logger.Infof("sync completed!")
 
-	return nil
+	return syncReport, nil
 }
@@ -0,0 +1,172 @@
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	depresolver "github.com/circle-makotom/orbs-sync/dependency-resolver"
+	"github.com/circle-makotom/orbs-sync/logging"
+)
+
+type WhyOpts struct {
+	OrbSrcDirPath     string
+	IllegibleListPath string
+	UnresolvedMapPath string
+	DroppedListPath   string
+}
+
+func cmdWhy() *cobra.Command {
+	opts := &WhyOpts{}
+
+	cmd := &cobra.Command{
+		Use:   "why <orb-ref>",
+		Short: "Explain why an orb was unresolved or dropped",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			return Why(opts, args[0])
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&opts.OrbSrcDirPath, "src", "orbs", "Path to the directory containing orb sources")
+	flags.StringVar(&opts.IllegibleListPath, "illegible", "orbs-illegible.txt", "Path to the file containing the list of orbs caused YAML parser errors")
+	flags.StringVar(&opts.UnresolvedMapPath, "unresolved", "orbs-unresolved.txt", "Path to the file containing the map of unresolved orbs")
+	flags.StringVar(&opts.DroppedListPath, "dropped", "orbs-dropped.txt", "Path to the file containing the list of dropped orbs while importing")
+
+	return cmd
+}
+
+// Parse the map of unresolved orbs formatted by formatUnresolvedMap
+func parseUnresolvedMap(lines []string) (map[string][]string, error) {
+	ret := make(map[string][]string)
+	quotedPattern := regexp.MustCompile(`"(?:[^"\\]|\\.)*"`)
+
+	for _, line := range lines {
+		quotedRefs := quotedPattern.FindAllString(line, -1)
+		if len(quotedRefs) == 0 {
+			return nil, fmt.Errorf("malformed line %q", line)
+		}
+
+		refs := []string{}
+		for _, quotedRef := range quotedRefs {
+			ref, err := strconv.Unquote(quotedRef)
+			if err != nil {
+				return nil, errors.Wrapf(err, "malformed line %q", line)
+			}
+			refs = append(refs, ref)
+		}
+
+		ret[refs[0]] = refs[1:]
+	}
+
+	return ret, nil
+}
+
+// Parse the list of dropped orbs; each line starts with a ref optionally followed by tab-separated details
+func parseDroppedList(lines []string) map[string]string {
+	ret := make(map[string]string)
+
+	for _, line := range lines {
+		fields := strings.SplitN(line, "\t", 2)
+
+		if len(fields) > 1 {
+			ret[fields[0]] = strings.ReplaceAll(fields[1], "\t", ": ")
+		} else {
+			ret[fields[0]] = "failed to be imported"
+		}
+	}
+
+	return ret
+}
+
+func formatExplanation(explanation *depresolver.Explanation, indent string) string {
+	line := indent + explanation.Ref
+	if explanation.Via != "" && explanation.Via != explanation.Ref {
+		line += fmt.Sprintf(" (as %s)", explanation.Via)
+	}
+	if explanation.Cause != "" {
+		line += fmt.Sprintf(": %s - %s", explanation.Cause, explanation.Detail)
+	}
+
+	lines := []string{line}
+	for _, dependency := range explanation.Dependencies {
+		lines = append(lines, formatExplanation(dependency, indent+"  "))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func Why(opts *WhyOpts, orbRef string) error {
+	logger := logging.New("why")
+
+	// Load orbs and outputs of the previous run
+	logger.Infof("loading orbs")
+	orbs, err := loadOrbsInDir(opts.OrbSrcDirPath)
+	if err != nil {
+		return errors.Wrap(err, "could not load orbs")
+	}
+
+	illegible, err := readLinesIfExists(opts.IllegibleListPath)
+	if err != nil {
+		return errors.Wrap(err, "could not load the list of orbs caused YAML parser errors")
+	}
+
+	unresolvedLines, err := readLinesIfExists(opts.UnresolvedMapPath)
+	if err != nil {
+		return errors.Wrap(err, "could not load the map of unresolved orbs")
+	}
+	unresolved, err := parseUnresolvedMap(unresolvedLines)
+	if err != nil {
+		return errors.Wrap(err, "could not parse the map of unresolved orbs")
+	}
+
+	droppedLines, err := readLinesIfExists(opts.DroppedListPath)
+	if err != nil {
+		return errors.Wrap(err, "could not load the list of dropped orbs")
+	}
+	dropped := parseDroppedList(droppedLines)
+
+	// Trace dependencies
+	graph, illegibleInSrc := depresolver.BuildGraph(orbs)
+
+	explanation, err := graph.Explain(orbRef, append(illegible, illegibleInSrc...), dropped)
+	if err != nil {
+		return errors.Wrap(err, "could not trace dependencies")
+	}
+
+	// Tell what we found
+	status := []string{}
+	if _, ok := unresolved[explanation.Ref]; ok {
+		status = append(status, "unresolved")
+	}
+	if _, ok := dropped[explanation.Ref]; ok {
+		status = append(status, "dropped")
+	}
+	if len(status) > 0 {
+		fmt.Printf("%s was %s in the previous run\n\n", explanation.Ref, strings.Join(status, " and "))
+	}
+
+	if explanation.IsBlocked() {
+		fmt.Printf("dependency chain down to root causes:\n\n%s\n\n", formatExplanation(explanation, "  "))
+	} else {
+		fmt.Printf("no blocking dependency found for %s\n\n", explanation.Ref)
+	}
+
+	// Healthy orbs block nothing
+	if !explanation.IsBlocked() && len(status) == 0 {
+		return nil
+	}
+
+	if dependents := graph.BlockedDependents(explanation.Ref); len(dependents) > 0 {
+		fmt.Printf("dependents blocked as a result:\n\n  %s\n", strings.Join(dependents, "\n  "))
+	} else {
+		fmt.Printf("no dependents are blocked as a result\n")
+	}
+
+	return nil
+}
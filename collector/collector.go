@@ -1,10 +1,10 @@
 package collector
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"net/http"
-	"os"
+	"time"
 
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v3"
@@ -12,6 +12,10 @@ import (
 	circleapi "github.com/CircleCI-Public/circleci-cli/api"
 	circleql "github.com/CircleCI-Public/circleci-cli/api/graphql"
 
+	apicall "github.com/circle-makotom/orbs-sync/api-call"
+	"github.com/circle-makotom/orbs-sync/events"
+	"github.com/circle-makotom/orbs-sync/logging"
+	"github.com/circle-makotom/orbs-sync/metrics"
 	"github.com/circle-makotom/orbs-sync/types"
 )
 
@@ -94,7 +98,25 @@ const (
 	`
 )
 
-var logger = log.New(os.Stderr, "collector: ", 7)
+var (
+	logger = logging.NewSwappable(logging.New("collector"))
+
+	metricOrbsDiscovered = metrics.NewCounterVec("orbs_sync_orbs_discovered_total", "Versioned orbs collected from the source, excluding illegible ones")
+)
+
+// Replace the logger of the collector, e.g., to route entries on illegible orbs and pagination to the logger of the programme using it
+func SetLogger(l logging.Printer) {
+	logger.Set(l)
+}
+
+// Emit events of the orb collected from the source, along with its source if fetched as well
+// This is not done on listing versions for an inventory, as orbs on the destination are not discovered
+func emitDiscovered(orb *types.VersionedOrb, withSource bool) {
+	events.Emit(&events.Event{Type: events.OrbDiscovered, Ref: orb.Ref})
+	if withSource {
+		events.Emit(&events.Event{Type: events.SourceFetched, Ref: orb.Ref})
+	}
+}
 
 type versionAPIResponse struct {
 	Version string "json:\"version\""
@@ -111,10 +133,12 @@ type listVersionsForOneResponse struct {
 func processVersionedOrb(name string, version versionAPIResponse) *types.VersionedOrb {
 	orbRef := fmt.Sprintf("%s@%s", name, version.Version)
 
-	logger.Printf("discovered %q\n", orbRef)
+	logger.Debugf("discovered %q\n", orbRef)
 
 	if err := yaml.Unmarshal([]byte(version.Source), &circleapi.OrbWithData{}); err != nil {
-		logger.Printf(errors.Wrapf(err, "corrupt orb %q detected; skipping", orbRef).Error())
+		logger.Warnf("%v", errors.Wrapf(err, "corrupt orb %q detected; skipping", orbRef))
+		metrics.OrbsIllegible.Inc("collect")
+		events.Emit(&events.Event{Type: events.OrbIllegible, Ref: orbRef, Phase: "collect", Error: err.Error()})
 		return nil
 	} else {
 		return &types.VersionedOrb{
@@ -126,10 +150,10 @@ func processVersionedOrb(name string, version versionAPIResponse) *types.Version
 	}
 }
 
-func listKnownHiddenOrbs(cl *circleql.Client, targetOrbNames []string, includeSource bool) ([]*types.VersionedOrb, error) {
+func listKnownHiddenOrbs(ctx context.Context, cl *circleql.Client, targetOrbNames []string, includeSource bool) ([]*types.VersionedOrb, error) {
 	ret := []*types.VersionedOrb{}
 
-	logger.Printf("injecting known hidden orbs")
+	logger.Infof("injecting known hidden orbs")
 
 	for _, orbName := range targetOrbNames {
 		var (
@@ -137,9 +161,9 @@ func listKnownHiddenOrbs(cl *circleql.Client, targetOrbNames []string, includeSo
 			err           error
 		)
 
-		logger.Printf("revealing %q", orbName)
+		logger.Debugf("revealing %q", orbName)
 
-		versionedOrbs, err = FetchVersionsForOne(cl, orbName, includeSource)
+		versionedOrbs, err = FetchVersionsForOne(ctx, cl, orbName, includeSource)
 
 		if err != nil {
 			return nil, errors.Wrapf(err, "could not list orbs %q", orbName)
@@ -152,17 +176,17 @@ func listKnownHiddenOrbs(cl *circleql.Client, targetOrbNames []string, includeSo
 }
 
 // cf. https://github.com/CircleCI-Public/circleci-cli/blob/6ec121d68a6b12f46c604cc0f44d1e18d8bb2b52/api/api.go#L1346-L1417
-func FetchVersionsForOne(cl *circleql.Client, orbName string, includeSource bool) ([]*types.VersionedOrb, error) {
+func FetchVersionsForOne(ctx context.Context, cl *circleql.Client, orbName string, includeSource bool) ([]*types.VersionedOrb, error) {
 	ret := []*types.VersionedOrb{}
 
 	var query string
 	var response listVersionsForOneResponse
 
 	if includeSource {
-		logger.Printf("listing versions of orb %q with source\n", orbName)
+		logger.Debugf("listing versions of orb %q with source\n", orbName)
 		query = listVersionsWithSourceQuery
 	} else {
-		logger.Printf("listing versions of orb %q without source\n", orbName)
+		logger.Debugf("listing versions of orb %q without source\n", orbName)
 		query = listVersionsWithoutSourceQuery
 	}
 
@@ -170,7 +194,7 @@ func FetchVersionsForOne(cl *circleql.Client, orbName string, includeSource bool
 	request.SetToken(cl.Token)
 	request.Var("name", orbName)
 
-	if err := cl.Run(request, &response); err != nil {
+	if err := apicall.Run(ctx, "ListVersions", func() error { return cl.Run(request, &response) }); err != nil {
 		return nil, errors.Wrap(err, "GraphQL query failed")
 	}
 
@@ -184,14 +208,20 @@ func FetchVersionsForOne(cl *circleql.Client, orbName string, includeSource bool
 }
 
 // cf. https://github.com/CircleCI-Public/circleci-cli/blob/6ec121d68a6b12f46c604cc0f44d1e18d8bb2b52/api/api.go#L1419-L1492
-func ListAllVersionedOrbsFast(cl *circleql.Client, knownHiddenOrbs []string, includeSource, includeUncertified bool) ([]*types.VersionedOrb, error) {
+func ListAllVersionedOrbsFast(ctx context.Context, cl *circleql.Client, knownHiddenOrbs []string, includeSource, includeUncertified bool) ([]*types.VersionedOrb, error) {
 	var query string
 
+	defer metrics.PhaseDuration.SetSince(time.Now(), "collect")
+	defer events.StartPhase("collect")()
+
 	// Gimmick: Manually list known hidden orbs, including welcome orbs; these are hidden orbs, although referenced often
-	ret, err := listKnownHiddenOrbs(cl, knownHiddenOrbs, includeSource)
+	ret, err := listKnownHiddenOrbs(ctx, cl, knownHiddenOrbs, includeSource)
 	if err != nil {
 		return nil, err
 	}
+	for _, versionedOrb := range ret {
+		emitDiscovered(versionedOrb, includeSource)
+	}
 
 	if includeSource {
 		query = listAllVersionedOrbsWithSrcQuery
@@ -199,7 +229,7 @@ func ListAllVersionedOrbsFast(cl *circleql.Client, knownHiddenOrbs []string, inc
 		query = listAllVersionedOrbsWithoutSrcQuery
 	}
 
-	logger.Printf("fetching all versioned orbs at once")
+	logger.Infof("fetching all versioned orbs at once")
 	currentCursor := ""
 	for {
 		var result circleapi.OrbListResponse
@@ -210,7 +240,7 @@ func ListAllVersionedOrbsFast(cl *circleql.Client, knownHiddenOrbs []string, inc
 		request.Var("after", currentCursor)
 		request.Var("certifiedOnly", !includeUncertified)
 
-		if err := cl.Run(request, &result); err != nil {
+		if err := apicall.Run(ctx, "ListOrbsWithAllVersions", func() error { return cl.Run(request, &result) }); err != nil {
 			return nil, errors.Wrap(err, "GraphQL query failed")
 		}
 
@@ -220,6 +250,7 @@ func ListAllVersionedOrbsFast(cl *circleql.Client, knownHiddenOrbs []string, inc
 			for _, version := range edge.Node.Versions {
 				if versionedOrb := processVersionedOrb(edge.Node.Name, version); versionedOrb != nil {
 					ret = append(ret, versionedOrb)
+					emitDiscovered(versionedOrb, includeSource)
 				}
 			}
 		}
@@ -229,49 +260,72 @@ func ListAllVersionedOrbsFast(cl *circleql.Client, knownHiddenOrbs []string, inc
 		}
 	}
 
+	metricOrbsDiscovered.Add(float64(len(ret)))
+
 	return ret, nil
 }
 
 // cf. https://github.com/CircleCI-Public/circleci-cli/blob/6ec121d68a6b12f46c604cc0f44d1e18d8bb2b52/api/api.go#L1419-L1492
-func ListAllVersionedOrbsSlow(cl *circleql.Client, knownHiddenOrbs []string, includeSource, includeUncertified bool) ([]*types.VersionedOrb, error) {
+func ListAllVersionedOrbsSlow(ctx context.Context, cl *circleql.Client, knownHiddenOrbs []string, includeSource, includeUncertified bool) ([]*types.VersionedOrb, error) {
 	var ret []*types.VersionedOrb
 
+	defer metrics.PhaseDuration.SetSince(time.Now(), "collect")
+	defer events.StartPhase("collect")()
+
 	// Gimmick: Manually list known hidden orbs, including welcome orbs; these are hidden orbs, although referenced often
-	ret, err := listKnownHiddenOrbs(cl, knownHiddenOrbs, includeSource)
+	ret, err := listKnownHiddenOrbs(ctx, cl, knownHiddenOrbs, includeSource)
 	if err != nil {
 		return nil, err
 	}
+	for _, versionedOrb := range ret {
+		emitDiscovered(versionedOrb, includeSource)
+	}
 
-	logger.Printf("listing all orb names")
-	orbList, err := circleapi.ListOrbs(cl, includeUncertified)
+	logger.Infof("listing all orb names")
+	var orbList *circleapi.OrbsForListing
+	err = apicall.Run(ctx, "ListOrbs", func() (err error) {
+		orbList, err = circleapi.ListOrbs(cl, includeUncertified)
+		return err
+	})
 	if err != nil {
 		return nil, errors.Wrap(err, "error while listing orbs")
 	}
 
-	logger.Printf("fetching all versions of each orb")
+	logger.Infof("fetching all versions of each orb")
 	for _, orb := range orbList.Orbs {
-		logger.Printf("working on %q", orb.Name)
+		logger.Debugf("working on %q", orb.Name)
 
-		versionedOrbs, err := FetchVersionsForOne(cl, orb.Name, includeSource)
+		versionedOrbs, err := FetchVersionsForOne(ctx, cl, orb.Name, includeSource)
 
-		if err != nil {
+		// Do not fall back if the whole collection is cancelled
+		if err != nil && ctx.Err() != nil {
+			return nil, err
+		} else if err != nil {
 			// FetchVersionedOrbs can fail if the source of orb is astonishingly big
 			// As a fallback fetch each version one-by-one herein
 			// This operation can be astronomically slow however
-			logger.Printf("oof, could not fetch versions of orb %q at once; trying to fetch each version one-by-one", orb.Name)
+			logger.Warnf("oof, could not fetch versions of orb %q at once; trying to fetch each version one-by-one", orb.Name)
 
-			logger.Printf("listing all versions of orb %q without source", orb.Name)
-			orbVersions, err := FetchVersionsForOne(cl, orb.Name, false)
+			logger.Debugf("listing all versions of orb %q without source", orb.Name)
+			orbVersions, err := FetchVersionsForOne(ctx, cl, orb.Name, false)
 			if err != nil {
 				return nil, err
 			}
 
 			// Make sure that source fetch happens only if includeSource is truthy for sure.
 			// It is possible that the first attempt of FetchVersionsForOne got a temporary error even with includeSource falsy.
+			for _, orbVersion := range orbVersions {
+				emitDiscovered(orbVersion, false)
+			}
+
 			if includeSource {
 				for _, orbVersion := range orbVersions {
-					logger.Printf("fetching source of orb %s", orbVersion.Ref)
-					orbSrc, err := circleapi.OrbSource(cl, orbVersion.Ref)
+					logger.Debugf("fetching source of orb %s", orbVersion.Ref)
+					var orbSrc string
+					err := apicall.Run(ctx, "OrbSource", func() (err error) {
+						orbSrc, err = circleapi.OrbSource(cl, orbVersion.Ref)
+						return err
+					})
 					if err != nil {
 						return nil, errors.Wrapf(err, "could not fetch source of orb %q", orbVersion.Ref)
 					}
@@ -282,20 +336,26 @@ func ListAllVersionedOrbsSlow(cl *circleql.Client, knownHiddenOrbs []string, inc
 						Version: orbVersion.Version,
 						Source:  orbSrc,
 					})
+					events.Emit(&events.Event{Type: events.SourceFetched, Ref: orbVersion.Ref})
 				}
 			} else {
 				ret = append(ret, orbVersions...)
 			}
 		} else {
+			for _, versionedOrb := range versionedOrbs {
+				emitDiscovered(versionedOrb, includeSource)
+			}
 			ret = append(ret, versionedOrbs...)
 		}
 	}
 
+	metricOrbsDiscovered.Add(float64(len(ret)))
+
 	return ret, nil
 }
 
-func ListAllVersionedOrbsWithNewClient(hostname, apiEndpoint, token string, knownHiddenOrbs []string, includeSource, includeUncertified, beSlow, debug bool) ([]*types.VersionedOrb, error) {
+func ListAllVersionedOrbsWithNewClient(ctx context.Context, hostname, apiEndpoint, token string, knownHiddenOrbs []string, includeSource, includeUncertified, beSlow, debug bool) ([]*types.VersionedOrb, error) {
 	cl := circleql.NewClient(&http.Client{}, hostname, apiEndpoint, token, debug)
 
-	return ListAllVersionedOrbsSlow(cl, knownHiddenOrbs, includeSource, includeUncertified)
+	return ListAllVersionedOrbsSlow(ctx, cl, knownHiddenOrbs, includeSource, includeUncertified)
 }
@@ -0,0 +1,318 @@
+package collector
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	circleapi "github.com/CircleCI-Public/circleci-cli/api"
+	circleql "github.com/CircleCI-Public/circleci-cli/api/graphql"
+
+	apicall "github.com/circle-makotom/orbs-sync/api-call"
+	"github.com/circle-makotom/orbs-sync/events"
+	"github.com/circle-makotom/orbs-sync/metrics"
+)
+
+const (
+	inventoryBulkiness = 20
+
+	// The API lists up to this number of versions for each orb, without any means to page through the rest
+	inventoryVersionsCap = 200
+
+	// cf. https://github.com/CircleCI-Public/circleci-cli/blob/6ec121d68a6b12f46c604cc0f44d1e18d8bb2b52/api/api.go#L1424-L1448
+	listInventoryQuery = `
+		query ListOrbInventory($first: Int!, $after: String!) {
+			orbs(first: $first, after: $after, certifiedOnly: false) {
+				edges {
+					cursor
+					node {
+						id
+						name
+						versions(count: 200) {
+							version
+						}
+					}
+				}
+				pageInfo {
+					hasNextPage
+				}
+			}
+		}
+	`
+
+	// cf. https://github.com/CircleCI-Public/circleci-cli/blob/v0.1.16535/api/api.go#L1542-L1571
+	listNamespaceInventoryQuery = `
+		query ListNamespaceOrbInventory($namespace: String, $first: Int!, $after: String!) {
+			registryNamespace(name: $namespace) {
+				id
+				orbs(first: $first, after: $after) {
+					edges {
+						cursor
+						node {
+							id
+							name
+							versions(count: 200) {
+								version
+							}
+						}
+					}
+					pageInfo {
+						hasNextPage
+					}
+				}
+			}
+		}
+	`
+)
+
+var (
+	metricDestinationNamespaces = metrics.NewGaugeVec("orbs_sync_destination_namespaces", "Namespaces on the destination by the last inventory")
+	metricDestinationOrbs       = metrics.NewGaugeVec("orbs_sync_destination_orbs", "Orbs on the destination by the last inventory, excluding hidden ones")
+	metricDestinationVersions   = metrics.NewGaugeVec("orbs_sync_destination_versions", "Versioned orbs on the destination by the last inventory")
+)
+
+type inventoryOrbsResponse struct {
+	Edges []struct {
+		Cursor string
+		Node   struct {
+			ID       string
+			Name     string
+			Versions []struct {
+				Version string
+			}
+		}
+	}
+	PageInfo struct {
+		HasNextPage bool
+	}
+}
+
+type listInventoryResponse struct {
+	Orbs inventoryOrbsResponse
+}
+
+type listNamespaceInventoryResponse struct {
+	RegistryNamespace struct {
+		ID   string
+		Orbs inventoryOrbsResponse
+	}
+}
+
+// Inventory is a snapshot of namespaces, orb IDs and versions on an instance
+// Anything missing in the inventory may have been created after the snapshot was taken
+type Inventory struct {
+	TakenAt time.Time
+
+	Namespaces map[string]bool
+
+	// OrbIDs lacks IDs of hidden orbs, which are not listed in bulk
+	OrbIDs map[string]string
+
+	Versions map[string]bool
+
+	// Capped lists orbs which have as many versions as the API lists; other versions of them may be missing in Versions
+	Capped map[string]bool
+}
+
+func newInventory() *Inventory {
+	return &Inventory{
+		TakenAt:    time.Now(),
+		Namespaces: make(map[string]bool),
+		OrbIDs:     make(map[string]string),
+		Versions:   make(map[string]bool),
+		Capped:     make(map[string]bool),
+	}
+}
+
+func (inv *Inventory) addVersion(name, version string) {
+	inv.Namespaces[strings.Split(name, "/")[0]] = true
+	inv.Versions[name+"@"+version] = true
+}
+
+// Add orbs in a page of the listing, returning the cursor of the last one
+func (inv *Inventory) addOrbs(orbs *inventoryOrbsResponse, cursor string) string {
+	for _, edge := range orbs.Edges {
+		cursor = edge.Cursor
+
+		inv.OrbIDs[edge.Node.Name] = edge.Node.ID
+		inv.Namespaces[strings.Split(edge.Node.Name, "/")[0]] = true
+
+		for _, version := range edge.Node.Versions {
+			inv.addVersion(edge.Node.Name, version.Version)
+		}
+		if len(edge.Node.Versions) >= inventoryVersionsCap {
+			inv.Capped[edge.Node.Name] = true
+		}
+	}
+
+	return cursor
+}
+
+// Tell whether the versioned orb is in the inventory
+// The second value is false if the inventory cannot tell, as versions of the orb were capped; look it up on the instance then
+func (inv *Inventory) Lookup(orbRef string) (bool, bool) {
+	if inv.Versions[orbRef] {
+		return true, true
+	}
+
+	return false, !inv.Capped[strings.Split(orbRef, "@")[0]]
+}
+
+// Return refs of all the versioned orbs in the inventory, in the lexical order
+func (inv *Inventory) Refs() []string {
+	ret := []string{}
+
+	for orbRef := range inv.Versions {
+		ret = append(ret, orbRef)
+	}
+	sort.Strings(ret)
+
+	return ret
+}
+
+func (inv *Inventory) Age() time.Duration {
+	return time.Since(inv.TakenAt)
+}
+
+// Take an inventory of the instance in bulk; known hidden orbs are looked up one-by-one as they are not listed
+func FetchInventory(ctx context.Context, cl *circleql.Client, knownHiddenOrbs []string) (*Inventory, error) {
+	inv := newInventory()
+
+	defer metrics.PhaseDuration.SetSince(time.Now(), "inventory")
+	defer events.StartPhase("inventory")()
+
+	logger.Infof("taking inventory of orbs")
+
+	currentCursor := ""
+	for {
+		var result listInventoryResponse
+
+		request := circleql.NewRequest(listInventoryQuery)
+		request.SetToken(cl.Token)
+		request.Var("first", inventoryBulkiness)
+		request.Var("after", currentCursor)
+
+		if err := apicall.Run(ctx, "ListOrbInventory", func() error { return cl.Run(request, &result) }); err != nil {
+			return nil, errors.Wrap(err, "GraphQL query failed")
+		}
+
+		currentCursor = inv.addOrbs(&result.Orbs, currentCursor)
+
+		if !result.Orbs.PageInfo.HasNextPage {
+			break
+		}
+	}
+
+	hiddenOrbs, err := listKnownHiddenOrbs(ctx, cl, knownHiddenOrbs, false)
+	if err != nil {
+		return nil, err
+	}
+	hiddenVersions := make(map[string]int)
+	for _, versionedOrb := range hiddenOrbs {
+		inv.addVersion(versionedOrb.Name, versionedOrb.Version)
+		hiddenVersions[versionedOrb.Name] += 1
+	}
+	for name, count := range hiddenVersions {
+		if count >= inventoryVersionsCap {
+			inv.Capped[name] = true
+		}
+	}
+
+	logger.Infof("took inventory of %d namespace(s), %d orb(s) and %d version(s)", len(inv.Namespaces), len(inv.OrbIDs), len(inv.Versions))
+	if len(inv.Capped) > 0 {
+		logger.Warnf("%d orb(s) have %d versions or more, only some of which are listed; other versions of them will be looked up one-by-one", len(inv.Capped), inventoryVersionsCap)
+	}
+
+	metricDestinationNamespaces.Set(float64(len(inv.Namespaces)))
+	metricDestinationOrbs.Set(float64(len(inv.OrbIDs)))
+	metricDestinationVersions.Set(float64(len(inv.Versions)))
+
+	return inv, nil
+}
+
+// Take an inventory of the given namespaces on the instance in bulk, e.g., those to import orbs into
+// Namespaces missing in the inventory do not exist, and other namespaces are not taken into account at all
+func FetchNamespaceInventory(ctx context.Context, cl *circleql.Client, namespaces []string) (*Inventory, error) {
+	inv := newInventory()
+
+	defer metrics.PhaseDuration.SetSince(time.Now(), "inventory")
+	defer events.StartPhase("inventory")()
+
+	logger.Infof("taking inventory of orbs in %d namespace(s)", len(namespaces))
+
+	for _, ns := range namespaces {
+		currentCursor := ""
+		for {
+			var result listNamespaceInventoryResponse
+
+			request := circleql.NewRequest(listNamespaceInventoryQuery)
+			request.SetToken(cl.Token)
+			request.Var("namespace", ns)
+			request.Var("first", inventoryBulkiness)
+			request.Var("after", currentCursor)
+
+			if err := apicall.Run(ctx, "ListNamespaceOrbInventory", func() error { return cl.Run(request, &result) }); err != nil {
+				return nil, errors.Wrapf(err, "GraphQL query failed for namespace %q", ns)
+			}
+
+			if result.RegistryNamespace.ID == "" {
+				break
+			}
+			inv.Namespaces[ns] = true
+
+			currentCursor = inv.addOrbs(&result.RegistryNamespace.Orbs, currentCursor)
+
+			if !result.RegistryNamespace.Orbs.PageInfo.HasNextPage {
+				break
+			}
+		}
+	}
+
+	logger.Infof("took inventory of %d namespace(s), %d orb(s) and %d version(s)", len(inv.Namespaces), len(inv.OrbIDs), len(inv.Versions))
+	if len(inv.Capped) > 0 {
+		logger.Warnf("%d orb(s) have %d versions or more, only some of which are listed; other versions of them will be looked up one-by-one", len(inv.Capped), inventoryVersionsCap)
+	}
+
+	return inv, nil
+}
+
+// Look up versions of capped orbs one-by-one, as the inventory cannot tell whether they exist
+// References may be partial, e.g., my-ns/my-orb@1, in which case the version the instance resolves them to is added
+// References of orbs not capped are left to the inventory
+func (inv *Inventory) LookupCapped(ctx context.Context, cl *circleql.Client, orbRefs []string) error {
+	for _, orbRef := range orbRefs {
+		name := strings.Split(orbRef, "@")[0]
+		if !inv.Capped[name] || inv.Versions[orbRef] {
+			continue
+		}
+
+		var orbVersion *circleapi.OrbVersion
+		err := apicall.Run(ctx, "OrbInfo", func() (err error) {
+			orbVersion, err = circleapi.OrbInfo(cl, orbRef)
+			return err
+		})
+		if _, ok := err.(*circleapi.ErrOrbVersionNotExists); ok {
+			logger.Debugf("%q is not on the instance", orbRef)
+			continue
+		} else if err != nil {
+			return errors.Wrapf(err, "could not look up %q", orbRef)
+		}
+
+		logger.Debugf("%q is on the instance as %s@%s", orbRef, name, orbVersion.Version)
+		inv.addVersion(name, orbVersion.Version)
+	}
+
+	return nil
+}
+
+func (inv *Inventory) LookupCappedWithNewClient(ctx context.Context, hostname, apiEndpoint, token string, orbRefs []string, debug bool) error {
+	return inv.LookupCapped(ctx, circleql.NewClient(&http.Client{}, hostname, apiEndpoint, token, debug), orbRefs)
+}
+
+func FetchInventoryWithNewClient(ctx context.Context, hostname, apiEndpoint, token string, knownHiddenOrbs []string, debug bool) (*Inventory, error) {
+	return FetchInventory(ctx, circleql.NewClient(&http.Client{}, hostname, apiEndpoint, token, debug), knownHiddenOrbs)
+}
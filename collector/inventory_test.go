@@ -0,0 +1,163 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	circleql "github.com/CircleCI-Public/circleci-cli/api/graphql"
+)
+
+// Serve a page of orbs having the given number of versions each
+func serveInventory(t *testing.T, versionCounts map[string]int) *circleql.Client {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		edges := []interface{}{}
+		for name, count := range versionCounts {
+			versions := []interface{}{}
+			for idx := 0; idx < count; idx++ {
+				versions = append(versions, map[string]string{"version": fmt.Sprintf("1.0.%d", idx)})
+			}
+
+			edges = append(edges, map[string]interface{}{"cursor": name, "node": map[string]interface{}{"id": "id:" + name, "name": name, "versions": versions}})
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"orbs": map[string]interface{}{"edges": edges, "pageInfo": map[string]bool{"hasNextPage": false}}}})
+	}))
+	t.Cleanup(server.Close)
+
+	return circleql.NewClient(server.Client(), server.URL, "graphql-unstable", "token", false)
+}
+
+func TestFetchInventoryCapped(t *testing.T) {
+	inv, err := FetchInventory(context.Background(), serveInventory(t, map[string]int{"ns/few": 3, "ns/many": inventoryVersionsCap}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		orbRef  string
+		present bool
+		known   bool
+	}{
+		{"ns/few@1.0.2", true, true},
+		{"ns/few@1.0.3", false, true},
+		{"ns/many@1.0.0", true, true},
+		{"ns/many@0.9.0", false, false},
+		{"ns/unknown@1.0.0", false, true},
+	}
+
+	for _, c := range cases {
+		if present, known := inv.Lookup(c.orbRef); present != c.present || known != c.known {
+			t.Errorf("Lookup(%q) = (%v, %v); expected (%v, %v)", c.orbRef, present, known, c.present, c.known)
+		}
+	}
+}
+
+// Serve namespaces with orbs having the given versions, and versions of orbs one-by-one including those not listed
+func serveNamespaces(t *testing.T, listed map[string][]string, hidden map[string]string) *circleql.Client {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Query     string
+			Variables map[string]interface{}
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var data interface{}
+		switch {
+		case strings.Contains(request.Query, "ListNamespaceOrbInventory"):
+			ns, _ := request.Variables["namespace"].(string)
+			edges := []interface{}{}
+			exists := false
+			for name, versions := range listed {
+				if strings.HasPrefix(name, ns+"/") {
+					exists = true
+
+					versionNodes := []interface{}{}
+					for _, version := range versions {
+						versionNodes = append(versionNodes, map[string]string{"version": version})
+					}
+					edges = append(edges, map[string]interface{}{"cursor": name, "node": map[string]interface{}{"id": "id:" + name, "name": name, "versions": versionNodes}})
+				}
+			}
+
+			if exists {
+				data = map[string]interface{}{"registryNamespace": map[string]interface{}{"id": "id:" + ns, "orbs": map[string]interface{}{"edges": edges, "pageInfo": map[string]bool{"hasNextPage": false}}}}
+			} else {
+				data = map[string]interface{}{"registryNamespace": nil}
+			}
+		case strings.Contains(request.Query, "orbVersion("):
+			orbRef, _ := request.Variables["orbVersionRef"].(string)
+			if version, ok := hidden[orbRef]; ok {
+				data = map[string]interface{}{"orbVersion": map[string]interface{}{"id": "id:" + version, "version": version, "source": "version: 2.1\n", "orb": map[string]interface{}{"id": "id", "name": "name", "versions": []interface{}{}}}}
+			} else {
+				data = map[string]interface{}{"orbVersion": nil}
+			}
+		default:
+			http.Error(w, "unknown query", http.StatusBadRequest)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}))
+	t.Cleanup(server.Close)
+
+	return circleql.NewClient(server.Client(), server.URL, "graphql-unstable", "token", false)
+}
+
+func TestFetchNamespaceInventory(t *testing.T) {
+	manyVersions := []string{}
+	for idx := 0; idx < inventoryVersionsCap; idx++ {
+		manyVersions = append(manyVersions, fmt.Sprintf("2.0.%d", idx))
+	}
+
+	cl := serveNamespaces(t, map[string][]string{"ns/few": {"1.0.0"}, "ns/many": manyVersions, "other/orb": {"1.0.0"}}, map[string]string{
+		"ns/many@1.0.0": "1.0.0",
+		"ns/many@1":     "1.9.0",
+		"ns/few@1":      "1.0.0",
+	})
+
+	inv, err := FetchNamespaceInventory(context.Background(), cl, []string{"ns", "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !inv.Namespaces["ns"] || inv.Namespaces["missing"] || inv.Namespaces["other"] {
+		t.Errorf("namespaces = %v; expected only the existing one of those given", inv.Namespaces)
+	}
+	if inv.OrbIDs["ns/few"] != "id:ns/few" || inv.OrbIDs["other/orb"] != "" {
+		t.Errorf("orb IDs = %v; expected only orbs in the given namespace", inv.OrbIDs)
+	}
+	if !inv.Capped["ns/many"] || inv.Capped["ns/few"] {
+		t.Errorf("capped = %v; expected only the orb with many versions", inv.Capped)
+	}
+
+	// Versions of capped orbs are looked up one-by-one, with partial references resolved by the instance
+	if err := inv.LookupCapped(context.Background(), cl, []string{"ns/many@1.0.0", "ns/many@1", "ns/many@0.1.0", "ns/few@1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		orbRef  string
+		present bool
+		known   bool
+	}{
+		{"ns/many@1.0.0", true, true},
+		{"ns/many@1.9.0", true, true},
+		{"ns/many@0.1.0", false, false},
+		{"ns/few@1.0.0", true, true},
+		{"ns/few@1.1.0", false, true},
+	}
+
+	for _, c := range cases {
+		if present, known := inv.Lookup(c.orbRef); present != c.present || known != c.known {
+			t.Errorf("Lookup(%q) = (%v, %v); expected (%v, %v)", c.orbRef, present, known, c.present, c.known)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package collector
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	circleql "github.com/CircleCI-Public/circleci-cli/api/graphql"
+
+	apicall "github.com/circle-makotom/orbs-sync/api-call"
+)
+
+const (
+	popularityBulkiness = 20
+
+	// cf. https://github.com/CircleCI-Public/circleci-cli/blob/6ec121d68a6b12f46c604cc0f44d1e18d8bb2b52/api/api.go#L1468-L1495
+	listPopularityQuery = `
+		query ListOrbPopularity($first: Int!, $after: String!, $certifiedOnly: Boolean!) {
+			orbs(first: $first, after: $after, certifiedOnly: $certifiedOnly) {
+				edges {
+					cursor
+					node {
+						name
+						statistics {
+							last30DaysProjectCount
+						}
+					}
+				}
+				pageInfo {
+					hasNextPage
+				}
+			}
+		}
+	`
+)
+
+type listPopularityResponse struct {
+	Orbs struct {
+		Edges []struct {
+			Cursor string
+			Node   struct {
+				Name       string
+				Statistics struct {
+					Last30DaysProjectCount int
+				}
+			}
+		}
+		PageInfo struct {
+			HasNextPage bool
+		}
+	}
+}
+
+// Map orb names to the number of projects using them in the last 30 days
+func FetchPopularity(ctx context.Context, cl *circleql.Client, includeUncertified bool) (map[string]int, error) {
+	ret := make(map[string]int)
+
+	logger.Infof("fetching popularity of orbs")
+
+	currentCursor := ""
+	for {
+		var result listPopularityResponse
+
+		request := circleql.NewRequest(listPopularityQuery)
+		request.SetToken(cl.Token)
+		request.Var("first", popularityBulkiness)
+		request.Var("after", currentCursor)
+		request.Var("certifiedOnly", !includeUncertified)
+
+		if err := apicall.Run(ctx, "ListOrbPopularity", func() error { return cl.Run(request, &result) }); err != nil {
+			return nil, errors.Wrap(err, "GraphQL query failed")
+		}
+
+		for _, edge := range result.Orbs.Edges {
+			currentCursor = edge.Cursor
+			ret[edge.Node.Name] = edge.Node.Statistics.Last30DaysProjectCount
+		}
+
+		if !result.Orbs.PageInfo.HasNextPage {
+			break
+		}
+	}
+
+	return ret, nil
+}
+
+func FetchPopularityWithNewClient(ctx context.Context, hostname, apiEndpoint, token string, includeUncertified, debug bool) (map[string]int, error) {
+	return FetchPopularity(ctx, circleql.NewClient(&http.Client{}, hostname, apiEndpoint, token, debug), includeUncertified)
+}
@@ -0,0 +1,400 @@
+package daemon
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	atomicfile "github.com/circle-makotom/orbs-sync/atomic-file"
+	bulkimporter "github.com/circle-makotom/orbs-sync/bulk-importer"
+	"github.com/circle-makotom/orbs-sync/logging"
+	"github.com/circle-makotom/orbs-sync/metrics"
+	"github.com/circle-makotom/orbs-sync/report"
+	"github.com/circle-makotom/orbs-sync/schedule"
+)
+
+const (
+	lastRunFileName    = "last-run.json"
+	lastReportFileName = "last-report.json"
+)
+
+// Runs are recorded in the metrics under this command name
+const command = "serve-sync"
+
+var (
+	logger = logging.NewSwappable(logging.New("daemon"))
+
+	metricRunInProgress = metrics.NewGaugeVec("orbs_sync_run_in_progress", "Whether a run of the daemon is in progress")
+	metricNextRun       = metrics.NewGaugeVec("orbs_sync_next_run_timestamp_seconds", "Time of the next scheduled run of the daemon in seconds since the epoch, or zero if none")
+)
+
+// Replace the logger of the daemon, e.g., to route entries on scheduled and triggered runs to the logger of the programme embedding it
+func SetLogger(l logging.Printer) {
+	logger.Set(l)
+}
+
+// RunFunc runs a sync, returning the report if the import took place
+type RunFunc func(ctx context.Context) (*report.Report, error)
+
+type RunState string
+
+const (
+	StateRunning   RunState = "running"
+	StateSucceeded RunState = "succeeded"
+	StateFailed    RunState = "failed"
+	StateCancelled RunState = "cancelled"
+
+	// Runs are incomplete if they stopped at the time budget, leaving orbs for the next run
+	StateIncomplete RunState = "incomplete"
+)
+
+type Trigger string
+
+const (
+	TriggerSchedule Trigger = "schedule"
+	TriggerManual   Trigger = "manual"
+)
+
+// RunStatus describes a run of the sync
+type RunStatus struct {
+	ID         int                   `json:"id"`
+	Trigger    Trigger               `json:"trigger"`
+	State      RunState              `json:"state"`
+	StartedAt  time.Time             `json:"startedAt"`
+	FinishedAt *time.Time            `json:"finishedAt,omitempty"`
+	Error      string                `json:"error,omitempty"`
+	Summary    map[report.Status]int `json:"summary,omitempty"`
+}
+
+// Tell the state of a finished run by the error it returned
+func stateOf(err error) RunState {
+	var incompleteErr *bulkimporter.IncompleteError
+
+	switch {
+	case err == nil:
+		return StateSucceeded
+	case errors.Is(err, context.Canceled):
+		return StateCancelled
+	case errors.As(err, &incompleteErr):
+		return StateIncomplete
+	default:
+		return StateFailed
+	}
+}
+
+// Daemon runs syncs one at a time on the schedule or on demand, keeping the results of the last run in memory and on disk
+type Daemon struct {
+	run      RunFunc
+	schedule schedule.Schedule
+	stateDir string
+
+	triggers chan Trigger
+
+	mu        sync.Mutex
+	current   *RunStatus
+	cancelRun context.CancelFunc
+	last      *RunStatus
+	report    []byte
+	nextRunAt time.Time
+}
+
+// Create a daemon, restoring the results of the last run from the state directory if any
+func New(run RunFunc, sched schedule.Schedule, stateDir string) (*Daemon, error) {
+	d := &Daemon{
+		run:      run,
+		schedule: sched,
+		stateDir: stateDir,
+		triggers: make(chan Trigger, 1),
+	}
+	metricRunInProgress.Set(0)
+
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return nil, errors.Wrap(err, "could not create the state directory")
+	}
+
+	if contents, err := ioutil.ReadFile(filepath.Join(stateDir, lastRunFileName)); err == nil {
+		last := &RunStatus{}
+		if err := json.Unmarshal(contents, last); err != nil {
+			return nil, errors.Wrap(err, "could not parse the status of the last run")
+		}
+
+		// Runs in progress when the daemon stopped never finished
+		if last.State == StateRunning {
+			last.State = StateCancelled
+		}
+
+		d.last = last
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, errors.Wrap(err, "could not load the status of the last run")
+	}
+
+	if contents, err := ioutil.ReadFile(filepath.Join(stateDir, lastReportFileName)); err == nil {
+		d.report = contents
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, errors.Wrap(err, "could not load the report of the last run")
+	}
+
+	return d, nil
+}
+
+// Request a run now; return false if a run is in progress or requested already
+func (d *Daemon) Trigger() bool {
+	d.mu.Lock()
+	running := d.current != nil
+	d.mu.Unlock()
+
+	if running {
+		return false
+	}
+
+	select {
+	case d.triggers <- TriggerManual:
+		return true
+	default:
+		return false
+	}
+}
+
+// Cancel the run in progress; return false if there is none
+func (d *Daemon) Cancel() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.cancelRun == nil {
+		return false
+	}
+
+	logger.Infof("cancelling run %d", d.current.ID)
+	d.cancelRun()
+
+	return true
+}
+
+// Run syncs until the context is done; the run in progress is cancelled then
+func (d *Daemon) Run(ctx context.Context) error {
+	for {
+		nextRunAt := d.schedule.Next(time.Now())
+
+		d.mu.Lock()
+		d.nextRunAt = nextRunAt
+		d.mu.Unlock()
+
+		if nextRunAt.IsZero() {
+			metricNextRun.Set(0)
+		} else {
+			metricNextRun.SetTime(nextRunAt)
+		}
+
+		var timer <-chan time.Time
+		if !nextRunAt.IsZero() {
+			logger.Infof("next run is scheduled at %s", nextRunAt.Format(time.RFC3339))
+			timer = time.After(time.Until(nextRunAt))
+		} else {
+			logger.Infof("no more runs are scheduled; waiting for triggers")
+		}
+
+		trigger := TriggerSchedule
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer:
+		case trigger = <-d.triggers:
+		}
+
+		d.runOnce(ctx, trigger)
+	}
+}
+
+func (d *Daemon) runOnce(ctx context.Context, trigger Trigger) {
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	d.mu.Lock()
+	status := &RunStatus{ID: 1, Trigger: trigger, State: StateRunning, StartedAt: time.Now()}
+	if d.last != nil {
+		status.ID = d.last.ID + 1
+	}
+	d.current = status
+	d.cancelRun = cancel
+	d.mu.Unlock()
+
+	logger.Infof("starting run %d (%s)", status.ID, trigger)
+	metricRunInProgress.Set(1)
+
+	runReport, err := d.run(runCtx)
+
+	finishedAt := time.Now()
+	finished := *status
+	finished.FinishedAt = &finishedAt
+	finished.State = stateOf(err)
+	if err != nil {
+		finished.Error = err.Error()
+	}
+
+	var reportJSON []byte
+	if runReport != nil {
+		finished.Summary = runReport.Summary
+
+		if reportJSON, err = runReport.JSON(); err != nil {
+			logger.Errorf("could not encode the report of run %d: %v", status.ID, err)
+		}
+	}
+
+	logger.Infof("run %d %s in %v", status.ID, finished.State, finishedAt.Sub(status.StartedAt).Round(time.Second))
+	metricRunInProgress.Set(0)
+	metrics.ObserveRun(command, string(finished.State), finishedAt)
+
+	d.mu.Lock()
+	d.current = nil
+	d.cancelRun = nil
+	d.last = &finished
+	if reportJSON != nil {
+		d.report = reportJSON
+	}
+	d.mu.Unlock()
+
+	if err := d.saveState(&finished, reportJSON); err != nil {
+		logger.Errorf("could not save the results of run %d: %v", status.ID, err)
+	}
+}
+
+func (d *Daemon) saveState(last *RunStatus, reportJSON []byte) error {
+	if reportJSON != nil {
+		if err := atomicfile.WriteFile(filepath.Join(d.stateDir, lastReportFileName), reportJSON, 0644); err != nil {
+			return err
+		}
+	}
+
+	contents, err := json.MarshalIndent(last, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.WriteFile(filepath.Join(d.stateDir, lastRunFileName), contents, 0644)
+}
+
+type statusResponse struct {
+	Current   *RunStatus `json:"current"`
+	Last      *RunStatus `json:"last"`
+	NextRunAt *time.Time `json:"nextRunAt,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	contents, err := json.MarshalIndent(body, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(append(contents, '\n'))
+}
+
+func writeMessage(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]string{"message": message})
+}
+
+// Restrict the handler to the method
+func allow(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeMessage(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// Require the bearer token for the handler, unless the token is empty
+func authorize(token string, handler http.HandlerFunc) http.HandlerFunc {
+	if token == "" {
+		return handler
+	}
+
+	expected := []byte("Bearer " + token)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeMessage(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// Return the HTTP API of the daemon; endpoints other than /healthz require the bearer token if given
+//
+//	GET  /healthz  - tell the daemon is alive
+//	GET  /status   - the run in progress, the last run and the next scheduled run
+//	GET  /report   - the report of the last run which imported orbs
+//	GET  /metrics  - Prometheus metrics
+//	POST /trigger  - start a run now
+//	POST /cancel   - cancel the run in progress
+func (d *Daemon) Handler(token string) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", allow(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		writeMessage(w, http.StatusOK, "ok")
+	}))
+
+	mux.HandleFunc("/status", allow(http.MethodGet, authorize(token, func(w http.ResponseWriter, r *http.Request) {
+		d.mu.Lock()
+		response := &statusResponse{Current: d.current, Last: d.last}
+		if !d.nextRunAt.IsZero() && d.current == nil {
+			nextRunAt := d.nextRunAt
+			response.NextRunAt = &nextRunAt
+		}
+		d.mu.Unlock()
+
+		writeJSON(w, http.StatusOK, response)
+	})))
+
+	mux.HandleFunc("/report", allow(http.MethodGet, authorize(token, func(w http.ResponseWriter, r *http.Request) {
+		d.mu.Lock()
+		reportJSON := d.report
+		d.mu.Unlock()
+
+		if reportJSON == nil {
+			writeMessage(w, http.StatusNotFound, "no report yet")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(reportJSON)
+	})))
+
+	mux.Handle("/metrics", allow(http.MethodGet, authorize(token, metrics.Default.Handler().ServeHTTP)))
+
+	mux.HandleFunc("/trigger", allow(http.MethodPost, authorize(token, func(w http.ResponseWriter, r *http.Request) {
+		if !d.Trigger() {
+			writeMessage(w, http.StatusConflict, "a run is in progress or requested already")
+			return
+		}
+
+		writeMessage(w, http.StatusAccepted, "run requested")
+	})))
+
+	mux.HandleFunc("/cancel", allow(http.MethodPost, authorize(token, func(w http.ResponseWriter, r *http.Request) {
+		if !d.Cancel() {
+			writeMessage(w, http.StatusConflict, "no run in progress")
+			return
+		}
+
+		writeMessage(w, http.StatusAccepted, "run cancelled")
+	})))
+
+	return mux
+}
@@ -0,0 +1,285 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	bulkimporter "github.com/circle-makotom/orbs-sync/bulk-importer"
+	"github.com/circle-makotom/orbs-sync/report"
+)
+
+const testToken = "secret"
+
+// A schedule running only on triggers
+type neverSchedule struct{}
+
+func (neverSchedule) Next(after time.Time) time.Time {
+	return time.Time{}
+}
+
+// Start the daemon and its HTTP API, stopping them at the end of the test
+func startDaemon(t *testing.T, run RunFunc, stateDir string) (*Daemon, *httptest.Server) {
+	t.Helper()
+
+	d, err := New(run, neverSchedule{}, stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.Run(ctx)
+	}()
+
+	server := httptest.NewServer(d.Handler(testToken))
+	t.Cleanup(func() {
+		server.Close()
+		cancel()
+		<-done
+	})
+
+	return d, server
+}
+
+func request(t *testing.T, server *httptest.Server, method, path, token string) (int, []byte) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, server.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res.StatusCode, body
+}
+
+func getStatus(t *testing.T, server *httptest.Server) *statusResponse {
+	t.Helper()
+
+	code, body := request(t, server, http.MethodGet, "/status", testToken)
+	if code != http.StatusOK {
+		t.Fatalf("GET /status = %d; expected %d", code, http.StatusOK)
+	}
+
+	status := &statusResponse{}
+	if err := json.Unmarshal(body, status); err != nil {
+		t.Fatal(err)
+	}
+
+	return status
+}
+
+// Wait for the last run to become the one with the given ID
+func waitForLastRun(t *testing.T, server *httptest.Server, id int) *RunStatus {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if status := getStatus(t, server); status.Last != nil && status.Last.ID == id {
+			return status.Last
+		}
+	}
+
+	t.Fatalf("run %d did not finish", id)
+	return nil
+}
+
+func TestNewRestoresLastRun(t *testing.T) {
+	stateDir := t.TempDir()
+
+	lastRun := `{"id": 3, "trigger": "schedule", "state": "running", "startedAt": "2021-01-01T00:00:00Z"}`
+	if err := ioutil.WriteFile(filepath.Join(stateDir, lastRunFileName), []byte(lastRun), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lastReport := `{"summary": {"imported": 1}}`
+	if err := ioutil.WriteFile(filepath.Join(stateDir, lastReportFileName), []byte(lastReport), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, server := startDaemon(t, func(ctx context.Context) (*report.Report, error) {
+		return nil, nil
+	}, stateDir)
+
+	status := getStatus(t, server)
+	if status.Current != nil {
+		t.Errorf("current run = %+v; expected none", status.Current)
+	}
+	if status.Last == nil || status.Last.ID != 3 || status.Last.State != StateCancelled {
+		t.Errorf("last run = %+v; expected run 3 cancelled", status.Last)
+	}
+	if status.NextRunAt != nil {
+		t.Errorf("next run at %s; expected none", status.NextRunAt)
+	}
+
+	if code, body := request(t, server, http.MethodGet, "/report", testToken); code != http.StatusOK || string(body) != lastReport {
+		t.Errorf("GET /report = %d %q; expected %d %q", code, body, http.StatusOK, lastReport)
+	}
+
+	// Runs are numbered after the restored one
+	request(t, server, http.MethodPost, "/trigger", testToken)
+	if last := waitForLastRun(t, server, 4); last.State != StateSucceeded {
+		t.Errorf("run 4 %s; expected %s", last.State, StateSucceeded)
+	}
+}
+
+func TestTriggerAndCancel(t *testing.T) {
+	stateDir := t.TempDir()
+	started := make(chan struct{})
+
+	_, server := startDaemon(t, func(ctx context.Context) (*report.Report, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}, stateDir)
+
+	if code, _ := request(t, server, http.MethodGet, "/report", testToken); code != http.StatusNotFound {
+		t.Errorf("GET /report = %d before any run; expected %d", code, http.StatusNotFound)
+	}
+	if code, _ := request(t, server, http.MethodGet, "/trigger", testToken); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /trigger = %d; expected %d", code, http.StatusMethodNotAllowed)
+	}
+	if code, _ := request(t, server, http.MethodPost, "/cancel", testToken); code != http.StatusConflict {
+		t.Errorf("POST /cancel = %d with no run; expected %d", code, http.StatusConflict)
+	}
+
+	if code, _ := request(t, server, http.MethodPost, "/trigger", testToken); code != http.StatusAccepted {
+		t.Fatalf("POST /trigger = %d; expected %d", code, http.StatusAccepted)
+	}
+	<-started
+
+	status := getStatus(t, server)
+	if status.Current == nil || status.Current.ID != 1 || status.Current.State != StateRunning || status.Current.Trigger != TriggerManual {
+		t.Errorf("current run = %+v; expected run 1 running on the manual trigger", status.Current)
+	}
+
+	if code, _ := request(t, server, http.MethodPost, "/trigger", testToken); code != http.StatusConflict {
+		t.Errorf("POST /trigger = %d while running; expected %d", code, http.StatusConflict)
+	}
+
+	if code, _ := request(t, server, http.MethodPost, "/cancel", testToken); code != http.StatusAccepted {
+		t.Errorf("POST /cancel = %d while running; expected %d", code, http.StatusAccepted)
+	}
+
+	last := waitForLastRun(t, server, 1)
+	if last.State != StateCancelled || last.FinishedAt == nil {
+		t.Errorf("run 1 = %+v; expected it cancelled and finished", last)
+	}
+
+	if code, _ := request(t, server, http.MethodPost, "/cancel", testToken); code != http.StatusConflict {
+		t.Errorf("POST /cancel = %d after the run; expected %d", code, http.StatusConflict)
+	}
+
+	// The last run is kept on disk for restarts
+	saved := &RunStatus{}
+	if contents, err := ioutil.ReadFile(filepath.Join(stateDir, lastRunFileName)); err != nil {
+		t.Error(err)
+	} else if err := json.Unmarshal(contents, saved); err != nil {
+		t.Error(err)
+	} else if saved.ID != 1 || saved.State != StateCancelled {
+		t.Errorf("saved run = %+v; expected run 1 cancelled", saved)
+	}
+}
+
+func TestRunStates(t *testing.T) {
+	runReport := report.New()
+	runReport.AddAlreadyPresent([]string{"circleci/node@4.1.0"})
+	runReport.Finish()
+
+	cases := []struct {
+		name        string
+		runReport   *report.Report
+		err         error
+		expected    RunState
+		expectedErr bool
+	}{
+		{"succeeded", runReport, nil, StateSucceeded, false},
+		{"failed", nil, errors.New("something went wrong"), StateFailed, true},
+		{"incomplete", runReport, &bulkimporter.IncompleteError{Remaining: []string{"circleci/node@4.1.0"}}, StateIncomplete, true},
+		{"cancelled", nil, errors.Wrap(context.Canceled, "aborted"), StateCancelled, true},
+	}
+
+	for _, c := range cases {
+		c := c
+		_, server := startDaemon(t, func(ctx context.Context) (*report.Report, error) {
+			return c.runReport, c.err
+		}, t.TempDir())
+
+		if code, _ := request(t, server, http.MethodPost, "/trigger", testToken); code != http.StatusAccepted {
+			t.Errorf("%s: POST /trigger = %d; expected %d", c.name, code, http.StatusAccepted)
+			continue
+		}
+
+		last := waitForLastRun(t, server, 1)
+		if last.State != c.expected {
+			t.Errorf("%s: run 1 %s; expected %s", c.name, last.State, c.expected)
+		}
+		if (last.Error != "") != c.expectedErr {
+			t.Errorf("%s: error %q; expected an error: %v", c.name, last.Error, c.expectedErr)
+		}
+
+		code, _ := request(t, server, http.MethodGet, "/report", testToken)
+		if c.runReport != nil && (code != http.StatusOK || last.Summary[report.StatusAlreadyPresent] != 1) {
+			t.Errorf("%s: GET /report = %d with summary %v; expected the report", c.name, code, last.Summary)
+		} else if c.runReport == nil && code != http.StatusNotFound {
+			t.Errorf("%s: GET /report = %d; expected %d", c.name, code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestHandlerAuthorization(t *testing.T) {
+	_, server := startDaemon(t, func(ctx context.Context) (*report.Report, error) {
+		return nil, nil
+	}, t.TempDir())
+
+	cases := []struct {
+		method, path, token string
+		expected            int
+	}{
+		{http.MethodPost, "/trigger", "", http.StatusUnauthorized},
+		{http.MethodPost, "/trigger", "wrong", http.StatusUnauthorized},
+		{http.MethodPost, "/cancel", "", http.StatusUnauthorized},
+		{http.MethodPost, "/cancel", "wrong", http.StatusUnauthorized},
+		{http.MethodPost, "/cancel", testToken, http.StatusConflict},
+		{http.MethodGet, "/status", "", http.StatusUnauthorized},
+		{http.MethodGet, "/status", "wrong", http.StatusUnauthorized},
+		{http.MethodGet, "/status", testToken, http.StatusOK},
+		{http.MethodGet, "/report", "", http.StatusUnauthorized},
+		{http.MethodGet, "/report", testToken, http.StatusNotFound},
+		{http.MethodGet, "/metrics", "", http.StatusUnauthorized},
+		{http.MethodGet, "/metrics", testToken, http.StatusOK},
+		{http.MethodGet, "/healthz", "", http.StatusOK},
+	}
+
+	for _, c := range cases {
+		if code, _ := request(t, server, c.method, c.path, c.token); code != c.expected {
+			t.Errorf("%s %s with token %q = %d; expected %d", c.method, c.path, c.token, code, c.expected)
+		}
+	}
+
+	// Nothing is triggered without the token
+	if status := getStatus(t, server); status.Current != nil || status.Last != nil {
+		t.Errorf("status = %+v; expected no runs", status)
+	}
+}
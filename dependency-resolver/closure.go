@@ -0,0 +1,88 @@
+package depresolver
+
+import (
+	"context"
+
+	"github.com/circle-makotom/orbs-sync/types"
+)
+
+// Pick up the given orbs and whatever they depend on directly or indirectly, i.e., the transitive dependency closure
+// Floating references like my-orb@1, my-orb@volatile or my-orb are expanded to the highest version Resolve can resolve among the given orbs
+// They fall back to the highest version available if none is resolvable, for Resolve to report why
+// Dependencies satisfiable by availableRefs, e.g., orbs already on the destination, are not followed
+// Return the orbs in the closure and the references which no orb can satisfy
+func Closure(orbs []*types.VersionedOrb, orbRefs, availableRefs []string) ([]*types.VersionedOrb, []string) {
+	ret := []*types.VersionedOrb{}
+	notFound := []string{}
+
+	orbsByRef := make(map[string]*types.VersionedOrb)
+	allOrbRefs := []string{}
+	for _, orb := range orbs {
+		orbsByRef[orb.Ref] = orb
+		allOrbRefs = append(allOrbRefs, orb.Ref)
+	}
+	satisfierIndex := buildSatisfierIndex(allOrbRefs)
+	availableSatisfierIndex := buildSatisfierIndex(availableRefs)
+
+	// Any version satisfying a reference makes the dependent resolvable; lower versions are needed if higher ones are illegible or unresolvable
+	r := newResolver()
+	resolvableRefs := []string{}
+	if _, err := r.initMaps(context.Background(), orbs); err == nil {
+		levels, _ := r.run(context.Background(), orbs, availableRefs)
+		for _, level := range levels {
+			resolvableRefs = append(resolvableRefs, level...)
+		}
+	}
+	resolvableSatisfierIndex := buildSatisfierIndex(resolvableRefs)
+
+	procQueue := []string{}
+	for _, orbRef := range orbRefs {
+		// Bare orb names mean the latest version
+		if _, version := splitOrbRef(orbRef); version == "" {
+			orbRef += "@volatile"
+		}
+		procQueue = append(procQueue, orbRef)
+	}
+
+	visited := make(map[string]bool)
+	for ; len(procQueue) > 0; procQueue = procQueue[1:] {
+		if visited[procQueue[0]] {
+			continue
+		}
+		visited[procQueue[0]] = true
+
+		orbRef, ok := pickHighestSatisfier(resolvableSatisfierIndex, procQueue[0])
+		if !ok {
+			orbRef, ok = pickHighestSatisfier(satisfierIndex, procQueue[0])
+		}
+		if !ok {
+			notFound = append(notFound, procQueue[0])
+			continue
+		}
+		if procQueue[0] != orbRef {
+			if visited[orbRef] {
+				continue
+			}
+			visited[orbRef] = true
+		}
+
+		orb := orbsByRef[orbRef]
+		ret = append(ret, orb)
+
+		dependencies, err := parseDependencies(orb)
+		if err != nil {
+			// Leave it to Resolve to report the orb as illegible
+			continue
+		}
+
+		for dependency := range dependencies {
+			if _, isAvailable := availableSatisfierIndex[dependency]; !isAvailable {
+				procQueue = append(procQueue, dependency)
+			}
+		}
+	}
+
+	logger.Infof("closure done; %d picked up, %d not found\n", len(ret), len(notFound))
+
+	return ret, notFound
+}
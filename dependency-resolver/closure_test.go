@@ -0,0 +1,76 @@
+package depresolver
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/circle-makotom/orbs-sync/types"
+)
+
+func TestClosure(t *testing.T) {
+	orbs := []*types.VersionedOrb{
+		newTestOrb("ns/app@1.0.0", "ns/lib@1", "ns/util@volatile"),
+		newTestOrb("ns/lib@1.0.0"),
+		newTestOrb("ns/lib@1.1.0", "ns/hidden@1.0.0"),
+		newIllegibleTestOrb("ns/lib@1.2.0"),
+		newTestOrb("ns/lib@2.0.0"),
+		newTestOrb("ns/util@0.1.0"),
+		newTestOrb("ns/util@0.2.0", "ns/base@1.0.0"),
+		newTestOrb("ns/base@1.0.0"),
+		newTestOrb("ns/unrelated@1.0.0"),
+		newTestOrb("ns/broken@1.0.0", "ns/hidden@1.0.0"),
+	}
+
+	cases := []struct {
+		name          string
+		orbRefs       []string
+		availableRefs []string
+		expected      []string
+		notFound      []string
+	}{
+		{
+			// ns/lib@1.2.0 is illegible and ns/lib@1.1.0 is unresolvable, so ns/lib@1 falls back to ns/lib@1.0.0
+			name:     "falling back to resolvable versions",
+			orbRefs:  []string{"ns/app@1.0.0"},
+			expected: []string{"ns/app@1.0.0", "ns/base@1.0.0", "ns/lib@1.0.0", "ns/util@0.2.0"},
+			notFound: []string{},
+		},
+		{
+			name:     "bare names as the latest versions",
+			orbRefs:  []string{"ns/lib"},
+			expected: []string{"ns/lib@2.0.0"},
+			notFound: []string{},
+		},
+		{
+			// Unresolvable orbs are still picked up for Resolve to report
+			name:     "no resolvable versions",
+			orbRefs:  []string{"ns/broken@1", "ns/missing@1"},
+			expected: []string{"ns/broken@1.0.0"},
+			notFound: []string{"ns/hidden@1.0.0", "ns/missing@1"},
+		},
+		{
+			// Orbs available on the destination make ns/lib@1.1.0 resolvable, and are not followed
+			name:          "available orbs",
+			orbRefs:       []string{"ns/lib@1"},
+			availableRefs: []string{"ns/hidden@1.0.0"},
+			expected:      []string{"ns/lib@1.1.0"},
+			notFound:      []string{},
+		},
+	}
+
+	for _, c := range cases {
+		closure, notFound := Closure(orbs, c.orbRefs, c.availableRefs)
+
+		actual := []string{}
+		for _, orb := range closure {
+			actual = append(actual, orb.Ref)
+		}
+		sort.Strings(actual)
+		sort.Strings(notFound)
+
+		if !reflect.DeepEqual(actual, c.expected) || !reflect.DeepEqual(notFound, c.notFound) {
+			t.Errorf("%s: closure = %q, not found = %q; expected %q and %q", c.name, actual, notFound, c.expected, c.notFound)
+		}
+	}
+}
@@ -1,163 +1,359 @@
 package depresolver
 
 import (
-	"log"
-	"os"
-	"regexp"
+	"context"
+	"sort"
+	"time"
 
 	"gopkg.in/yaml.v3"
 
+	"github.com/circle-makotom/orbs-sync/events"
+	"github.com/circle-makotom/orbs-sync/logging"
+	"github.com/circle-makotom/orbs-sync/metrics"
 	"github.com/circle-makotom/orbs-sync/types"
 )
 
 var (
-	orbRefMap       map[string]*types.VersionedOrb
-	resolvedOrder   []*types.VersionedOrb
-	dependenciesMap map[string]map[string]string
-	dependentsMap   map[string]map[string]string
+	logger = logging.NewSwappable(logging.New("dependency-resolver"))
 
-	logger = log.New(os.Stderr, "dependency-resolver: ", 7)
+	metricOrbsResolved   = metrics.NewCounterVec("orbs_sync_orbs_resolved_total", "Versioned orbs whose dependencies were resolved")
+	metricOrbsUnresolved = metrics.NewCounterVec("orbs_sync_orbs_unresolved_total", "Versioned orbs with unresolvable dependencies")
 )
 
+// Replace the logger of the resolver, e.g., to route entries on unresolvable dependencies to the logger of the programme using it
+func SetLogger(l logging.Printer) {
+	logger.Set(l)
+}
+
 type orbImportingOrb struct {
 	Orbs map[string]interface{}
 }
 
-func getDependents(orbRef string) map[string]string {
-	dependents, ok := dependentsMap[orbRef]
+// Parse orbs imported by the given orb, including those imported by inline orbs
+func parseDependencies(orb *types.VersionedOrb) (map[string]string, error) {
+	dependencies := make(map[string]string)
 
-	if !ok {
-		dependents = make(map[string]string)
-		dependentsMap[orbRef] = dependents
+	importingOrbs := &orbImportingOrb{}
+
+	if err := yaml.Unmarshal([]byte(orb.Source), importingOrbs); err != nil {
+		return nil, err
 	}
 
-	return dependents
+	if importingOrbs != nil {
+		for procQueue := []map[string]interface{}{importingOrbs.Orbs}; len(procQueue) > 0; procQueue = procQueue[1:] {
+			for _, prop := range procQueue[0] {
+				switch value := prop.(type) {
+				case string:
+					dependencies[value] = value
+				case map[string]interface{}:
+					if value["orbs"] != nil {
+						if nestedOrbs, ok := value["orbs"].(map[string]interface{}); ok {
+							procQueue = append(procQueue, nestedOrbs)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return dependencies, nil
 }
 
-func initMaps(orbs []*types.VersionedOrb) []string {
+// resolver holds state of a run of Kahn's algorithm
+// An orb becomes ready once all of its dependencies are satisfied, where a floating reference like my-orb@1 is satisfied by any version matching it
+type resolver struct {
+	orbRefMap       map[string]*types.VersionedOrb
+	dependenciesMap map[string]map[string]string
+	dependentsMap   map[string][]string
+
+	// nUnsatisfied counts unsatisfied dependencies of each orb
+	nUnsatisfied map[string]int
+	satisfied    map[string]bool
+
+	// Orbs ignored by initMaps, for the caller to report
+	duplicated  []string
+	parseErrors map[string]error
+}
+
+func newResolver() *resolver {
+	return &resolver{
+		orbRefMap:       make(map[string]*types.VersionedOrb),
+		dependenciesMap: make(map[string]map[string]string),
+		dependentsMap:   make(map[string][]string),
+		nUnsatisfied:    make(map[string]int),
+		satisfied:       make(map[string]bool),
+		duplicated:      []string{},
+		parseErrors:     make(map[string]error),
+	}
+}
+
+func (r *resolver) initMaps(ctx context.Context, orbs []*types.VersionedOrb) ([]string, error) {
 	illegible := []string{}
 
 	for _, orb := range orbs {
-		logger.Printf("initializing %q", orb.Ref)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 
-		orbRefMap[orb.Ref] = orb
+		if _, duplicated := r.orbRefMap[orb.Ref]; duplicated {
+			r.duplicated = append(r.duplicated, orb.Ref)
+			continue
+		}
 
-		dependencies := make(map[string]string)
+		logger.Debugf("initializing %q", orb.Ref)
 
-		importingOrbs := &orbImportingOrb{}
+		r.orbRefMap[orb.Ref] = orb
 
-		if err := yaml.Unmarshal([]byte(orb.Source), importingOrbs); err != nil {
-			logger.Printf("ignoring orb %q because of YAML parser error: %v", orb.Ref, err.Error())
+		dependencies, err := parseDependencies(orb)
+		if err != nil {
+			r.parseErrors[orb.Ref] = err
 			illegible = append(illegible, orb.Ref)
 		} else {
-			if importingOrbs != nil {
-				for procQueue := []map[string]interface{}{importingOrbs.Orbs}; len(procQueue) > 0; procQueue = procQueue[1:] {
-					for _, prop := range procQueue[0] {
-						switch value := prop.(type) {
-						case string:
-							siblingDependents := getDependents(value)
-							siblingDependents[orb.Ref] = orb.Ref
-
-							dependencies[value] = value
-						case map[string]interface{}:
-							if value["orbs"] != nil {
-								if nestedOrbs, ok := value["orbs"].(map[string]interface{}); ok {
-									procQueue = append(procQueue, nestedOrbs)
-								}
-							}
-						}
-					}
-				}
+			for dependency := range dependencies {
+				r.dependentsMap[dependency] = append(r.dependentsMap[dependency], orb.Ref)
 			}
 
-			dependenciesMap[orb.Ref] = dependencies
+			r.dependenciesMap[orb.Ref] = dependencies
+			r.nUnsatisfied[orb.Ref] = len(dependencies)
 		}
 	}
 
-	return illegible
+	return illegible, nil
 }
 
-func listOrbsWithoutDependencies() []string {
-	ret := []string{}
+// Mark references satisfiable by the orb as satisfied, and return dependents which got ready by that
+func (r *resolver) satisfy(orbRef string) []string {
+	ready := []string{}
 
-	for orbRef, dependencies := range dependenciesMap {
-		if len(dependencies) == 0 {
-			ret = append(ret, orbRef)
+	for _, satisfiableRef := range satisfiableRefs(orbRef) {
+		if r.satisfied[satisfiableRef] {
+			continue
+		}
+		r.satisfied[satisfiableRef] = true
+
+		for _, dependent := range r.dependentsMap[satisfiableRef] {
+			r.nUnsatisfied[dependent] -= 1
+
+			if r.nUnsatisfied[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
 		}
 	}
 
-	return ret
+	return ready
 }
 
-func doDeleteReferencesForOrb(orbRef string) {
-	delete(dependenciesMap, orbRef)
+func (r *resolver) reduceUnresolved() map[string][]string {
+	ret := make(map[string][]string)
+
+	for orbRef, nUnsatisfied := range r.nUnsatisfied {
+		if nUnsatisfied <= 0 {
+			continue
+		}
 
-	if dependents, ok := dependentsMap[orbRef]; ok {
-		for _, dependent := range dependents {
-			delete(dependenciesMap[dependent], orbRef)
+		dependencies := []string{}
+		for dependency := range r.dependenciesMap[orbRef] {
+			if !r.satisfied[dependency] {
+				dependencies = append(dependencies, dependency)
+			}
 		}
+
+		ret[orbRef] = dependencies
 	}
+
+	return ret
 }
 
-func trimMostInsignificantSemver(orbRef string) string {
-	return regexp.MustCompile(`\.?\d+$`).ReplaceAllString(orbRef, "")
+// Run Kahn's algorithm level by level over orbs given to initMaps, and return references of resolved orbs in levels
+// Every orb in a level depends only on orbs in preceding levels, or on availableRefs
+func (r *resolver) run(ctx context.Context, orbs []*types.VersionedOrb, availableRefs []string) ([][]string, error) {
+	levels := [][]string{}
+
+	// Orbs available outside can make orbs ready, but they are not in the resolved order on their own
+	for _, orbRef := range availableRefs {
+		r.satisfy(orbRef)
+	}
+
+	level := []string{}
+	for _, orb := range orbs {
+		if nUnsatisfied, ok := r.nUnsatisfied[orb.Ref]; ok && nUnsatisfied == 0 && r.orbRefMap[orb.Ref] == orb {
+			level = append(level, orb.Ref)
+		}
+	}
+
+	for len(level) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		levels = append(levels, level)
+
+		nextLevel := []string{}
+		for _, orbRef := range level {
+			nextLevel = append(nextLevel, r.satisfy(orbRef)...)
+		}
+
+		level = nextLevel
+	}
+
+	return levels, nil
 }
 
-func deleteReferencesForOrb(orbRef string) {
-	doDeleteReferencesForOrb(orbRef)
+// Resolve dependencies between orbs and return them in the order to import, along with illegible and unresolvable ones
+// Dependencies satisfiable by availableRefs, e.g., orbs already on the destination, are treated as satisfied
+// Nothing is returned but the error if the context is done in the middle
+func Resolve(ctx context.Context, orbs []*types.VersionedOrb, availableRefs []string) ([]*types.VersionedOrb, []string, map[string][]string, error) {
+	levels, illegible, unresolved, err := ResolveLevels(ctx, orbs, availableRefs)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
-	// Gimmick: Trim insignificant semver portions to pick up dependents designating dependencies non-specifically
-	// e.g., my-orb@x.y.z can be my-orb@x.y or my-orb@x
-	for partialOrbRef := trimMostInsignificantSemver(orbRef); regexp.MustCompile(`\d+$`).MatchString(partialOrbRef); partialOrbRef = trimMostInsignificantSemver(partialOrbRef) {
-		doDeleteReferencesForOrb(partialOrbRef)
+	resolvedOrder := []*types.VersionedOrb{}
+	for _, level := range levels {
+		resolvedOrder = append(resolvedOrder, level...)
 	}
 
-	// Gimmick: Deal with @volatile
-	// e.g., my-orb@x.y.z can be my-orb@volatile
-	doDeleteReferencesForOrb(regexp.MustCompile(`@[^@]*$`).ReplaceAllString(orbRef, "@volatile"))
+	return resolvedOrder, illegible, unresolved, nil
 }
 
-func reduceDependenciesMap() map[string][]string {
-	ret := make(map[string][]string)
+// Resolve dependencies like Resolve, but return resolved orbs in dependency levels
+// Every orb in a level depends only on orbs in preceding levels or on availableRefs, so orbs in the same level can be imported at once
+func ResolveLevels(ctx context.Context, orbs []*types.VersionedOrb, availableRefs []string) ([][]*types.VersionedOrb, []string, map[string][]string, error) {
+	r := newResolver()
+	resolvedLevels := [][]*types.VersionedOrb{}
+	nResolved := 0
 
-	for orbRef, dependenciesMapEntry := range dependenciesMap {
-		dependencies := []string{}
+	defer metrics.PhaseDuration.SetSince(time.Now(), "resolve")
+	defer events.StartPhase("resolve")()
+
+	illegible, err := r.initMaps(ctx, orbs)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	for _, orbRef := range r.duplicated {
+		logger.Warnf("ignoring duplicated orb %q", orbRef)
+	}
+	for _, orbRef := range illegible {
+		logger.Warnf("ignoring orb %q because of YAML parser error: %v", orbRef, r.parseErrors[orbRef])
+		events.Emit(&events.Event{Type: events.OrbIllegible, Ref: orbRef, Phase: "resolve", Error: r.parseErrors[orbRef].Error()})
+	}
 
-		for _, dependingOrb := range dependenciesMapEntry {
-			dependencies = append(dependencies, dependingOrb)
+	levels, err := r.run(ctx, orbs, availableRefs)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	for _, level := range levels {
+		resolvedLevel := []*types.VersionedOrb{}
+		for _, orbRef := range level {
+			resolvedLevel = append(resolvedLevel, r.orbRefMap[orbRef])
+			events.Emit(&events.Event{Type: events.OrbResolved, Ref: orbRef})
 		}
 
-		ret[orbRef] = dependencies
+		resolvedLevels = append(resolvedLevels, resolvedLevel)
+		nResolved += len(level)
+
+		logger.Infof("resolver running; %d newly resolved, %d resolved in total, %d remaining\n", len(level), nResolved, len(r.dependenciesMap)-nResolved)
+	}
+
+	unresolved := r.reduceUnresolved()
+
+	logger.Infof("resolver done; %d resolved in %d level(s), %d unresolvable\n", nResolved, len(resolvedLevels), len(unresolved))
+
+	metricOrbsResolved.Add(float64(nResolved))
+	metricOrbsUnresolved.Add(float64(len(unresolved)))
+	metrics.OrbsIllegible.Add(float64(len(illegible)), "resolve")
+
+	return resolvedLevels, illegible, unresolved, nil
+}
+
+// Map each orb to the index of its dependency level
+func MapLevels(levels [][]*types.VersionedOrb) map[string]int {
+	ret := make(map[string]int)
+
+	for idx, level := range levels {
+		for _, orb := range level {
+			ret[orb.Ref] = idx
+		}
 	}
 
 	return ret
 }
 
-func Resolve(orbs []*types.VersionedOrb) ([]*types.VersionedOrb, []string, map[string][]string, error) {
-	orbRefMap = make(map[string]*types.VersionedOrb)
-	resolvedOrder = []*types.VersionedOrb{}
-	dependenciesMap = make(map[string]map[string]string)
-	dependentsMap = make(map[string]map[string]string)
+// Group orbs in the resolved order into dependency levels, for lists of orbs whose levels given by ResolveLevels are unknown
+// Every orb in a level depends only on orbs in preceding levels, or on orbs not in the given list, so orbs in the same level can be imported at once
+func GroupIntoLevels(orderedOrbs []*types.VersionedOrb) [][]*types.VersionedOrb {
+	ret := [][]*types.VersionedOrb{}
 
-	illegible := initMaps(orbs)
+	// The lowest level of orbs satisfying each reference
+	refLevels := make(map[string]int)
 
-	for {
-		orbsWithoutDependencies := listOrbsWithoutDependencies()
-		nProcessing := len(orbsWithoutDependencies)
+	for _, orb := range orderedOrbs {
+		level := 0
 
-		if nProcessing == 0 {
-			break
+		// Illegible orbs have no known dependencies; the importer will find out the problem for them
+		dependencies, _ := parseDependencies(orb)
+		for dependency := range dependencies {
+			if dependencyLevel, ok := refLevels[dependency]; ok && dependencyLevel+1 > level {
+				level = dependencyLevel + 1
+			}
 		}
 
-		for _, orbRef := range orbsWithoutDependencies {
-			resolvedOrder = append(resolvedOrder, orbRefMap[orbRef])
-			deleteReferencesForOrb(orbRef)
+		for _, satisfiableRef := range satisfiableRefs(orb.Ref) {
+			if currentLevel, ok := refLevels[satisfiableRef]; !ok || level < currentLevel {
+				refLevels[satisfiableRef] = level
+			}
 		}
 
-		logger.Printf("resolver running; %d newly resolved, %d resolved in total, %d remaining\n", nProcessing, len(resolvedOrder), len(dependenciesMap))
+		for len(ret) <= level {
+			ret = append(ret, []*types.VersionedOrb{})
+		}
+		ret[level] = append(ret[level], orb)
 	}
 
-	logger.Printf("resolver done; %d resolved, %d unresolvable\n", len(resolvedOrder), len(dependenciesMap))
+	return ret
+}
+
+// Map each of the given orbs to its dependencies, each of which is mapped to orbs in the given list satisfying it
+// Dependencies without any satisfying orb in the list are omitted, as they are supposed to be available elsewhere
+func MapDependencySatisfiers(orbs []*types.VersionedOrb) map[string]map[string][]string {
+	ret := make(map[string]map[string][]string)
+
+	orbRefs := []string{}
+	for _, orb := range orbs {
+		orbRefs = append(orbRefs, orb.Ref)
+	}
+	satisfierIndex := buildSatisfierIndex(orbRefs)
+
+	for _, orb := range orbs {
+		satisfiers := make(map[string][]string)
+
+		dependencies, _ := parseDependencies(orb)
+		for dependency := range dependencies {
+			if satisfyingRefs, ok := satisfierIndex[dependency]; ok {
+				satisfiers[dependency] = satisfyingRefs
+			}
+		}
+
+		ret[orb.Ref] = satisfiers
+	}
+
+	return ret
+}
+
+// List references of orbs imported by the given orb, including those imported by inline orbs
+func ListDependencies(orb *types.VersionedOrb) ([]string, error) {
+	dependencies, err := parseDependencies(orb)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []string{}
+	for dependency := range dependencies {
+		ret = append(ret, dependency)
+	}
+	sort.Strings(ret)
 
-	return resolvedOrder, illegible, reduceDependenciesMap(), nil
+	return ret, nil
 }
@@ -0,0 +1,294 @@
+package depresolver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/circle-makotom/orbs-sync/logging"
+	"github.com/circle-makotom/orbs-sync/types"
+)
+
+// Generate a synthetic set of orbs resembling the public registry
+// Each version of each family depends on a few versions of families with smaller indices, designated in various ways
+func generateSyntheticOrbs(nFamilies, nVersions int) []*types.VersionedOrb {
+	ret := []*types.VersionedOrb{}
+	rng := rand.New(rand.NewSource(42))
+
+	for family := 0; family < nFamilies; family += 1 {
+		name := fmt.Sprintf("ns%d/orb%d", family%50, family)
+
+		for version := 0; version < nVersions; version += 1 {
+			orbVersion := fmt.Sprintf("%d.%d.%d", version/20, version/5%4, version%5)
+			orbs := []string{}
+
+			for dependency := 0; family > 0 && dependency < rng.Intn(4); dependency += 1 {
+				dependencyFamily := rng.Intn(family)
+				dependencyVersion := rng.Intn(nVersions)
+				dependencyName := fmt.Sprintf("ns%d/orb%d", dependencyFamily%50, dependencyFamily)
+
+				var dependencyRef string
+				switch rng.Intn(4) {
+				case 0:
+					dependencyRef = fmt.Sprintf("%s@%d.%d.%d", dependencyName, dependencyVersion/20, dependencyVersion/5%4, dependencyVersion%5)
+				case 1:
+					dependencyRef = fmt.Sprintf("%s@%d.%d", dependencyName, dependencyVersion/20, dependencyVersion/5%4)
+				case 2:
+					dependencyRef = fmt.Sprintf("%s@%d", dependencyName, dependencyVersion/20)
+				default:
+					dependencyRef = fmt.Sprintf("%s@volatile", dependencyName)
+				}
+
+				orbs = append(orbs, fmt.Sprintf("  dep%d: %s", dependency, dependencyRef))
+			}
+
+			source := "version: 2.1\n"
+			if len(orbs) > 0 {
+				source += "orbs:\n" + strings.Join(orbs, "\n") + "\n"
+			}
+
+			ret = append(ret, &types.VersionedOrb{
+				Ref:     fmt.Sprintf("%s@%s", name, orbVersion),
+				Name:    name,
+				Version: orbVersion,
+				Source:  source,
+			})
+		}
+	}
+
+	return ret
+}
+
+// Create an orb importing the given references
+func newTestOrb(orbRef string, dependencies ...string) *types.VersionedOrb {
+	name, version := splitOrbRef(orbRef)
+
+	source := "version: 2.1\n"
+	if len(dependencies) > 0 {
+		source += "orbs:\n"
+		for idx, dependency := range dependencies {
+			source += fmt.Sprintf("  dep%d: %s\n", idx, dependency)
+		}
+	}
+
+	return &types.VersionedOrb{Ref: orbRef, Name: name, Version: version, Source: source}
+}
+
+// Create an orb whose source causes YAML parser errors
+func newIllegibleTestOrb(orbRef string) *types.VersionedOrb {
+	orb := newTestOrb(orbRef)
+	orb.Source = "orbs: [unterminated"
+
+	return orb
+}
+
+// Fail unless every dependency of each resolved orb is satisfied by an orb resolved earlier or by availableRefs
+func assertDependenciesFirst(t *testing.T, resolved []*types.VersionedOrb, availableRefs []string) {
+	t.Helper()
+
+	satisfied := make(map[string]bool)
+	for _, orbRef := range availableRefs {
+		for _, satisfiableRef := range satisfiableRefs(orbRef) {
+			satisfied[satisfiableRef] = true
+		}
+	}
+
+	for _, orb := range resolved {
+		dependencies, err := parseDependencies(orb)
+		if err != nil {
+			t.Errorf("illegible orb %q is resolved", orb.Ref)
+			continue
+		}
+
+		for dependency := range dependencies {
+			if !satisfied[dependency] {
+				t.Errorf("%q is resolved before its dependency %q", orb.Ref, dependency)
+			}
+		}
+
+		for _, satisfiableRef := range satisfiableRefs(orb.Ref) {
+			satisfied[satisfiableRef] = true
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	cases := []struct {
+		name          string
+		orbs          []*types.VersionedOrb
+		availableRefs []string
+
+		resolved   []string
+		illegible  []string
+		unresolved map[string][]string
+	}{
+		{
+			name: "exact and floating references",
+			orbs: []*types.VersionedOrb{
+				newTestOrb("ns/app@1.0.0", "ns/lib@1", "ns/util@1.2", "ns/base@1.0.0"),
+				newTestOrb("ns/lib@1.3.0", "ns/base@volatile"),
+				newTestOrb("ns/util@1.2.7"),
+				newTestOrb("ns/base@1.0.0"),
+			},
+			resolved:   []string{"ns/util@1.2.7", "ns/base@1.0.0", "ns/lib@1.3.0", "ns/app@1.0.0"},
+			illegible:  []string{},
+			unresolved: map[string][]string{},
+		},
+		{
+			name: "floating references not matching other majors or minors",
+			orbs: []*types.VersionedOrb{
+				newTestOrb("ns/app@1.0.0", "ns/lib@1"),
+				newTestOrb("ns/tool@1.0.0", "ns/lib@2.1"),
+				newTestOrb("ns/lib@2.0.0"),
+			},
+			resolved:   []string{"ns/lib@2.0.0"},
+			illegible:  []string{},
+			unresolved: map[string][]string{"ns/app@1.0.0": {"ns/lib@1"}, "ns/tool@1.0.0": {"ns/lib@2.1"}},
+		},
+		{
+			name: "duplicated orbs",
+			orbs: []*types.VersionedOrb{
+				newTestOrb("ns/lib@1.0.0"),
+				newTestOrb("ns/app@1.0.0", "ns/lib@1.0.0"),
+				newTestOrb("ns/lib@1.0.0"),
+			},
+			resolved:   []string{"ns/lib@1.0.0", "ns/app@1.0.0"},
+			illegible:  []string{},
+			unresolved: map[string][]string{},
+		},
+		{
+			name: "orbs available outside",
+			orbs: []*types.VersionedOrb{
+				newTestOrb("ns/app@1.0.0", "private/orb@1", "ns/lib@1.0.0"),
+				newTestOrb("ns/lib@1.0.0", "hidden/orb@volatile"),
+			},
+			availableRefs: []string{"private/orb@1.4.2", "hidden/orb@0.0.1"},
+			resolved:      []string{"ns/lib@1.0.0", "ns/app@1.0.0"},
+			illegible:     []string{},
+			unresolved:    map[string][]string{},
+		},
+		{
+			name: "illegible orbs and their dependents",
+			orbs: []*types.VersionedOrb{
+				newIllegibleTestOrb("ns/bad@1.0.0"),
+				newTestOrb("ns/app@1.0.0", "ns/bad@1"),
+				newTestOrb("ns/user@1.0.0", "ns/app@1.0.0"),
+			},
+			resolved:   []string{},
+			illegible:  []string{"ns/bad@1.0.0"},
+			unresolved: map[string][]string{"ns/app@1.0.0": {"ns/bad@1"}, "ns/user@1.0.0": {"ns/app@1.0.0"}},
+		},
+		{
+			name: "illegible versions replaced by other satisfying ones",
+			orbs: []*types.VersionedOrb{
+				newIllegibleTestOrb("ns/lib@1.1.0"),
+				newTestOrb("ns/lib@1.0.0"),
+				newTestOrb("ns/app@1.0.0", "ns/lib@1"),
+			},
+			resolved:   []string{"ns/lib@1.0.0", "ns/app@1.0.0"},
+			illegible:  []string{"ns/lib@1.1.0"},
+			unresolved: map[string][]string{},
+		},
+		{
+			name: "cycles",
+			orbs: []*types.VersionedOrb{
+				newTestOrb("ns/a@1.0.0", "ns/b@1"),
+				newTestOrb("ns/b@1.0.0", "ns/a@1.0.0"),
+				newTestOrb("ns/self@1.0.0", "ns/self@volatile"),
+				newTestOrb("ns/c@1.0.0", "ns/a@1.0.0", "ns/d@1.0.0"),
+				newTestOrb("ns/d@1.0.0"),
+			},
+			resolved:  []string{"ns/d@1.0.0"},
+			illegible: []string{},
+			unresolved: map[string][]string{
+				"ns/a@1.0.0":    {"ns/b@1"},
+				"ns/b@1.0.0":    {"ns/a@1.0.0"},
+				"ns/self@1.0.0": {"ns/self@volatile"},
+				"ns/c@1.0.0":    {"ns/a@1.0.0"},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		resolved, illegible, unresolved, err := Resolve(context.Background(), c.orbs, c.availableRefs)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+
+		resolvedRefs := []string{}
+		for _, orb := range resolved {
+			resolvedRefs = append(resolvedRefs, orb.Ref)
+		}
+
+		if !reflect.DeepEqual(resolvedRefs, c.resolved) {
+			t.Errorf("%s: resolved = %q; expected %q", c.name, resolvedRefs, c.resolved)
+		}
+		if !reflect.DeepEqual(illegible, c.illegible) {
+			t.Errorf("%s: illegible = %q; expected %q", c.name, illegible, c.illegible)
+		}
+		if !reflect.DeepEqual(unresolved, c.unresolved) {
+			t.Errorf("%s: unresolved = %q; expected %q", c.name, unresolved, c.unresolved)
+		}
+
+		assertDependenciesFirst(t, resolved, c.availableRefs)
+	}
+}
+
+func TestResolveSynthetic(t *testing.T) {
+	orbs := generateSyntheticOrbs(50, 20)
+
+	resolved, illegible, unresolved, err := Resolve(context.Background(), orbs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resolved)+len(illegible)+len(unresolved) != len(orbs) {
+		t.Errorf("%d resolved, %d illegible and %d unresolved out of %d", len(resolved), len(illegible), len(unresolved), len(orbs))
+	}
+
+	assertDependenciesFirst(t, resolved, nil)
+}
+
+func TestResolveCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, _, _, err := Resolve(ctx, generateSyntheticOrbs(5, 5), nil); err != context.Canceled {
+		t.Errorf("err = %v; expected %v", err, context.Canceled)
+	}
+}
+
+func benchmarkResolve(b *testing.B, nFamilies, nVersions int) {
+	SetLogger(logging.NewWithWriter("dependency-resolver", ioutil.Discard, logging.FormatText, logging.LevelError))
+	orbs := generateSyntheticOrbs(nFamilies, nVersions)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for iter := 0; iter < b.N; iter += 1 {
+		resolved, _, unresolved, err := Resolve(context.Background(), orbs, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(resolved)+len(unresolved) != len(orbs) {
+			b.Fatalf("%d resolved and %d unresolved out of %d", len(resolved), len(unresolved), len(orbs))
+		}
+	}
+}
+
+func BenchmarkResolve1k(b *testing.B) {
+	benchmarkResolve(b, 50, 20)
+}
+
+func BenchmarkResolve10k(b *testing.B) {
+	benchmarkResolve(b, 250, 40)
+}
+
+func BenchmarkResolve40k(b *testing.B) {
+	benchmarkResolve(b, 500, 80)
+}
@@ -0,0 +1,288 @@
+package depresolver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/circle-makotom/orbs-sync/types"
+)
+
+type GraphNode struct {
+	Ref     string `json:"ref"`
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+
+	// Missing is truthy for dependencies which no known orb can satisfy
+	Missing bool `json:"missing,omitempty"`
+}
+
+type GraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+
+	// Via is the reference as it is written in the source of the dependent orb, e.g., my-orb@1
+	Via string `json:"via"`
+}
+
+// Graph is a dependency graph of orbs; an edge goes from a dependent to its dependency
+type Graph struct {
+	Nodes []*GraphNode `json:"nodes"`
+	Edges []*GraphEdge `json:"edges"`
+}
+
+// Build the dependency graph of the given orbs
+// Floating references like my-orb@1 or my-orb@volatile get an edge to every version satisfying them in the given orbs, as any of them makes the dependent resolvable
+// Return the graph and the list of orbs caused YAML parser errors
+func BuildGraph(orbs []*types.VersionedOrb) (*Graph, []string) {
+	illegible := []string{}
+	nodes := make(map[string]*GraphNode)
+	dependenciesOf := make(map[string]map[string]string)
+	orbRefs := []string{}
+
+	for _, orb := range orbs {
+		dependencies, err := parseDependencies(orb)
+		if err != nil {
+			illegible = append(illegible, orb.Ref)
+			continue
+		}
+
+		nodes[orb.Ref] = &GraphNode{Ref: orb.Ref, Name: orb.Name, Version: orb.Version}
+		dependenciesOf[orb.Ref] = dependencies
+		orbRefs = append(orbRefs, orb.Ref)
+	}
+
+	satisfierIndex := buildSatisfierIndex(orbRefs)
+	edges := []*GraphEdge{}
+
+	for dependent, dependencies := range dependenciesOf {
+		for dependency := range dependencies {
+			satisfiers, ok := satisfierIndex[dependency]
+			if !ok {
+				if _, exists := nodes[dependency]; !exists {
+					name, version := splitOrbRef(dependency)
+					nodes[dependency] = &GraphNode{Ref: dependency, Name: name, Version: version, Missing: true}
+				}
+
+				satisfiers = []string{dependency}
+			}
+
+			for _, target := range satisfiers {
+				edges = append(edges, &GraphEdge{From: dependent, To: target, Via: dependency})
+			}
+		}
+	}
+
+	return newGraph(nodes, edges), illegible
+}
+
+func newGraph(nodes map[string]*GraphNode, edges []*GraphEdge) *Graph {
+	ret := &Graph{Nodes: []*GraphNode{}, Edges: edges}
+
+	for _, node := range nodes {
+		ret.Nodes = append(ret.Nodes, node)
+	}
+
+	sort.Slice(ret.Nodes, func(i, j int) bool {
+		return ret.Nodes[i].Ref < ret.Nodes[j].Ref
+	})
+	sort.Slice(ret.Edges, func(i, j int) bool {
+		if ret.Edges[i].From != ret.Edges[j].From {
+			return ret.Edges[i].From < ret.Edges[j].From
+		}
+		if ret.Edges[i].To != ret.Edges[j].To {
+			return ret.Edges[i].To < ret.Edges[j].To
+		}
+		return ret.Edges[i].Via < ret.Edges[j].Via
+	})
+
+	return ret
+}
+
+func (graph *Graph) node(ref string) *GraphNode {
+	idx := sort.Search(len(graph.Nodes), func(i int) bool {
+		return graph.Nodes[i].Ref >= ref
+	})
+
+	if idx < len(graph.Nodes) && graph.Nodes[idx].Ref == ref {
+		return graph.Nodes[idx]
+	}
+
+	return nil
+}
+
+// Find the node for the given reference; floating references are expanded to the highest version in the graph
+// A reference without any version is treated as @volatile
+func (graph *Graph) Lookup(orbRef string) (*GraphNode, bool) {
+	if !strings.Contains(orbRef, "@") {
+		orbRef += "@volatile"
+	}
+
+	if node := graph.node(orbRef); node != nil {
+		return node, true
+	}
+
+	orbRefs := []string{}
+	for _, node := range graph.Nodes {
+		if !node.Missing {
+			orbRefs = append(orbRefs, node.Ref)
+		}
+	}
+
+	if ref, ok := pickHighestSatisfier(buildSatisfierIndex(orbRefs), orbRef); ok {
+		return graph.node(ref), true
+	}
+
+	return nil, false
+}
+
+// Return the subgraph induced by nodes which the predicate holds for
+func (graph *Graph) Filter(predicate func(node *GraphNode) bool) *Graph {
+	nodes := make(map[string]*GraphNode)
+	edges := []*GraphEdge{}
+
+	for _, node := range graph.Nodes {
+		if predicate(node) {
+			nodes[node.Ref] = node
+		}
+	}
+
+	for _, edge := range graph.Edges {
+		if nodes[edge.From] != nil && nodes[edge.To] != nil {
+			edges = append(edges, edge)
+		}
+	}
+
+	return newGraph(nodes, edges)
+}
+
+// Return the subgraph of orbs in the given namespace
+func (graph *Graph) FilterNamespace(namespace string) *Graph {
+	return graph.Filter(func(node *GraphNode) bool {
+		return strings.HasPrefix(node.Name, namespace+"/")
+	})
+}
+
+// Return the subgraph of versions of the given orb family, e.g., circleci/node
+func (graph *Graph) FilterFamily(orbName string) *Graph {
+	return graph.Filter(func(node *GraphNode) bool {
+		return node.Name == orbName
+	})
+}
+
+// Return the subgraph of orbs reachable from the root by following dependencies at most depth times
+// A negative depth means no limit
+func (graph *Graph) Reachable(rootRef string, depth int) (*Graph, error) {
+	root, ok := graph.Lookup(rootRef)
+	if !ok {
+		return nil, fmt.Errorf("orb %q is not in the graph", rootRef)
+	}
+
+	outgoing := make(map[string][]string)
+	for _, edge := range graph.Edges {
+		outgoing[edge.From] = append(outgoing[edge.From], edge.To)
+	}
+
+	distances := map[string]int{root.Ref: 0}
+	for procQueue := []string{root.Ref}; len(procQueue) > 0; procQueue = procQueue[1:] {
+		current := procQueue[0]
+
+		if depth >= 0 && distances[current] >= depth {
+			continue
+		}
+
+		for _, next := range outgoing[current] {
+			if _, visited := distances[next]; !visited {
+				distances[next] = distances[current] + 1
+				procQueue = append(procQueue, next)
+			}
+		}
+	}
+
+	return graph.Filter(func(node *GraphNode) bool {
+		_, reached := distances[node.Ref]
+		return reached
+	}), nil
+}
+
+// Collapse versions into orb families, so that each node represents an orb like circleci/node
+func (graph *Graph) CollapseFamilies() *Graph {
+	nodes := make(map[string]*GraphNode)
+	familyOf := make(map[string]string)
+
+	for _, node := range graph.Nodes {
+		familyOf[node.Ref] = node.Name
+
+		if family, ok := nodes[node.Name]; ok {
+			family.Missing = family.Missing && node.Missing
+		} else {
+			nodes[node.Name] = &GraphNode{Ref: node.Name, Name: node.Name, Missing: node.Missing}
+		}
+	}
+
+	edges := []*GraphEdge{}
+	edgeExists := make(map[string]bool)
+
+	for _, edge := range graph.Edges {
+		from, to := familyOf[edge.From], familyOf[edge.To]
+		key := from + " " + to
+
+		if from != to && !edgeExists[key] {
+			edgeExists[key] = true
+			edges = append(edges, &GraphEdge{From: from, To: to, Via: to})
+		}
+	}
+
+	return newGraph(nodes, edges)
+}
+
+// Render the graph in the DOT language of Graphviz
+func (graph *Graph) DOT() string {
+	lines := []string{"digraph orbs {", "\trankdir=LR;"}
+
+	for _, node := range graph.Nodes {
+		if node.Missing {
+			lines = append(lines, fmt.Sprintf("\t%q [style=dashed, color=red];", node.Ref))
+		} else {
+			lines = append(lines, fmt.Sprintf("\t%q;", node.Ref))
+		}
+	}
+
+	for _, edge := range graph.Edges {
+		if edge.Via != edge.To {
+			lines = append(lines, fmt.Sprintf("\t%q -> %q [label=%q];", edge.From, edge.To, edge.Via))
+		} else {
+			lines = append(lines, fmt.Sprintf("\t%q -> %q;", edge.From, edge.To))
+		}
+	}
+
+	return strings.Join(append(lines, "}"), "\n") + "\n"
+}
+
+// Render the graph as a Mermaid flowchart
+func (graph *Graph) Mermaid() string {
+	lines := []string{"graph LR"}
+	ids := make(map[string]string)
+
+	for idx, node := range graph.Nodes {
+		ids[node.Ref] = fmt.Sprintf("n%d", idx)
+
+		if node.Missing {
+			lines = append(lines, fmt.Sprintf("\t%s[\"%s\"]:::missing", ids[node.Ref], node.Ref))
+		} else {
+			lines = append(lines, fmt.Sprintf("\t%s[\"%s\"]", ids[node.Ref], node.Ref))
+		}
+	}
+
+	for _, edge := range graph.Edges {
+		if edge.Via != edge.To {
+			lines = append(lines, fmt.Sprintf("\t%s -->|\"%s\"| %s", ids[edge.From], edge.Via, ids[edge.To]))
+		} else {
+			lines = append(lines, fmt.Sprintf("\t%s --> %s", ids[edge.From], ids[edge.To]))
+		}
+	}
+
+	lines = append(lines, "\tclassDef missing stroke:#f00,stroke-dasharray:5 5")
+
+	return strings.Join(lines, "\n") + "\n"
+}
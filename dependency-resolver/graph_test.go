@@ -0,0 +1,46 @@
+package depresolver
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/circle-makotom/orbs-sync/types"
+)
+
+func TestBuildGraph(t *testing.T) {
+	orbs := []*types.VersionedOrb{
+		newTestOrb("ns/app@1.0.0", "ns/lib@1", "ns/hidden@1.0.0"),
+		newTestOrb("ns/lib@1.0.0"),
+		newTestOrb("ns/lib@1.1.0"),
+		newTestOrb("ns/lib@2.0.0"),
+		newIllegibleTestOrb("ns/lib@1.2.0"),
+	}
+
+	graph, illegible := BuildGraph(orbs)
+
+	if !reflect.DeepEqual(illegible, []string{"ns/lib@1.2.0"}) {
+		t.Errorf("illegible = %q; expected only ns/lib@1.2.0", illegible)
+	}
+
+	edges := []GraphEdge{}
+	for _, edge := range graph.Edges {
+		edges = append(edges, *edge)
+	}
+
+	// Every legible version satisfying ns/lib@1 is a dependency, and unknown ones are missing nodes
+	expectedEdges := []GraphEdge{
+		{From: "ns/app@1.0.0", To: "ns/hidden@1.0.0", Via: "ns/hidden@1.0.0"},
+		{From: "ns/app@1.0.0", To: "ns/lib@1.0.0", Via: "ns/lib@1"},
+		{From: "ns/app@1.0.0", To: "ns/lib@1.1.0", Via: "ns/lib@1"},
+	}
+	if !reflect.DeepEqual(edges, expectedEdges) {
+		t.Errorf("edges = %+v; expected %+v", edges, expectedEdges)
+	}
+
+	if node, ok := graph.Lookup("ns/hidden@1.0.0"); !ok || !node.Missing {
+		t.Errorf("ns/hidden@1.0.0 should be a missing node")
+	}
+	if node, ok := graph.Lookup("ns/lib"); !ok || node.Ref != "ns/lib@2.0.0" {
+		t.Errorf("ns/lib should be looked up as the highest version; got %+v", node)
+	}
+}
@@ -0,0 +1,203 @@
+package depresolver
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/circle-makotom/orbs-sync/types"
+)
+
+type PriorityMode string
+
+const (
+	// Keep the resolved order as-is
+	PriorityResolved PriorityMode = "resolved"
+
+	// Latest versions of each orb family first
+	PriorityNewest PriorityMode = "newest"
+
+	// Latest versions of orb families with more dependents and more popularity first
+	PriorityWeighted PriorityMode = "weighted"
+)
+
+func ParsePriorityMode(mode string) (PriorityMode, error) {
+	switch PriorityMode(mode) {
+	case PriorityResolved, PriorityNewest, PriorityWeighted:
+		return PriorityMode(mode), nil
+	}
+
+	return "", fmt.Errorf("unknown priority mode %q", mode)
+}
+
+type prioritizedOrb struct {
+	orb   *types.VersionedOrb
+	index int
+
+	// weight is the primary key in the descending order; index is the secondary key in the ascending order
+	weight float64
+}
+
+type priorityQueue []*prioritizedOrb
+
+func (pq priorityQueue) Len() int { return len(pq) }
+
+func (pq priorityQueue) Less(i, j int) bool {
+	if pq[i].weight != pq[j].weight {
+		return pq[i].weight > pq[j].weight
+	}
+	return pq[i].index < pq[j].index
+}
+
+func (pq priorityQueue) Swap(i, j int) { pq[i], pq[j] = pq[j], pq[i] }
+
+func (pq *priorityQueue) Push(x interface{}) { *pq = append(*pq, x.(*prioritizedOrb)) }
+
+func (pq *priorityQueue) Pop() interface{} {
+	old := *pq
+	item := old[len(old)-1]
+	*pq = old[:len(old)-1]
+	return item
+}
+
+// Rank versions in each orb family; the latest version is ranked 0
+func rankVersions(orbs []*types.VersionedOrb) map[string]int {
+	ret := make(map[string]int)
+
+	families := make(map[string][]*types.VersionedOrb)
+	for _, orb := range orbs {
+		families[orb.Name] = append(families[orb.Name], orb)
+	}
+
+	for _, family := range families {
+		sort.SliceStable(family, func(i, j int) bool {
+			return compareVersions(family[i].Version, family[j].Version) > 0
+		})
+
+		for rank, orb := range family {
+			ret[orb.Ref] = rank
+		}
+	}
+
+	return ret
+}
+
+// Weigh each orb by the given mode
+// Popularity maps orb names to the popularity statistics, e.g., the number of projects using them in the last 30 days
+func weighOrbs(orbs []*types.VersionedOrb, satisfiers map[string]map[string][]string, mode PriorityMode, popularity map[string]int) map[string]float64 {
+	ret := make(map[string]float64)
+	ranks := rankVersions(orbs)
+
+	orbRefMap := make(map[string]*types.VersionedOrb)
+	for _, orb := range orbs {
+		orbRefMap[orb.Ref] = orb
+	}
+
+	// Count orbs depending on any version of each family
+	familyDependents := make(map[string]map[string]bool)
+	for dependent, dependencies := range satisfiers {
+		for _, satisfyingRefs := range dependencies {
+			for _, satisfyingRef := range satisfyingRefs {
+				name := orbRefMap[satisfyingRef].Name
+				if familyDependents[name] == nil {
+					familyDependents[name] = make(map[string]bool)
+				}
+				familyDependents[name][dependent] = true
+			}
+		}
+	}
+
+	for _, orb := range orbs {
+		rank := float64(ranks[orb.Ref])
+
+		switch mode {
+		case PriorityNewest:
+			ret[orb.Ref] = -rank
+		case PriorityWeighted:
+			// Logarithms keep a few extremely popular families from outweighing the recency
+			ret[orb.Ref] = (1 + math.Log1p(float64(len(familyDependents[orb.Name]))) + math.Log1p(float64(popularity[orb.Name]))) / (1 + rank)
+		default:
+			ret[orb.Ref] = 0
+		}
+	}
+
+	return ret
+}
+
+// Reorder orbs in the resolved order by the given mode, keeping dependencies of each orb before the orb
+// A dependency is regarded as satisfied once any orb satisfying it is placed, just like the resolver does
+func Prioritize(orderedOrbs []*types.VersionedOrb, mode PriorityMode, popularity map[string]int) []*types.VersionedOrb {
+	if mode == PriorityResolved || mode == "" {
+		return orderedOrbs
+	}
+
+	logger.Infof("prioritizing %d orb(s) by %q", len(orderedOrbs), mode)
+
+	satisfiers := MapDependencySatisfiers(orderedOrbs)
+	weights := weighOrbs(orderedOrbs, satisfiers, mode, popularity)
+
+	// Map each orb to pairs of its dependents and their dependencies satisfied by it
+	type dependentPair struct {
+		dependent, dependency string
+	}
+	satisfiedBy := make(map[string][]dependentPair)
+	nUnsatisfied := make(map[string]int)
+	satisfied := make(map[string]map[string]bool)
+
+	for dependent, dependencies := range satisfiers {
+		nUnsatisfied[dependent] = len(dependencies)
+		satisfied[dependent] = make(map[string]bool)
+
+		for dependency, satisfyingRefs := range dependencies {
+			for _, satisfyingRef := range satisfyingRefs {
+				satisfiedBy[satisfyingRef] = append(satisfiedBy[satisfyingRef], dependentPair{dependent, dependency})
+			}
+		}
+	}
+
+	pq := &priorityQueue{}
+	entries := make(map[string]*prioritizedOrb)
+	for index, orb := range orderedOrbs {
+		entries[orb.Ref] = &prioritizedOrb{orb: orb, index: index, weight: weights[orb.Ref]}
+
+		if nUnsatisfied[orb.Ref] == 0 {
+			heap.Push(pq, entries[orb.Ref])
+		}
+	}
+
+	ret := []*types.VersionedOrb{}
+	placed := make(map[string]bool)
+
+	for pq.Len() > 0 {
+		entry := heap.Pop(pq).(*prioritizedOrb)
+		if placed[entry.orb.Ref] {
+			continue
+		}
+
+		ret = append(ret, entry.orb)
+		placed[entry.orb.Ref] = true
+
+		for _, pair := range satisfiedBy[entry.orb.Ref] {
+			if satisfied[pair.dependent][pair.dependency] {
+				continue
+			}
+
+			satisfied[pair.dependent][pair.dependency] = true
+			nUnsatisfied[pair.dependent] -= 1
+
+			if nUnsatisfied[pair.dependent] == 0 {
+				heap.Push(pq, entries[pair.dependent])
+			}
+		}
+	}
+
+	// Orbs never getting ready, e.g., because of cyclic dependencies, are left in the resolved order
+	for _, orb := range orderedOrbs {
+		if !placed[orb.Ref] {
+			ret = append(ret, orb)
+		}
+	}
+
+	return ret
+}
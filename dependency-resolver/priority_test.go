@@ -0,0 +1,117 @@
+package depresolver
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/circle-makotom/orbs-sync/types"
+)
+
+func refsOf(orbs []*types.VersionedOrb) []string {
+	ret := []string{}
+	for _, orb := range orbs {
+		ret = append(ret, orb.Ref)
+	}
+
+	return ret
+}
+
+func TestPrioritize(t *testing.T) {
+	cases := []struct {
+		name          string
+		orbs          []*types.VersionedOrb
+		mode          PriorityMode
+		popularity    map[string]int
+		availableRefs []string
+		expected      []string
+	}{
+		{
+			"resolved",
+			[]*types.VersionedOrb{newTestOrb("ns/a@1.0.0"), newTestOrb("ns/a@2.0.0")},
+			PriorityResolved, nil, nil,
+			[]string{"ns/a@1.0.0", "ns/a@2.0.0"},
+		},
+		{
+			"newest",
+			[]*types.VersionedOrb{newTestOrb("ns/a@1.0.0"), newTestOrb("ns/a@1.1.0"), newTestOrb("ns/a@2.0.0"), newTestOrb("ns/b@1.0.0", "ns/a@1"), newTestOrb("ns/b@1.1.0")},
+			PriorityNewest, nil, nil,
+			[]string{"ns/a@2.0.0", "ns/b@1.1.0", "ns/a@1.1.0", "ns/b@1.0.0", "ns/a@1.0.0"},
+		},
+		{
+			"newest waiting for dependencies",
+			[]*types.VersionedOrb{newTestOrb("ns/a@1.0.0"), newTestOrb("ns/b@1.0.0"), newTestOrb("ns/b@2.0.0", "ns/a@1.0.0"), newTestOrb("ns/a@2.0.0")},
+			PriorityNewest, nil, nil,
+			[]string{"ns/a@2.0.0", "ns/a@1.0.0", "ns/b@2.0.0", "ns/b@1.0.0"},
+		},
+		{
+			"weighted by dependents",
+			[]*types.VersionedOrb{newTestOrb("ns/p@1.0.0"), newTestOrb("ns/q@1.0.0"), newTestOrb("ns/r@1.0.0", "ns/q@1"), newTestOrb("ns/s@1.0.0", "ns/q@volatile")},
+			PriorityWeighted, nil, nil,
+			[]string{"ns/q@1.0.0", "ns/p@1.0.0", "ns/r@1.0.0", "ns/s@1.0.0"},
+		},
+		{
+			"weighted by popularity",
+			[]*types.VersionedOrb{newTestOrb("ns/y@1.0.0"), newTestOrb("ns/x@1.0.0"), newTestOrb("ns/z@1.0.0", "ns/y@1")},
+			PriorityWeighted, map[string]int{"ns/x": 1000}, nil,
+			[]string{"ns/x@1.0.0", "ns/y@1.0.0", "ns/z@1.0.0"},
+		},
+		{
+			"no satisfier in the list",
+			[]*types.VersionedOrb{newTestOrb("ns/m@1.0.0", "external/orb@1"), newTestOrb("ns/m@2.0.0", "external/orb@2.0.0")},
+			PriorityNewest, nil, []string{"external/orb@1.0.0", "external/orb@2.0.0"},
+			[]string{"ns/m@2.0.0", "ns/m@1.0.0"},
+		},
+	}
+
+	for _, c := range cases {
+		prioritized := Prioritize(c.orbs, c.mode, c.popularity)
+		if actual := refsOf(prioritized); !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("%s: Prioritize = %q; expected %q", c.name, actual, c.expected)
+		}
+
+		assertDependenciesFirst(t, prioritized, c.availableRefs)
+	}
+}
+
+// Orbs never getting ready are left in the resolved order after the others
+func TestPrioritizeCycle(t *testing.T) {
+	orbs := []*types.VersionedOrb{newTestOrb("ns/c1@1.0.0", "ns/c2@1.0.0"), newTestOrb("ns/c2@1.0.0", "ns/c1@1.0.0"), newTestOrb("ns/free@1.0.0")}
+
+	for _, mode := range []PriorityMode{PriorityNewest, PriorityWeighted} {
+		expected := []string{"ns/free@1.0.0", "ns/c1@1.0.0", "ns/c2@1.0.0"}
+		if actual := refsOf(Prioritize(orbs, mode, nil)); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("Prioritize by %q = %q; expected %q", mode, actual, expected)
+		}
+	}
+}
+
+func TestPrioritizeSynthetic(t *testing.T) {
+	resolved, _, _, err := Resolve(context.Background(), generateSyntheticOrbs(50, 20), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	popularity := map[string]int{"ns1/orb1": 500, "ns7/orb7": 20}
+
+	for _, mode := range []PriorityMode{PriorityNewest, PriorityWeighted} {
+		prioritized := Prioritize(resolved, mode, popularity)
+
+		if len(prioritized) != len(resolved) {
+			t.Errorf("Prioritize by %q returned %d orb(s); expected %d", mode, len(prioritized), len(resolved))
+		}
+		assertDependenciesFirst(t, prioritized, nil)
+	}
+}
+
+func TestParsePriorityMode(t *testing.T) {
+	for _, mode := range []string{"resolved", "newest", "weighted"} {
+		if actual, err := ParsePriorityMode(mode); err != nil || string(actual) != mode {
+			t.Errorf("ParsePriorityMode(%q) = (%q, %v)", mode, actual, err)
+		}
+	}
+
+	if _, err := ParsePriorityMode("popular"); err == nil {
+		t.Errorf("ParsePriorityMode(%q) succeeded; expected an error", "popular")
+	}
+}
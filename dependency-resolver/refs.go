@@ -0,0 +1,102 @@
+package depresolver
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Split an orb reference into the orb name and the version
+// e.g., my-ns/my-orb@1.2.3 becomes my-ns/my-orb and 1.2.3
+func splitOrbRef(orbRef string) (string, string) {
+	if idx := strings.Index(orbRef, "@"); idx >= 0 {
+		return orbRef[:idx], orbRef[idx+1:]
+	}
+
+	return orbRef, ""
+}
+
+// List references which can be satisfied by the given versioned orb, including the reference itself
+// e.g., my-orb@x.y.z satisfies my-orb@x.y.z, my-orb@x.y, my-orb@x and my-orb@volatile
+func satisfiableRefs(orbRef string) []string {
+	name, version := splitOrbRef(orbRef)
+	ret := []string{orbRef}
+
+	versionParts := strings.Split(version, ".")
+	for idx := len(versionParts) - 1; idx > 0; idx -= 1 {
+		if !isNumeric(versionParts[idx]) || !isNumeric(versionParts[idx-1]) {
+			break
+		}
+
+		ret = append(ret, name+"@"+strings.Join(versionParts[:idx], "."))
+	}
+
+	return append(ret, name+"@volatile")
+}
+
+func isNumeric(str string) bool {
+	_, err := strconv.Atoi(str)
+	return err == nil
+}
+
+// Compare two versions segment by segment, numerically where possible
+// Return a negative number if a < b, zero if a == b, or a positive number if a > b
+func compareVersions(a, b string) int {
+	aParts := strings.Split(a, ".")
+	bParts := strings.Split(b, ".")
+
+	for idx := 0; idx < len(aParts) && idx < len(bParts); idx += 1 {
+		aNum, aErr := strconv.Atoi(aParts[idx])
+		bNum, bErr := strconv.Atoi(bParts[idx])
+
+		switch {
+		case aErr == nil && bErr == nil:
+			if aNum != bNum {
+				return aNum - bNum
+			}
+		case aErr == nil:
+			return 1
+		case bErr == nil:
+			return -1
+		default:
+			if c := strings.Compare(aParts[idx], bParts[idx]); c != 0 {
+				return c
+			}
+		}
+	}
+
+	return len(aParts) - len(bParts)
+}
+
+// Build an index from references (including floating ones) to versioned orbs satisfying them
+func buildSatisfierIndex(orbRefs []string) map[string][]string {
+	ret := make(map[string][]string)
+
+	for _, orbRef := range orbRefs {
+		for _, satisfiableRef := range satisfiableRefs(orbRef) {
+			ret[satisfiableRef] = append(ret[satisfiableRef], orbRef)
+		}
+	}
+
+	return ret
+}
+
+// Pick the highest version among orbs satisfying the given reference
+// This mimics how CircleCI expands floating references such as my-orb@1 or my-orb@volatile
+func pickHighestSatisfier(satisfierIndex map[string][]string, orbRef string) (string, bool) {
+	ret := ""
+
+	for _, candidate := range satisfierIndex[orbRef] {
+		if ret == "" {
+			ret = candidate
+			continue
+		}
+
+		_, candidateVersion := splitOrbRef(candidate)
+		_, retVersion := splitOrbRef(ret)
+		if compareVersions(candidateVersion, retVersion) > 0 {
+			ret = candidate
+		}
+	}
+
+	return ret, ret != ""
+}
@@ -0,0 +1,71 @@
+package depresolver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSatisfiableRefs(t *testing.T) {
+	cases := []struct {
+		orbRef   string
+		expected []string
+	}{
+		{"ns/orb@1.2.3", []string{"ns/orb@1.2.3", "ns/orb@1.2", "ns/orb@1", "ns/orb@volatile"}},
+		{"ns/orb@10.0.0", []string{"ns/orb@10.0.0", "ns/orb@10.0", "ns/orb@10", "ns/orb@volatile"}},
+		{"ns/orb@1.2", []string{"ns/orb@1.2", "ns/orb@1", "ns/orb@volatile"}},
+		{"ns/orb@dev:alpha", []string{"ns/orb@dev:alpha", "ns/orb@volatile"}},
+		{"ns/orb@1.2.3-rc.1", []string{"ns/orb@1.2.3-rc.1", "ns/orb@volatile"}},
+	}
+
+	for _, c := range cases {
+		if actual := satisfiableRefs(c.orbRef); !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("satisfiableRefs(%q) = %q; expected %q", c.orbRef, actual, c.expected)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	cases := []struct {
+		a, b string
+		sign int
+	}{
+		{"1.2.3", "1.2.3", 0},
+		{"1.2.3", "1.2.4", -1},
+		{"1.10.0", "1.9.0", 1},
+		{"2.0.0", "10.0.0", -1},
+		{"1.2", "1.2.0", -1},
+		{"1.2.3", "1.alpha.0", 1},
+		{"1.alpha.0", "1.beta.0", -1},
+	}
+
+	for _, c := range cases {
+		actual := compareVersions(c.a, c.b)
+		if (actual > 0) != (c.sign > 0) || (actual < 0) != (c.sign < 0) {
+			t.Errorf("compareVersions(%q, %q) = %d; expected the sign of %d", c.a, c.b, actual, c.sign)
+		}
+	}
+}
+
+func TestPickHighestSatisfier(t *testing.T) {
+	satisfierIndex := buildSatisfierIndex([]string{"ns/orb@1.9.0", "ns/orb@1.10.0", "ns/orb@2.0.0", "ns/orb@1.2.3", "other/orb@0.1.0"})
+
+	cases := []struct {
+		orbRef   string
+		expected string
+		ok       bool
+	}{
+		{"ns/orb@1", "ns/orb@1.10.0", true},
+		{"ns/orb@1.2", "ns/orb@1.2.3", true},
+		{"ns/orb@1.2.3", "ns/orb@1.2.3", true},
+		{"ns/orb@volatile", "ns/orb@2.0.0", true},
+		{"ns/orb@3", "", false},
+		{"missing/orb@volatile", "", false},
+	}
+
+	for _, c := range cases {
+		actual, ok := pickHighestSatisfier(satisfierIndex, c.orbRef)
+		if actual != c.expected || ok != c.ok {
+			t.Errorf("pickHighestSatisfier(%q) = (%q, %v); expected (%q, %v)", c.orbRef, actual, ok, c.expected, c.ok)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package depresolver
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+type Cause string
+
+const (
+	CauseMissing      Cause = "missing"
+	CauseIllegible    Cause = "illegible"
+	CauseImportFailed Cause = "import-failed"
+	CauseCycle        Cause = "cycle"
+)
+
+// Explanation describes why an orb cannot be (or could not be) made available
+type Explanation struct {
+	Ref string
+
+	// Via is the reference as it is written in the source of the dependent orb
+	Via string
+
+	// Cause is non-empty if the orb itself is a root cause
+	Cause  Cause
+	Detail string
+
+	// Dependencies lists explanations for dependencies blocking the orb
+	Dependencies []*Explanation
+}
+
+// Return true if the orb is blocked by itself or by any of its dependencies
+func (explanation *Explanation) IsBlocked() bool {
+	return explanation.Cause != "" || len(explanation.Dependencies) > 0
+}
+
+// Group edges from an orb by the references as written in its source, in the order of first appearance
+func groupEdgesByVia(edges []*GraphEdge) ([]string, map[string][]string) {
+	vias := []string{}
+	satisfiers := make(map[string][]string)
+
+	for _, edge := range edges {
+		if _, ok := satisfiers[edge.Via]; !ok {
+			vias = append(vias, edge.Via)
+		}
+		satisfiers[edge.Via] = append(satisfiers[edge.Via], edge.To)
+	}
+
+	return vias, satisfiers
+}
+
+func isHigherVersion(orbRef, thanRef string) bool {
+	_, version := splitOrbRef(orbRef)
+	_, thanVersion := splitOrbRef(thanRef)
+
+	return compareVersions(version, thanVersion) > 0
+}
+
+// Explanations depending on no orbs on the stack of explain carry this depth
+const noDependenceOnStack = math.MaxInt32
+
+type explainer struct {
+	outgoing map[string][]*GraphEdge
+	dropped  map[string]string
+
+	// visiting maps orbs being explained to their depths on the stack
+	visiting map[string]int
+	memo     map[string]*Explanation
+}
+
+// Return the explanation along with the lowest depth of orbs on the stack it depends on, which are cut short as cycles
+// Explanations depending on the orb itself or on those below it on the stack are not memoized, as they differ for later callers
+func (ex *explainer) explain(ref, via string) (*Explanation, int) {
+	if depth, ok := ex.visiting[ref]; ok {
+		return &Explanation{Ref: ref, Via: via, Cause: CauseCycle, Detail: "dependency cycle detected"}, depth
+	}
+	if memoized, ok := ex.memo[ref]; ok {
+		return &Explanation{Ref: memoized.Ref, Via: via, Cause: memoized.Cause, Detail: memoized.Detail, Dependencies: memoized.Dependencies}, noDependenceOnStack
+	}
+
+	depth := len(ex.visiting)
+	ex.visiting[ref] = depth
+	defer delete(ex.visiting, ref)
+
+	ret := &Explanation{Ref: ref, Via: via}
+	lowest := noDependenceOnStack
+
+	if detail, ok := ex.dropped[ref]; ok {
+		ret.Cause = CauseImportFailed
+		ret.Detail = detail
+	}
+
+	// A dependency blocks the orb only if every orb satisfying it is blocked, as the resolver accepts any of them
+	// The highest of them represents the dependency then
+	vias, satisfiers := groupEdgesByVia(ex.outgoing[ref])
+	for _, via := range vias {
+		var blocking *Explanation
+
+		for _, satisfier := range satisfiers[via] {
+			dependency, dependsOn := ex.explain(satisfier, via)
+			if dependsOn < lowest {
+				lowest = dependsOn
+			}
+
+			if !dependency.IsBlocked() {
+				blocking = nil
+				break
+			}
+
+			if blocking == nil || isHigherVersion(dependency.Ref, blocking.Ref) {
+				blocking = dependency
+			}
+		}
+
+		if blocking != nil {
+			ret.Dependencies = append(ret.Dependencies, blocking)
+		}
+	}
+
+	// Orbs on cycles are explained differently depending on where the cycles are entered
+	if lowest <= depth {
+		return ret, lowest
+	}
+
+	ex.memo[ref] = ret
+
+	return ret, noDependenceOnStack
+}
+
+// Explain why the orb is blocked, following dependencies down to root causes
+// Illegible orbs are those caused YAML parser errors, and dropped orbs are those failed to be imported mapped to details
+func (graph *Graph) Explain(orbRef string, illegible []string, dropped map[string]string) (*Explanation, error) {
+	illegibleSatisfier := buildSatisfierIndex(illegible)
+
+	// The orb may not be in the graph if its source is illegible
+	for _, illegibleRef := range illegible {
+		if illegibleRef == orbRef {
+			return &Explanation{Ref: orbRef, Cause: CauseIllegible, Detail: "the source caused YAML parser errors"}, nil
+		}
+	}
+
+	node, ok := graph.Lookup(orbRef)
+	if !ok {
+		return nil, fmt.Errorf("orb %q is not in the source directory", orbRef)
+	}
+
+	ex := &explainer{
+		outgoing: make(map[string][]*GraphEdge),
+		dropped:  dropped,
+		visiting: make(map[string]int),
+		memo:     make(map[string]*Explanation),
+	}
+
+	for _, edge := range graph.Edges {
+		ex.outgoing[edge.From] = append(ex.outgoing[edge.From], edge)
+	}
+
+	for _, graphNode := range graph.Nodes {
+		if !graphNode.Missing {
+			continue
+		}
+
+		if satisfiers, ok := illegibleSatisfier[graphNode.Ref]; ok {
+			ex.memo[graphNode.Ref] = &Explanation{Ref: graphNode.Ref, Cause: CauseIllegible, Detail: fmt.Sprintf("the source of %q caused YAML parser errors", satisfiers[0])}
+		} else {
+			ex.memo[graphNode.Ref] = &Explanation{Ref: graphNode.Ref, Cause: CauseMissing, Detail: "not found in the source directory; possibly a hidden or private orb"}
+		}
+	}
+
+	explanation, _ := ex.explain(node.Ref, orbRef)
+
+	return explanation, nil
+}
+
+// List orbs blocked directly or indirectly if the given orb is unavailable
+// A dependent is blocked only if every orb satisfying one of its dependencies is blocked, as the resolver accepts any of them
+func (graph *Graph) BlockedDependents(orbRef string) []string {
+	ret := []string{}
+
+	incoming := make(map[string][]string)
+	outgoing := make(map[string][]*GraphEdge)
+	for _, edge := range graph.Edges {
+		incoming[edge.To] = append(incoming[edge.To], edge.From)
+		outgoing[edge.From] = append(outgoing[edge.From], edge)
+	}
+
+	isBlockedBy := func(dependent string, blocked map[string]bool) bool {
+		vias, satisfiers := groupEdgesByVia(outgoing[dependent])
+		for _, via := range vias {
+			allBlocked := true
+			for _, satisfier := range satisfiers[via] {
+				allBlocked = allBlocked && blocked[satisfier]
+			}
+
+			if allBlocked {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	blocked := map[string]bool{orbRef: true}
+	for procQueue := []string{orbRef}; len(procQueue) > 0; procQueue = procQueue[1:] {
+		for _, dependent := range incoming[procQueue[0]] {
+			if !blocked[dependent] && isBlockedBy(dependent, blocked) {
+				blocked[dependent] = true
+				procQueue = append(procQueue, dependent)
+				ret = append(ret, dependent)
+			}
+		}
+	}
+
+	sort.Strings(ret)
+
+	return ret
+}
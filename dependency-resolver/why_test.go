@@ -0,0 +1,124 @@
+package depresolver
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/circle-makotom/orbs-sync/types"
+)
+
+// Follow the first dependency of each blocked orb, returning the refs on the way and the root cause
+func chainOf(explanation *Explanation) ([]string, Cause) {
+	var chain []string
+	cause := Cause("")
+
+	for current := explanation; current != nil && current.IsBlocked(); {
+		chain = append(chain, current.Ref)
+		cause = current.Cause
+
+		if len(current.Dependencies) > 0 {
+			current = current.Dependencies[0]
+		} else {
+			current = nil
+		}
+	}
+
+	return chain, cause
+}
+
+func TestExplain(t *testing.T) {
+	orbs := []*types.VersionedOrb{
+		newTestOrb("ns/app@1.0.0", "ns/lib@1"),
+		newTestOrb("ns/lib@1.0.0"),
+		newTestOrb("ns/lib@1.1.0"),
+		newTestOrb("ns/tool@1.0.0", "ns/hidden@1.0.0"),
+		newTestOrb("ns/user@1.0.0", "ns/tool@1.0.0"),
+		newIllegibleTestOrb("ns/bad@1.0.0"),
+		newTestOrb("ns/reader@1.0.0", "ns/bad@1"),
+	}
+	graph, illegible := BuildGraph(orbs)
+
+	cases := []struct {
+		name    string
+		orbRef  string
+		dropped map[string]string
+
+		// Expected chain of blocking orbs following the first dependency, starting with the orb itself
+		chain []string
+		cause Cause
+
+		dependents []string
+	}{
+		{"healthy", "ns/app@1.0.0", map[string]string{}, nil, "", []string{}},
+		{"lower version still satisfies", "ns/lib@1.1.0", map[string]string{"ns/lib@1.1.0": "failed"}, []string{"ns/lib@1.1.0"}, CauseImportFailed, []string{}},
+		{"every satisfier dropped", "ns/app@1.0.0", map[string]string{"ns/lib@1.0.0": "failed", "ns/lib@1.1.0": "failed"}, []string{"ns/app@1.0.0", "ns/lib@1.1.0"}, CauseImportFailed, []string{}},
+		{"missing dependency", "ns/user@1.0.0", map[string]string{}, []string{"ns/user@1.0.0", "ns/tool@1.0.0", "ns/hidden@1.0.0"}, CauseMissing, []string{}},
+		{"dependents of missing dependency", "ns/tool@1.0.0", map[string]string{}, []string{"ns/tool@1.0.0", "ns/hidden@1.0.0"}, CauseMissing, []string{"ns/user@1.0.0"}},
+		{"illegible dependency", "ns/reader@1.0.0", map[string]string{}, []string{"ns/reader@1.0.0", "ns/bad@1"}, CauseIllegible, []string{}},
+		{"illegible orb", "ns/bad@1.0.0", map[string]string{}, []string{"ns/bad@1.0.0"}, CauseIllegible, nil},
+	}
+
+	for _, c := range cases {
+		explanation, err := graph.Explain(c.orbRef, illegible, c.dropped)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+
+		chain, cause := chainOf(explanation)
+		if !reflect.DeepEqual(chain, c.chain) || cause != c.cause {
+			t.Errorf("%s: chain = %q caused by %q; expected %q caused by %q", c.name, chain, cause, c.chain, c.cause)
+		}
+
+		if c.dependents != nil {
+			if dependents := graph.BlockedDependents(explanation.Ref); !reflect.DeepEqual(dependents, c.dependents) {
+				t.Errorf("%s: blocked dependents = %q; expected %q", c.name, dependents, c.dependents)
+			}
+		}
+	}
+}
+
+func TestBlockedDependents(t *testing.T) {
+	orbs := []*types.VersionedOrb{
+		newTestOrb("ns/app@1.0.0", "ns/lib@1"),
+		newTestOrb("ns/pinned@1.0.0", "ns/lib@1.1.0"),
+		newTestOrb("ns/top@1.0.0", "ns/pinned@1.0.0"),
+		newTestOrb("ns/lib@1.0.0"),
+		newTestOrb("ns/lib@1.1.0"),
+	}
+	graph, _ := BuildGraph(orbs)
+
+	// ns/app can fall back to ns/lib@1.0.0, but ns/pinned cannot, and nor can ns/top depending on it
+	expected := []string{"ns/pinned@1.0.0", "ns/top@1.0.0"}
+	if actual := graph.BlockedDependents("ns/lib@1.1.0"); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("blocked dependents = %q; expected %q", actual, expected)
+	}
+}
+
+func TestExplainCycle(t *testing.T) {
+	orbs := []*types.VersionedOrb{
+		newTestOrb("ns/app@1.0.0", "ns/a@1.0.0", "ns/b@1.0.0"),
+		newTestOrb("ns/a@1.0.0", "ns/b@1.0.0"),
+		newTestOrb("ns/b@1.0.0", "ns/a@1.0.0"),
+	}
+	graph, illegible := BuildGraph(orbs)
+
+	explanation, err := graph.Explain("ns/app@1.0.0", illegible, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(explanation.Dependencies) != 2 {
+		t.Fatalf("blocking dependencies = %d; expected 2", len(explanation.Dependencies))
+	}
+
+	// ns/b is explained while ns/a is on the stack first, which must not be reused when ns/app reaches ns/b directly
+	expected := [][]string{
+		{"ns/a@1.0.0", "ns/b@1.0.0", "ns/a@1.0.0"},
+		{"ns/b@1.0.0", "ns/a@1.0.0", "ns/b@1.0.0"},
+	}
+	for idx, dependency := range explanation.Dependencies {
+		if chain, cause := chainOf(dependency); !reflect.DeepEqual(chain, expected[idx]) || cause != CauseCycle {
+			t.Errorf("dependency %d: chain = %q caused by %q; expected %q caused by %q", idx, chain, cause, expected[idx], CauseCycle)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package events
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type Type string
+
+const (
+	OrbDiscovered Type = "orb-discovered"
+	SourceFetched Type = "source-fetched"
+	OrbIllegible  Type = "orb-illegible"
+	OrbResolved   Type = "orb-resolved"
+
+	ImportStarted   Type = "import-started"
+	ImportRetried   Type = "import-retried"
+	ImportSucceeded Type = "import-succeeded"
+	ImportDropped   Type = "import-dropped"
+
+	PhaseStarted  Type = "phase-started"
+	PhaseFinished Type = "phase-finished"
+)
+
+// Event is a step in the lifecycle of an orb or of a phase, which is one of collect, inventory, resolve, validate, import and verify
+type Event struct {
+	Time time.Time `json:"time"`
+	Type Type      `json:"type"`
+
+	// Ref is given for events of orbs, and Phase for those of phases
+	Ref   string `json:"ref,omitempty"`
+	Phase string `json:"phase,omitempty"`
+
+	// Attempt is the number of the attempt starting with retries
+	Attempt int `json:"attempt,omitempty"`
+
+	// Status tells whether the orb was imported or already present for succeeded imports
+	Status string `json:"status,omitempty"`
+
+	// Category and Error tell why the orb was dropped or retried, or is illegible
+	Category string `json:"category,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	// DurationSeconds is given for finished phases
+	DurationSeconds float64 `json:"durationSeconds,omitempty"`
+}
+
+// Sink receives events from the collector, the resolver and the importer; it must be safe for concurrent use
+type Sink interface {
+	Emit(event *Event)
+}
+
+type discard struct{}
+
+func (discard) Emit(*Event) {}
+
+// Discard drops all the events
+var Discard Sink = discard{}
+
+// NDJSONSink writes each event as a JSON object in a line
+// It stops writing at the first error, which Err returns, so that a broken output does not fail every event again
+type NDJSONSink struct {
+	mu  sync.Mutex
+	w   io.Writer
+	err error
+}
+
+func NewNDJSONSink(w io.Writer) *NDJSONSink {
+	return &NDJSONSink{w: w}
+}
+
+func (s *NDJSONSink) Emit(event *Event) {
+	line, err := json.Marshal(event)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return
+	}
+
+	if err != nil {
+		s.err = errors.Wrapf(err, "could not encode the %s event", event.Type)
+		return
+	}
+
+	if _, err := s.w.Write(append(line, '\n')); err != nil {
+		s.err = errors.Wrap(err, "could not write events")
+	}
+}
+
+// Return the first error encoding or writing events, if any
+func (s *NDJSONSink) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+var (
+	mu      sync.RWMutex
+	current = Discard
+)
+
+// Replace the sink all the packages emit events to; events are discarded until set
+func SetSink(sink Sink) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	current = sink
+}
+
+// Emit the event to the current sink, stamping the time unless given
+func Emit(event *Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	mu.RLock()
+	sink := current
+	mu.RUnlock()
+
+	sink.Emit(event)
+}
+
+// Emit an event of the phase starting, and return the function to emit one of the phase finishing
+// e.g., defer events.StartPhase("resolve")()
+func StartPhase(phase string) func() {
+	startedAt := time.Now()
+	Emit(&Event{Time: startedAt, Type: PhaseStarted, Phase: phase})
+
+	return func() {
+		finishedAt := time.Now()
+		Emit(&Event{Time: finishedAt, Type: PhaseFinished, Phase: phase, DurationSeconds: finishedAt.Sub(startedAt).Seconds()})
+	}
+}
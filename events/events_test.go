@@ -0,0 +1,146 @@
+package events
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingSink struct {
+	mu     sync.Mutex
+	events []*Event
+}
+
+func (s *recordingSink) Emit(event *Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.events = append(s.events, event)
+}
+
+// Route events to a recording sink until the test finishes
+func record(t *testing.T) *recordingSink {
+	t.Helper()
+
+	sink := &recordingSink{}
+	SetSink(sink)
+	t.Cleanup(func() { SetSink(Discard) })
+
+	return sink
+}
+
+type failingWriter struct {
+	writes int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return 0, errors.New("broken pipe")
+}
+
+func TestNDJSONSink(t *testing.T) {
+	at := time.Date(2021, 12, 1, 0, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name     string
+		event    *Event
+		expected string
+	}{
+		{
+			name:     "discovered",
+			event:    &Event{Time: at, Type: OrbDiscovered, Ref: "ns/orb@1.0.0"},
+			expected: `{"time":"2021-12-01T00:00:00Z","type":"orb-discovered","ref":"ns/orb@1.0.0"}`,
+		},
+		{
+			name:     "retried",
+			event:    &Event{Time: at, Type: ImportRetried, Ref: "ns/orb@1.0.0", Attempt: 2, Category: "transient", Error: "503 Service Unavailable"},
+			expected: `{"time":"2021-12-01T00:00:00Z","type":"import-retried","ref":"ns/orb@1.0.0","attempt":2,"category":"transient","error":"503 Service Unavailable"}`,
+		},
+		{
+			name:     "succeeded",
+			event:    &Event{Time: at, Type: ImportSucceeded, Ref: "ns/orb@1.0.0", Attempt: 1, Status: "imported"},
+			expected: `{"time":"2021-12-01T00:00:00Z","type":"import-succeeded","ref":"ns/orb@1.0.0","attempt":1,"status":"imported"}`,
+		},
+		{
+			name:     "phase finished",
+			event:    &Event{Time: at, Type: PhaseFinished, Phase: "import", DurationSeconds: 1.5},
+			expected: `{"time":"2021-12-01T00:00:00Z","type":"phase-finished","phase":"import","durationSeconds":1.5}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			sink := NewNDJSONSink(buf)
+
+			sink.Emit(tc.event)
+			sink.Emit(tc.event)
+
+			if expected := tc.expected + "\n" + tc.expected + "\n"; buf.String() != expected {
+				t.Errorf("wrote %q; expected %q", buf.String(), expected)
+			}
+			if err := sink.Err(); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestNDJSONSinkFailing(t *testing.T) {
+	w := &failingWriter{}
+	sink := NewNDJSONSink(w)
+
+	sink.Emit(&Event{Type: OrbDiscovered, Ref: "ns/a@1.0.0"})
+	sink.Emit(&Event{Type: OrbDiscovered, Ref: "ns/b@1.0.0"})
+
+	if err := sink.Err(); err == nil || !strings.Contains(err.Error(), "broken pipe") {
+		t.Errorf("got %v; expected the write error", err)
+	}
+	if w.writes != 1 {
+		t.Errorf("wrote %d times; expected to stop at the first error", w.writes)
+	}
+}
+
+func TestEmit(t *testing.T) {
+	sink := record(t)
+	at := time.Date(2021, 12, 1, 0, 0, 0, 0, time.UTC)
+
+	before := time.Now()
+	Emit(&Event{Type: OrbDiscovered, Ref: "ns/a@1.0.0"})
+	Emit(&Event{Time: at, Type: OrbDiscovered, Ref: "ns/b@1.0.0"})
+
+	if len(sink.events) != 2 {
+		t.Fatalf("got %d events; expected 2", len(sink.events))
+	}
+	if stamped := sink.events[0].Time; stamped.Before(before) {
+		t.Errorf("stamped %v; expected the time of emitting", stamped)
+	}
+	if given := sink.events[1].Time; !given.Equal(at) {
+		t.Errorf("stamped %v; expected the given time to be kept", given)
+	}
+}
+
+func TestStartPhase(t *testing.T) {
+	sink := record(t)
+
+	finish := StartPhase("resolve")
+	finish()
+
+	if len(sink.events) != 2 {
+		t.Fatalf("got %d events; expected 2", len(sink.events))
+	}
+
+	started, finished := sink.events[0], sink.events[1]
+	if started.Type != PhaseStarted || started.Phase != "resolve" {
+		t.Errorf("got %+v; expected the phase to start", started)
+	}
+	if finished.Type != PhaseFinished || finished.Phase != "resolve" {
+		t.Errorf("got %+v; expected the phase to finish", finished)
+	}
+	if expected := finished.Time.Sub(started.Time).Seconds(); finished.DurationSeconds != expected {
+		t.Errorf("took %v seconds; expected %v", finished.DurationSeconds, expected)
+	}
+}
@@ -0,0 +1,407 @@
+package lock
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+
+	atomicfile "github.com/circle-makotom/orbs-sync/atomic-file"
+	"github.com/circle-makotom/orbs-sync/logging"
+)
+
+var (
+	pollInterval = 2 * time.Second
+
+	logger = logging.NewSwappable(logging.New("lock"))
+)
+
+// Replace the logger of the lock, e.g., to route entries on waiting for and taking over locks to the logger of the programme using it
+func SetLogger(l logging.Printer) {
+	logger.Set(l)
+}
+
+// Holder describes the run holding a lock
+type Holder struct {
+	ID          string    `json:"id"`
+	Hostname    string    `json:"hostname"`
+	PID         int       `json:"pid"`
+	Command     string    `json:"command"`
+	Destination string    `json:"destination"`
+	AcquiredAt  time.Time `json:"acquiredAt"`
+
+	// ExpiresAt is renewed by heartbeats of the holder; the lock is regarded as stale after this
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func (h *Holder) String() string {
+	return fmt.Sprintf("%s (pid %d on %s) since %s", h.Command, h.PID, h.Hostname, h.AcquiredAt.Format(time.RFC3339))
+}
+
+// Stale locks are those not renewed in time, or those held by processes gone on this host
+func (h *Holder) isStale(now time.Time) bool {
+	if now.After(h.ExpiresAt) {
+		return true
+	}
+
+	hostname, err := os.Hostname()
+	return err == nil && h.Hostname == hostname && !isAlive(h.PID)
+}
+
+func isAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+
+	return !errors.Is(process.Signal(syscall.Signal(0)), os.ErrProcessDone)
+}
+
+// LockedError is returned if the lock is held by another run
+type LockedError struct {
+	Path   string
+	Holder *Holder
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("%s is locked by %s, expiring at %s unless renewed", e.Path, e.Holder, e.Holder.ExpiresAt.Format(time.RFC3339))
+}
+
+// LostError tells the lock was lost while held, e.g., taken over by another run as the heartbeats were delayed
+type LostError struct {
+	Path string
+
+	// Holder is the run which took over the lock, or nil if the lock file was removed
+	Holder *Holder
+}
+
+func (e *LostError) Error() string {
+	if e.Holder == nil {
+		return fmt.Sprintf("lost lock %s, which was removed", e.Path)
+	}
+
+	return fmt.Sprintf("lost lock %s to %s", e.Path, e.Holder)
+}
+
+// Lock is an advisory lock by a file, which works on shared filesystems as well
+type Lock struct {
+	path   string
+	ttl    time.Duration
+	holder *Holder
+
+	stop chan struct{}
+	done chan struct{}
+
+	// lost is closed once the lock is lost, after lostErr is set
+	lost    chan struct{}
+	lostErr error
+}
+
+// Heartbeats of the holder go to its own file next to the lock file, so that renewals never replace the lock file another run may have taken over
+func heartbeatPath(path, id string) string {
+	return fmt.Sprintf("%s.%s.heartbeat", path, id)
+}
+
+func readHolderFile(path string) (*Holder, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	holder := &Holder{}
+	if err := json.Unmarshal(contents, holder); err != nil {
+		return nil, err
+	}
+
+	return holder, nil
+}
+
+// Read the holder of the lock, with the expiry renewed by its heartbeats if any
+func readHolder(path string) (*Holder, error) {
+	holder, err := readHolderFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if heartbeat, err := readHolderFile(heartbeatPath(path, holder.ID)); err == nil && heartbeat.ID == holder.ID && heartbeat.ExpiresAt.After(holder.ExpiresAt) {
+		holder.ExpiresAt = heartbeat.ExpiresAt
+	}
+
+	return holder, nil
+}
+
+// Create the lock file unless it exists; the file is linked from a temporary one so that readers never see it half-written
+func createExclusively(path string, holder *Holder) error {
+	contents, err := json.MarshalIndent(holder, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(contents); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Link(tmpFile.Name(), path)
+}
+
+// Move the lock file aside to the path unique to the holder, so that it is neither renewed nor removed once taken over by another run
+// Another run taking the lock over in the meantime is put back, returned as the current holder
+func moveAside(path, suffix string, holder *Holder) (string, *Holder, error) {
+	movedPath := fmt.Sprintf("%s.%s.%s", path, holder.ID, suffix)
+	if err := os.Rename(path, movedPath); err != nil {
+		return "", nil, err
+	}
+
+	moved, err := readHolderFile(movedPath)
+	if err == nil && moved.ID == holder.ID {
+		return movedPath, nil, nil
+	}
+	defer os.Remove(movedPath)
+
+	if linkErr := os.Link(movedPath, path); linkErr != nil && !errors.Is(linkErr, os.ErrExist) {
+		return "", nil, linkErr
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	return "", moved, nil
+}
+
+// Remove the stale lock file, unless it has been taken over by another run in the meantime
+func removeStale(path string, stale *Holder) error {
+	movedPath, current, err := moveAside(path, "stale", stale)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	} else if current != nil {
+		return &LockedError{Path: path, Holder: current}
+	}
+	os.Remove(heartbeatPath(path, stale.ID))
+
+	return os.Remove(movedPath)
+}
+
+func tryAcquire(path string, holder *Holder) error {
+	err := createExclusively(path, holder)
+	if !errors.Is(err, os.ErrExist) {
+		return err
+	}
+
+	existing, err := readHolder(path)
+	if errors.Is(err, os.ErrNotExist) {
+		// Released in the meantime
+		return tryAcquire(path, holder)
+	} else if err != nil {
+		return errors.Wrapf(err, "could not read lock file %q; remove it if no other runs are in progress", path)
+	}
+
+	if !existing.isStale(time.Now()) {
+		return &LockedError{Path: path, Holder: existing}
+	}
+
+	logger.Warnf("taking over the stale lock held by %s", existing)
+	if err := removeStale(path, existing); err != nil {
+		return err
+	}
+
+	if err := createExclusively(path, holder); errors.Is(err, os.ErrExist) {
+		// Another run took over the stale lock first
+		if existing, err := readHolder(path); err == nil {
+			return &LockedError{Path: path, Holder: existing}
+		}
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func newID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+
+	return hex.EncodeToString(buf)
+}
+
+// Acquire the lock, waiting up to the given duration if it is held by another run
+// The lock is renewed by heartbeats every third of the TTL until released; other runs regard it as stale once it is not renewed for the TTL
+// Return LockedError naming the holder if the lock could not be acquired in time
+func Acquire(ctx context.Context, path, destination, command string, ttl, wait time.Duration) (*Lock, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("invalid TTL of lock %v", ttl)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not tell the hostname")
+	}
+
+	giveUpAt := time.Now().Add(wait)
+	for waiting := false; ; waiting = true {
+		now := time.Now()
+		holder := &Holder{
+			ID:          newID(),
+			Hostname:    hostname,
+			PID:         os.Getpid(),
+			Command:     command,
+			Destination: destination,
+			AcquiredAt:  now,
+			ExpiresAt:   now.Add(ttl),
+		}
+
+		err := tryAcquire(path, holder)
+		if err == nil {
+			logger.Infof("acquired lock %q", path)
+
+			l := &Lock{path: path, ttl: ttl, holder: holder, stop: make(chan struct{}), done: make(chan struct{}), lost: make(chan struct{})}
+			go l.heartbeat()
+
+			return l, nil
+		}
+
+		var lockedErr *LockedError
+		if !errors.As(err, &lockedErr) || !now.Before(giveUpAt) {
+			return nil, err
+		}
+
+		if !waiting {
+			logger.Infof("waiting up to %v for the lock; %v", wait, lockedErr)
+		}
+
+		select {
+		case <-time.After(pollInterval):
+		case <-ctx.Done():
+			return nil, errors.Wrapf(ctx.Err(), "gave up waiting for the lock; %v", lockedErr)
+		}
+	}
+}
+
+// Renew the lock by a heartbeat, unless it has been taken over by another run
+// Only the heartbeat file of this run is written; another run may take the lock over only once heartbeats stop for the TTL
+func (l *Lock) renew() error {
+	current, err := readHolderFile(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &LostError{Path: l.path}
+	} else if err != nil {
+		return err
+	} else if current.ID != l.holder.ID {
+		return &LostError{Path: l.path, Holder: current}
+	}
+
+	renewed := *l.holder
+	renewed.ExpiresAt = time.Now().Add(l.ttl)
+
+	contents, err := json.MarshalIndent(&renewed, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := atomicfile.WriteFile(heartbeatPath(l.path, l.holder.ID), contents, 0644); err != nil {
+		return err
+	}
+
+	l.holder = &renewed
+
+	return nil
+}
+
+// Renew the lock until released; tell the lock is lost once it has been taken over by another run
+func (l *Lock) heartbeat() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+
+		var lostErr *LostError
+		if err := l.renew(); errors.As(err, &lostErr) {
+			logger.Errorf("%v", lostErr)
+			os.Remove(heartbeatPath(l.path, l.holder.ID))
+
+			l.lostErr = lostErr
+			close(l.lost)
+			return
+		} else if err != nil {
+			logger.Warnf("could not renew lock %q: %v", l.path, err)
+		}
+	}
+}
+
+// Return a channel closed once the lock is lost
+func (l *Lock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Return LostError if the lock has been lost, or nil otherwise
+func (l *Lock) Err() error {
+	select {
+	case <-l.lost:
+		return l.lostErr
+	default:
+		return nil
+	}
+}
+
+// Derive a context cancelled once the lock is lost, so that the run holding the lock stops
+func (l *Lock) Context(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+
+	go func() {
+		select {
+		case <-l.lost:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// Release the lock, unless it has been taken over by another run
+func (l *Lock) Release() error {
+	close(l.stop)
+	<-l.done
+
+	if err := l.Err(); err != nil {
+		return err
+	}
+	defer os.Remove(heartbeatPath(l.path, l.holder.ID))
+
+	movedPath, current, err := moveAside(l.path, "releasing", l.holder)
+	if err != nil {
+		return err
+	} else if current != nil {
+		logger.Warnf("lock %q had been taken over by %s", l.path, current)
+		return nil
+	}
+
+	logger.Infof("releasing lock %q", l.path)
+
+	return os.Remove(movedPath)
+}
@@ -0,0 +1,241 @@
+package lock
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/circle-makotom/orbs-sync/logging"
+)
+
+func init() {
+	SetLogger(logging.NewWithWriter("lock", ioutil.Discard, logging.FormatText, logging.LevelError))
+	pollInterval = 5 * time.Millisecond
+}
+
+func writeHolder(t *testing.T, path string, holder *Holder) {
+	t.Helper()
+
+	contents, err := json.Marshal(holder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Return the PID of a process which has exited
+func exitedPID(t *testing.T) int {
+	t.Helper()
+
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skipf("could not run a process: %v", err)
+	}
+
+	return cmd.Process.Pid
+}
+
+func TestAcquireStale(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		holder *Holder
+	}{
+		{"expired", &Holder{ID: "expired", Hostname: "another-host", PID: 1, ExpiresAt: time.Now().Add(-time.Second)}},
+		{"holder gone on this host", &Holder{ID: "gone", Hostname: hostname, PID: exitedPID(t), ExpiresAt: time.Now().Add(time.Hour)}},
+	}
+
+	for _, c := range cases {
+		path := filepath.Join(t.TempDir(), "test.lock")
+		writeHolder(t, path, c.holder)
+
+		l, err := Acquire(context.Background(), path, "destination", "test", time.Minute, 0)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+
+		if current, err := readHolder(path); err != nil || current.ID != l.holder.ID {
+			t.Errorf("%s: lock file is held by %v (%v); expected to be taken over", c.name, current, err)
+		}
+		if err := l.Release(); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+}
+
+func TestAcquireHeld(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.lock")
+
+	first, err := Acquire(context.Background(), path, "destination", "first", time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lockedErr *LockedError
+	if _, err := Acquire(context.Background(), path, "destination", "second", time.Minute, 0); !errors.As(err, &lockedErr) {
+		t.Fatalf("acquiring the held lock returned %v; expected LockedError", err)
+	} else if lockedErr.Holder.ID != first.holder.ID {
+		t.Errorf("LockedError names %s; expected %s", lockedErr.Holder, first.holder)
+	}
+
+	// Waiting runs acquire the lock once released
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		first.Release()
+	}()
+
+	second, err := Acquire(context.Background(), path, "destination", "second", time.Minute, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Release(); err != nil {
+		t.Error(err)
+	}
+
+	if entries, err := ioutil.ReadDir(filepath.Dir(path)); err != nil {
+		t.Fatal(err)
+	} else if len(entries) > 0 {
+		t.Errorf("%d file(s) remain after released, e.g., %q", len(entries), entries[0].Name())
+	}
+}
+
+// Runs contending for the lock never hold it together, including while it is renewed
+func TestAcquireContention(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.lock")
+
+	var mu sync.Mutex
+	holding, maxHolding, nAcquired := 0, 0, 0
+
+	var wg sync.WaitGroup
+	for idx := 0; idx < 8; idx++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			l, err := Acquire(context.Background(), path, "destination", "test", 60*time.Millisecond, 5*time.Second)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			mu.Lock()
+			holding += 1
+			nAcquired += 1
+			if holding > maxHolding {
+				maxHolding = holding
+			}
+			mu.Unlock()
+
+			// Hold the lock across heartbeats
+			select {
+			case <-time.After(50 * time.Millisecond):
+			case <-l.Lost():
+			}
+
+			mu.Lock()
+			holding -= 1
+			mu.Unlock()
+
+			l.Release()
+		}()
+	}
+	wg.Wait()
+
+	if maxHolding != 1 {
+		t.Errorf("%d run(s) held the lock at once; expected 1", maxHolding)
+	}
+	if nAcquired != 8 {
+		t.Errorf("%d run(s) acquired the lock; expected 8", nAcquired)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.lock")
+
+	l, err := Acquire(context.Background(), path, "destination", "test", 30*time.Millisecond, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acquired, _ := readHolder(path)
+
+	time.Sleep(50 * time.Millisecond)
+
+	if renewed, err := readHolder(path); err != nil {
+		t.Fatal(err)
+	} else if renewed.ID != acquired.ID || !renewed.ExpiresAt.After(acquired.ExpiresAt) {
+		t.Errorf("lock was not renewed: %+v after %+v", renewed, acquired)
+	}
+	if err := l.Err(); err != nil {
+		t.Errorf("lock was lost: %v", err)
+	}
+
+	if err := l.Release(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLost(t *testing.T) {
+	cases := []struct {
+		name    string
+		takeOff func(path string) error
+		holder  string
+	}{
+		{"taken over", func(path string) error {
+			return os.Rename(path+".another", path)
+		}, "another"},
+		{"removed", os.Remove, ""},
+	}
+
+	for _, c := range cases {
+		path := filepath.Join(t.TempDir(), "test.lock")
+
+		l, err := Acquire(context.Background(), path, "destination", "test", 30*time.Millisecond, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := l.Context(context.Background())
+
+		writeHolder(t, path+".another", &Holder{ID: "another", ExpiresAt: time.Now().Add(time.Hour)})
+		if err := c.takeOff(path); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+			t.Fatalf("%s: context was not cancelled", c.name)
+		}
+		cancel()
+
+		var lostErr *LostError
+		if !errors.As(l.Err(), &lostErr) {
+			t.Errorf("%s: Err() = %v; expected LostError", c.name, l.Err())
+		} else if (lostErr.Holder == nil && c.holder != "") || (lostErr.Holder != nil && lostErr.Holder.ID != c.holder) {
+			t.Errorf("%s: lost to %v; expected %q", c.name, lostErr.Holder, c.holder)
+		}
+
+		// The lock of another run is left as-is
+		if c.holder != "" {
+			l.Release()
+			if current, err := readHolder(path); err != nil || current.ID != c.holder {
+				t.Errorf("%s: lock file is held by %v (%v) after released; expected %q", c.name, current, err, c.holder)
+			}
+		}
+	}
+}
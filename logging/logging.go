@@ -0,0 +1,242 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (level Level) String() string {
+	if name, ok := levelNames[level]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("level(%d)", int(level))
+}
+
+func ParseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+
+	return LevelInfo, fmt.Errorf("unknown log level %q; must be one of debug, info, warn and error", name)
+}
+
+type Format string
+
+const (
+	// FormatText is a line for each entry, prefixed with the logger name, the time and the level
+	FormatText Format = "text"
+
+	// FormatJSON is a JSON object for each line, with keys time, level, logger and msg
+	FormatJSON Format = "json"
+)
+
+func ParseFormat(name string) (Format, error) {
+	switch format := Format(strings.ToLower(name)); format {
+	case FormatText, FormatJSON:
+		return format, nil
+	default:
+		return FormatText, fmt.Errorf("unknown log format %q; must be either text or json", name)
+	}
+}
+
+type output struct {
+	w        io.Writer
+	minLevel Level
+}
+
+// sink writes entries of loggers sharing it to its outputs, one entry at a time
+type sink struct {
+	mu      sync.Mutex
+	format  Format
+	outputs []output
+}
+
+type jsonEntry struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Logger  string `json:"logger"`
+	Message string `json:"msg"`
+}
+
+func (s *sink) write(name string, level Level, message string) {
+	now := time.Now()
+	message = strings.TrimRight(message, "\n")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var line []byte
+	for _, out := range s.outputs {
+		if level < out.minLevel {
+			continue
+		}
+
+		// Entries are formatted only if any outputs take them, as most debug entries are not
+		if line == nil {
+			if s.format == FormatJSON {
+				line, _ = json.Marshal(&jsonEntry{Time: now.Format(time.RFC3339Nano), Level: level.String(), Logger: name, Message: message})
+			} else {
+				line = []byte(fmt.Sprintf("%s: %s %s %s", name, now.Format("2006/01/02 15:04:05.000000"), strings.ToUpper(level.String()), message))
+			}
+			line = append(line, '\n')
+		}
+
+		out.w.Write(line)
+	}
+}
+
+// Logger writes entries with levels on behalf of a package or a command, which is named in each entry
+type Logger struct {
+	name string
+	sink *sink
+}
+
+// All the loggers created by New share the default sink, which writes entries of info and above to the standard error until configured
+var defaultSink = &sink{format: FormatText, outputs: []output{{w: os.Stderr, minLevel: LevelInfo}}}
+
+// Create a logger writing to the default sink, which Configure applies to
+func New(name string) *Logger {
+	return &Logger{name: name, sink: defaultSink}
+}
+
+// Create a logger writing entries of the level and above to the writer, independently of the default sink
+// This is for programmes using packages of orbs-sync, to inject their loggers
+func NewWithWriter(name string, w io.Writer, format Format, minLevel Level) *Logger {
+	return &Logger{name: name, sink: &sink{format: format, outputs: []output{{w: w, minLevel: minLevel}}}}
+}
+
+// Create a logger with another name, writing to the same sink
+func (l *Logger) Named(name string) *Logger {
+	return &Logger{name: name, sink: l.sink}
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.sink.write(l.name, LevelDebug, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.sink.write(l.name, LevelInfo, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.sink.write(l.name, LevelWarn, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.sink.write(l.name, LevelError, fmt.Sprintf(format, args...))
+}
+
+// Printer is what packages of orbs-sync need of a logger, so that programmes using them can inject their own, e.g., an adapter to their logging library
+type Printer interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// Swappable is the logger of a package, which programmes using the package may replace at any moment, even while it is in use
+type Swappable struct {
+	mu      sync.RWMutex
+	printer Printer
+}
+
+func NewSwappable(printer Printer) *Swappable {
+	return &Swappable{printer: printer}
+}
+
+// Replace the logger entries are written to
+func (s *Swappable) Set(printer Printer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.printer = printer
+}
+
+func (s *Swappable) get() Printer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.printer
+}
+
+func (s *Swappable) Debugf(format string, args ...interface{}) {
+	s.get().Debugf(format, args...)
+}
+
+func (s *Swappable) Infof(format string, args ...interface{}) {
+	s.get().Infof(format, args...)
+}
+
+func (s *Swappable) Warnf(format string, args ...interface{}) {
+	s.get().Warnf(format, args...)
+}
+
+func (s *Swappable) Errorf(format string, args ...interface{}) {
+	s.get().Errorf(format, args...)
+}
+
+type Options struct {
+	// Level is the minimum level of entries written
+	Level Level
+
+	Format Format
+
+	// Quiet limits entries to the standard error to warnings and errors; the log file takes entries of Level and above regardless
+	Quiet bool
+
+	// FilePath is the path to the file to append entries to as well, if given
+	FilePath string
+}
+
+// Configure the default sink, which all the loggers created by New share
+// Return the function to close the log file
+func Configure(opts Options) (func() error, error) {
+	stderrLevel := opts.Level
+	if opts.Quiet && stderrLevel < LevelWarn {
+		stderrLevel = LevelWarn
+	}
+
+	outputs := []output{{w: os.Stderr, minLevel: stderrLevel}}
+	closeFile := func() error { return nil }
+
+	if opts.FilePath != "" {
+		file, err := os.OpenFile(opts.FilePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+
+		outputs = append(outputs, output{w: file, minLevel: opts.Level})
+		closeFile = file.Close
+	}
+
+	defaultSink.mu.Lock()
+	defaultSink.format = opts.Format
+	defaultSink.outputs = outputs
+	defaultSink.mu.Unlock()
+
+	return closeFile, nil
+}
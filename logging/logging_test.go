@@ -0,0 +1,87 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A printer recording messages, as programmes using packages of orbs-sync may inject
+type recordingPrinter struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (p *recordingPrinter) record(level, format string, args ...interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.messages = append(p.messages, level+" "+fmt.Sprintf(format, args...))
+}
+
+func (p *recordingPrinter) Debugf(format string, args ...interface{}) {
+	p.record("debug", format, args...)
+}
+
+func (p *recordingPrinter) Infof(format string, args ...interface{}) {
+	p.record("info", format, args...)
+}
+
+func (p *recordingPrinter) Warnf(format string, args ...interface{}) {
+	p.record("warn", format, args...)
+}
+
+func (p *recordingPrinter) Errorf(format string, args ...interface{}) {
+	p.record("error", format, args...)
+}
+
+func TestSwappable(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewSwappable(NewWithWriter("test", &buf, FormatText, LevelDebug))
+
+	logger.Debugf("to the %s", "writer")
+	if !strings.Contains(buf.String(), "test: ") || !strings.Contains(buf.String(), "DEBUG to the writer") {
+		t.Errorf("writer got %q; expected the debug entry", buf.String())
+	}
+
+	printer := &recordingPrinter{}
+	logger.Set(printer)
+
+	logger.Debugf("%d", 1)
+	logger.Infof("%d", 2)
+	logger.Warnf("%d", 3)
+	logger.Errorf("%d", 4)
+
+	expected := []string{"debug 1", "info 2", "warn 3", "error 4"}
+	if strings.Join(printer.messages, ",") != strings.Join(expected, ",") {
+		t.Errorf("printer got %q; expected %q", printer.messages, expected)
+	}
+	if strings.Contains(buf.String(), "INFO") {
+		t.Errorf("writer got %q after the logger was replaced", buf.String())
+	}
+}
+
+// Replacing the logger while it is in use must not race, which go test -race tells
+func TestSwappableConcurrently(t *testing.T) {
+	logger := NewSwappable(&recordingPrinter{})
+
+	var wg sync.WaitGroup
+	for idx := 0; idx < 4; idx += 1 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for jdx := 0; jdx < 100; jdx += 1 {
+				logger.Infof("entry %d", jdx)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for jdx := 0; jdx < 100; jdx += 1 {
+				logger.Set(&recordingPrinter{})
+			}
+		}()
+	}
+	wg.Wait()
+}
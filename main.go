@@ -1,13 +1,20 @@
 package main
 
 import (
+	"context"
 	"os"
 
+	"github.com/pkg/errors"
+
 	"github.com/circle-makotom/orbs-sync/cmd"
 )
 
 func main() {
-	if cmd.Execute() != nil {
+	if err := cmd.Execute(); errors.Is(err, context.Canceled) {
+		os.Exit(cmd.ExitCodeCancelled)
+	} else if errors.Is(err, cmd.ErrIncomplete) {
+		os.Exit(cmd.ExitCodeIncomplete)
+	} else if err != nil {
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,276 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	atomicfile "github.com/circle-makotom/orbs-sync/atomic-file"
+)
+
+// Registry holds metric families and exposes them in the Prometheus text format
+// cf. https://prometheus.io/docs/instrumenting/exposition_formats/#text-based-format
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// Default is the registry every metric of orbs-sync is registered to
+var Default = NewRegistry()
+
+type kind string
+
+const (
+	kindCounter kind = "counter"
+	kindGauge   kind = "gauge"
+)
+
+// family is a metric with a set of label names, holding a value for each combination of label values
+type family struct {
+	name       string
+	help       string
+	kind       kind
+	labelNames []string
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+}
+
+func (r *Registry) register(name, help string, k kind, labelNames []string) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.families[name]; ok {
+		panic(fmt.Sprintf("metric %q is registered twice", name))
+	}
+
+	f := &family{name: name, help: help, kind: k, labelNames: labelNames, series: make(map[string]*series)}
+	r.families[name] = f
+
+	return f
+}
+
+// Apply the change to the value for the label values, creating the series if needed
+func (f *family) update(labelValues []string, change func(value float64) float64) {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("metric %q takes %d label value(s), but got %d", f.name, len(f.labelNames), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string{}, labelValues...)}
+		f.series[key] = s
+	}
+	s.value = change(s.value)
+}
+
+// CounterVec is a counter only going up, with a value for each combination of label values
+type CounterVec struct {
+	f *family
+}
+
+func (r *Registry) NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{f: r.register(name, help, kindCounter, labelNames)}
+}
+
+// Create a counter in the default registry
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	return Default.NewCounterVec(name, help, labelNames...)
+}
+
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic(fmt.Sprintf("counter %q cannot go down", c.f.name))
+	}
+
+	c.f.update(labelValues, func(value float64) float64 { return value + delta })
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// GaugeVec is a value going up and down, with a value for each combination of label values
+type GaugeVec struct {
+	f *family
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{f: r.register(name, help, kindGauge, labelNames)}
+}
+
+// Create a gauge in the default registry
+func NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	return Default.NewGaugeVec(name, help, labelNames...)
+}
+
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.f.update(labelValues, func(float64) float64 { return value })
+}
+
+func (g *GaugeVec) Add(delta float64, labelValues ...string) {
+	g.f.update(labelValues, func(value float64) float64 { return value + delta })
+}
+
+// Set the gauge to the time elapsed since the given time in seconds
+func (g *GaugeVec) SetSince(startedAt time.Time, labelValues ...string) {
+	g.Set(time.Since(startedAt).Seconds(), labelValues...)
+}
+
+// Set the gauge to the time in seconds since the epoch
+func (g *GaugeVec) SetTime(t time.Time, labelValues ...string) {
+	g.Set(float64(t.UnixNano())/1e9, labelValues...)
+}
+
+var (
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+func (f *family) write(buf *bytes.Buffer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Families without any series are omitted, as they tell nothing
+	if len(f.series) == 0 {
+		return
+	}
+
+	fmt.Fprintf(buf, "# HELP %s %s\n", f.name, helpEscaper.Replace(f.help))
+	fmt.Fprintf(buf, "# TYPE %s %s\n", f.name, f.kind)
+
+	// Series are in the order of label values, compared one by one so that a value comes before those it prefixes
+	sorted := []*series{}
+	for _, s := range f.series {
+		sorted = append(sorted, s)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		for idx := range sorted[i].labelValues {
+			if a, b := sorted[i].labelValues[idx], sorted[j].labelValues[idx]; a != b {
+				return a < b
+			}
+		}
+		return false
+	})
+
+	for _, s := range sorted {
+		buf.WriteString(f.name)
+		if len(f.labelNames) > 0 {
+			labels := []string{}
+			for idx, labelName := range f.labelNames {
+				labels = append(labels, fmt.Sprintf("%s=\"%s\"", labelName, labelValueEscaper.Replace(s.labelValues[idx])))
+			}
+			fmt.Fprintf(buf, "{%s}", strings.Join(labels, ","))
+		}
+		fmt.Fprintf(buf, " %s\n", formatValue(s.value))
+	}
+}
+
+// Write all the metrics in the text format, in the lexical order of names
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	names := []string{}
+	for name := range r.families {
+		names = append(names, name)
+	}
+	r.mu.Unlock()
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		r.mu.Lock()
+		f := r.families[name]
+		r.mu.Unlock()
+
+		f.write(&buf)
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Write all the metrics to the file for the textfile collector of the node exporter
+// The file is replaced atomically, as the collector may read it at any moment; its name must end with .prom to be collected
+func (r *Registry) WriteTextfile(filename string) error {
+	var buf bytes.Buffer
+	if err := r.WriteText(&buf); err != nil {
+		return err
+	}
+
+	return atomicfile.WriteFile(filename, buf.Bytes(), 0644)
+}
+
+// Return the handler serving all the metrics for scraping
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteText(w)
+	})
+}
+
+// Metrics shared by multiple packages
+var (
+	GraphQLRequests = NewCounterVec("orbs_sync_graphql_requests_total",
+		"GraphQL requests to CircleCI instances by the operation and the status, which is one of success, error and cancelled",
+		"operation", "status")
+
+	GraphQLRequestSeconds = NewCounterVec("orbs_sync_graphql_request_duration_seconds_total",
+		"Total time spent on GraphQL requests by the operation",
+		"operation")
+
+	OrbsIllegible = NewCounterVec("orbs_sync_orbs_illegible_total",
+		"Versioned orbs whose sources caused YAML parser errors, by the phase they were found in, which is either collect or resolve",
+		"phase")
+
+	PhaseDuration = NewGaugeVec("orbs_sync_phase_duration_seconds",
+		"Duration of the last run of each phase, which is one of collect, inventory, resolve, validate, import and verify",
+		"phase")
+
+	Runs = NewCounterVec("orbs_sync_runs_total",
+		"Finished runs by the command and the result, which is one of succeeded, failed, incomplete and cancelled",
+		"command", "result")
+
+	LastRunTimestamp = NewGaugeVec("orbs_sync_last_run_timestamp_seconds",
+		"Time when the last run by the command with the result finished, in seconds since the epoch",
+		"command", "result")
+)
+
+// Record a finished run of the command with the result
+func ObserveRun(command, result string, finishedAt time.Time) {
+	Runs.Inc(command, result)
+	LastRunTimestamp.SetTime(finishedAt, command, result)
+}
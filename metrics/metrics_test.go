@@ -0,0 +1,153 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	cases := []struct {
+		name     string
+		populate func(r *Registry)
+		expected string
+	}{
+		{
+			"empty registry",
+			func(r *Registry) {},
+			"",
+		},
+		{
+			"empty families are omitted",
+			func(r *Registry) {
+				r.NewCounterVec("test_unused_total", "Never incremented", "label")
+				r.NewGaugeVec("test_gauge", "A gauge").Set(1)
+			},
+			"# HELP test_gauge A gauge\n" +
+				"# TYPE test_gauge gauge\n" +
+				"test_gauge 1\n",
+		},
+		{
+			"families in the order of names and series in the order of label values",
+			func(r *Registry) {
+				counter := r.NewCounterVec("test_b_total", "Second", "status")
+				counter.Inc("success")
+				counter.Add(2, "error")
+				counter.Inc("success")
+
+				gauge := r.NewGaugeVec("test_a", "First", "phase", "kind")
+				gauge.Set(0.5, "resolve", "y")
+				gauge.Set(1.5, "collect", "z")
+				gauge.Set(2.5, "collect", "x")
+				gauge.Set(3.5, "collector", "a")
+			},
+			"# HELP test_a First\n" +
+				"# TYPE test_a gauge\n" +
+				"test_a{phase=\"collect\",kind=\"x\"} 2.5\n" +
+				"test_a{phase=\"collect\",kind=\"z\"} 1.5\n" +
+				"test_a{phase=\"collector\",kind=\"a\"} 3.5\n" +
+				"test_a{phase=\"resolve\",kind=\"y\"} 0.5\n" +
+				"# HELP test_b_total Second\n" +
+				"# TYPE test_b_total counter\n" +
+				"test_b_total{status=\"error\"} 2\n" +
+				"test_b_total{status=\"success\"} 2\n",
+		},
+		{
+			"escaping",
+			func(r *Registry) {
+				r.NewGaugeVec("test_escaped", "Help with \\ and\na new line, but \"quotes\" as-is", "ref").Set(1, "a\\b\n\"c\"")
+			},
+			"# HELP test_escaped Help with \\\\ and\\na new line, but \"quotes\" as-is\n" +
+				"# TYPE test_escaped gauge\n" +
+				"test_escaped{ref=\"a\\\\b\\n\\\"c\\\"\"} 1\n",
+		},
+		{
+			"special values",
+			func(r *Registry) {
+				gauge := r.NewGaugeVec("test_values", "Values", "value")
+				gauge.Set(math.Inf(1), "a")
+				gauge.Set(math.Inf(-1), "b")
+				gauge.Set(math.NaN(), "c")
+				gauge.Set(1e6, "d")
+				gauge.Set(-0.25, "e")
+				gauge.Add(0.1, "f")
+				gauge.Add(0.2, "f")
+			},
+			"# HELP test_values Values\n" +
+				"# TYPE test_values gauge\n" +
+				"test_values{value=\"a\"} +Inf\n" +
+				"test_values{value=\"b\"} -Inf\n" +
+				"test_values{value=\"c\"} NaN\n" +
+				"test_values{value=\"d\"} 1e+06\n" +
+				"test_values{value=\"e\"} -0.25\n" +
+				"test_values{value=\"f\"} 0.30000000000000004\n",
+		},
+	}
+
+	for _, c := range cases {
+		r := NewRegistry()
+		c.populate(r)
+
+		var buf bytes.Buffer
+		if err := r.WriteText(&buf); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+
+		if actual := buf.String(); actual != c.expected {
+			t.Errorf("%s: got\n%s\nexpected\n%s", c.name, actual, c.expected)
+		}
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("test_total", "A counter")
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a metric twice did not panic")
+		}
+	}()
+	r.NewGaugeVec("test_total", "A gauge")
+}
+
+func TestWrongLabelValues(t *testing.T) {
+	gauge := NewRegistry().NewGaugeVec("test_gauge", "A gauge", "label")
+
+	defer func() {
+		if recover() == nil {
+			t.Error("setting a gauge with wrong label values did not panic")
+		}
+	}()
+	gauge.Set(1)
+}
+
+func TestWriteTextfileAndHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("test_total", "A counter").Inc()
+	expected := "# HELP test_total A counter\n# TYPE test_total counter\ntest_total 1\n"
+
+	filename := filepath.Join(t.TempDir(), "orbs-sync.prom")
+	if err := r.WriteTextfile(filename); err != nil {
+		t.Fatal(err)
+	}
+	if contents, err := ioutil.ReadFile(filename); err != nil {
+		t.Error(err)
+	} else if string(contents) != expected {
+		t.Errorf("textfile contains\n%s\nexpected\n%s", contents, expected)
+	}
+
+	recorder := httptest.NewRecorder()
+	r.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("Content-Type = %q; expected the text format", contentType)
+	}
+	if body := recorder.Body.String(); body != expected {
+		t.Errorf("handler served\n%s\nexpected\n%s", body, expected)
+	}
+}
@@ -0,0 +1,258 @@
+package nsmapper
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+
+	"github.com/circle-makotom/orbs-sync/logging"
+	"github.com/circle-makotom/orbs-sync/types"
+)
+
+var logger = logging.NewSwappable(logging.New("namespace-mapper"))
+
+// Replace the logger of the mapper, e.g., to route entries on rewritten orb sources to the logger of the programme using it
+func SetLogger(l logging.Printer) {
+	logger.Set(l)
+}
+
+// Mapping maps namespaces on the source to those on the destination, e.g., circleci => mirror-circleci
+type Mapping map[string]string
+
+// Build a mapping from pairs of namespaces, ensuring that no two namespaces are mapped to the same one
+func NewMapping(pairs map[string]string) (Mapping, error) {
+	ret := make(Mapping)
+	mappedFrom := make(map[string]string)
+
+	for from, to := range pairs {
+		if from == "" || to == "" || strings.Contains(from, "/") || strings.Contains(to, "/") {
+			return nil, errors.Errorf("invalid namespace mapping %q => %q", from, to)
+		}
+
+		if another, exists := mappedFrom[to]; exists {
+			return nil, errors.Errorf("both %q and %q are mapped to %q", another, from, to)
+		}
+
+		ret[from] = to
+		mappedFrom[to] = from
+	}
+
+	return ret, nil
+}
+
+func (m Mapping) lookup(ref string, reverse bool) string {
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) < 2 {
+		return ref
+	}
+
+	if !reverse {
+		if to, ok := m[parts[0]]; ok {
+			return to + "/" + parts[1]
+		}
+	} else {
+		for from, to := range m {
+			if to == parts[0] {
+				return from + "/" + parts[1]
+			}
+		}
+	}
+
+	return ref
+}
+
+// Map the namespace of an orb name or an orb ref; return it as-is if the namespace is not mapped
+func (m Mapping) MapRef(ref string) string {
+	return m.lookup(ref, false)
+}
+
+// Map an orb name or an orb ref on the destination back to that on the source
+func (m Mapping) UnmapRef(ref string) string {
+	return m.lookup(ref, true)
+}
+
+func (m Mapping) MapRefs(refs []string) []string {
+	ret := []string{}
+
+	for _, ref := range refs {
+		ret = append(ret, m.MapRef(ref))
+	}
+
+	return ret
+}
+
+func (m Mapping) UnmapRefs(refs []string) []string {
+	ret := []string{}
+
+	for _, ref := range refs {
+		ret = append(ret, m.UnmapRef(ref))
+	}
+
+	return ret
+}
+
+// Map orb names of the popularity statistics
+func (m Mapping) MapPopularity(popularity map[string]int) map[string]int {
+	ret := make(map[string]int)
+
+	for name, count := range popularity {
+		ret[m.MapRef(name)] = count
+	}
+
+	return ret
+}
+
+// Map refs of orbs mapped to their dependency levels; nil is kept nil, as it means that levels are unknown
+func (m Mapping) MapLevels(levelOf map[string]int) map[string]int {
+	if levelOf == nil {
+		return nil
+	}
+
+	ret := make(map[string]int)
+
+	for orbRef, level := range levelOf {
+		ret[m.MapRef(orbRef)] = level
+	}
+
+	return ret
+}
+
+// Collect scalar nodes of orb refs in `orbs:`, including those imported by inline orbs
+func collectOrbRefNodes(node *yaml.Node) []*yaml.Node {
+	ret := []*yaml.Node{}
+
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	if node.Kind != yaml.MappingNode {
+		return ret
+	}
+
+	for idx := 0; idx+1 < len(node.Content); idx += 2 {
+		if node.Content[idx].Value != "orbs" || node.Content[idx+1].Kind != yaml.MappingNode {
+			continue
+		}
+
+		orbsNode := node.Content[idx+1]
+		for jdx := 1; jdx < len(orbsNode.Content); jdx += 2 {
+			switch value := orbsNode.Content[jdx]; value.Kind {
+			case yaml.ScalarNode:
+				ret = append(ret, value)
+			case yaml.MappingNode:
+				ret = append(ret, collectOrbRefNodes(value)...)
+			}
+		}
+	}
+
+	return ret
+}
+
+// Rewrite the namespace of a scalar in place, leaving the rest of the source untouched
+// Return false if the scalar is not found where the parser says, e.g., because of tags or escapes
+func spliceNamespace(lines [][]rune, node *yaml.Node, from, to string) bool {
+	if node.Line < 1 || node.Line > len(lines) || node.Column < 1 {
+		return false
+	}
+
+	line := lines[node.Line-1]
+	pos := node.Column - 1
+	if node.Style&(yaml.SingleQuotedStyle|yaml.DoubleQuotedStyle) != 0 {
+		pos += 1
+	}
+
+	prefix := []rune(from + "/")
+	if pos+len(prefix) > len(line) || string(line[pos:pos+len(prefix)]) != string(prefix) {
+		return false
+	}
+
+	spliced := append([]rune{}, line[:pos]...)
+	spliced = append(spliced, []rune(to+"/")...)
+	lines[node.Line-1] = append(spliced, line[pos+len(prefix):]...)
+
+	return true
+}
+
+// Rewrite references to orbs in mapped namespaces in the given orb source
+// The source is kept as-is except the namespaces, unless it cannot be rewritten in place; it is re-encoded in that case
+func (m Mapping) MapSource(orbSrc string) (string, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(orbSrc), &doc); err != nil {
+		return "", err
+	}
+
+	lines := [][]rune{}
+	for _, line := range strings.Split(orbSrc, "\n") {
+		lines = append(lines, []rune(line))
+	}
+
+	nodes := collectOrbRefNodes(&doc)
+
+	// Nodes are processed from the end so that columns of preceding nodes on the same line stay valid
+	inPlace := true
+	for idx := len(nodes) - 1; idx >= 0; idx -= 1 {
+		node := nodes[idx]
+
+		mapped := m.MapRef(node.Value)
+		if mapped == node.Value {
+			continue
+		}
+
+		from := strings.SplitN(node.Value, "/", 2)[0]
+		inPlace = inPlace && spliceNamespace(lines, node, from, m[from])
+		node.Value = mapped
+	}
+
+	if inPlace {
+		contents := []string{}
+		for _, line := range lines {
+			contents = append(contents, string(line))
+		}
+
+		return strings.Join(contents, "\n"), nil
+	}
+
+	reencoded, err := yaml.Marshal(&doc)
+	if err != nil {
+		return "", err
+	}
+
+	return string(reencoded), nil
+}
+
+// Map orbs to those in namespaces on the destination, rewriting their sources as well
+// Sources which cannot be parsed are kept as-is, as the dependency resolver will report them anyway
+func (m Mapping) MapOrbs(orbs []*types.VersionedOrb) ([]*types.VersionedOrb, error) {
+	if len(m) == 0 {
+		return orbs, nil
+	}
+
+	ret := []*types.VersionedOrb{}
+	mappedFrom := make(map[string]string)
+
+	for _, orb := range orbs {
+		mappedRef := m.MapRef(orb.Ref)
+
+		if another, exists := mappedFrom[mappedRef]; exists && another != orb.Ref {
+			return nil, errors.Errorf("both %q and %q are mapped to %q", another, orb.Ref, mappedRef)
+		}
+		mappedFrom[mappedRef] = orb.Ref
+
+		mappedSrc, err := m.MapSource(orb.Source)
+		if err != nil {
+			logger.Warnf("could not rewrite references in %q; keeping its source as-is: %v", orb.Ref, err)
+			mappedSrc = orb.Source
+		}
+
+		ret = append(ret, &types.VersionedOrb{
+			Ref:     mappedRef,
+			Name:    m.MapRef(orb.Name),
+			Version: orb.Version,
+			Source:  mappedSrc,
+		})
+	}
+
+	logger.Infof("mapped namespaces of %d orb(s)", len(ret))
+
+	return ret, nil
+}
@@ -0,0 +1,148 @@
+package nsmapper
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestMapSource(t *testing.T) {
+	mapping, err := NewMapping(map[string]string{"circleci": "mirror-circleci", "ns": "mirror-ns"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		source   string
+		expected string
+	}{
+		{
+			"block mapping",
+			"version: 2.1\norbs:\n  node: circleci/node@5.0.0 # keep circleci/node@5.0.0 in comments\n  other: other/orb@1\ndescription: uses circleci/node@5\n",
+			"version: 2.1\norbs:\n  node: mirror-circleci/node@5.0.0 # keep circleci/node@5.0.0 in comments\n  other: other/orb@1\ndescription: uses circleci/node@5\n",
+		},
+		{
+			"quoted refs",
+			"orbs:\n  node: \"circleci/node@5\"\n  slack: 'circleci/slack@4.1'\n",
+			"orbs:\n  node: \"mirror-circleci/node@5\"\n  slack: 'mirror-circleci/slack@4.1'\n",
+		},
+		{
+			"flow mapping",
+			"orbs: {node: circleci/node@5, util: \"ns/util@1.2.3\", other: other/orb@1}\n",
+			"orbs: {node: mirror-circleci/node@5, util: \"mirror-ns/util@1.2.3\", other: other/orb@1}\n",
+		},
+		{
+			"same ref twice on a line",
+			"orbs: {a: circleci/node@5, b: circleci/node@5}\n",
+			"orbs: {a: mirror-circleci/node@5, b: mirror-circleci/node@5}\n",
+		},
+		{
+			"inline orb",
+			"orbs:\n  inline:\n    orbs:\n      node: circleci/node@5\n    commands:\n      hello:\n        steps: [run: echo circleci/node@5]\n",
+			"orbs:\n  inline:\n    orbs:\n      node: mirror-circleci/node@5\n    commands:\n      hello:\n        steps: [run: echo circleci/node@5]\n",
+		},
+		{
+			"multibyte characters",
+			"description: 日本語の説明\norbs: {説明: circleci/node@5, ユーティリティ: ns/util@1}\n",
+			"description: 日本語の説明\norbs: {説明: mirror-circleci/node@5, ユーティリティ: mirror-ns/util@1}\n",
+		},
+		{
+			"nothing to map",
+			"version: 2.1\norbs:\n  other: other/orb@1\n",
+			"version: 2.1\norbs:\n  other: other/orb@1\n",
+		},
+	}
+
+	for _, c := range cases {
+		actual, err := mapping.MapSource(c.source)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if actual != c.expected {
+			t.Errorf("%s: MapSource(%q) = %q; expected %q", c.name, c.source, actual, c.expected)
+		}
+	}
+
+	if _, err := mapping.MapSource("orbs: [unterminated"); err == nil {
+		t.Errorf("MapSource of an illegible source succeeded; expected an error")
+	}
+}
+
+// Sources which cannot be rewritten in place are re-encoded with namespaces mapped
+func TestMapSourceReencoded(t *testing.T) {
+	mapping, err := NewMapping(map[string]string{"circleci": "mirror-circleci"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := "orbs:\n  node: !!str circleci/node@5\n  escaped: \"\\x63ircleci/node@5\"\n"
+	expected := "orbs:\n    node: !!str mirror-circleci/node@5\n    escaped: \"mirror-circleci/node@5\"\n"
+
+	if actual, err := mapping.MapSource(source); err != nil {
+		t.Error(err)
+	} else if actual != expected {
+		t.Errorf("MapSource(%q) = %q; expected %q", source, actual, expected)
+	}
+}
+
+func TestSpliceNamespace(t *testing.T) {
+	toLines := func(lines ...string) [][]rune {
+		ret := [][]rune{}
+		for _, line := range lines {
+			ret = append(ret, []rune(line))
+		}
+		return ret
+	}
+
+	cases := []struct {
+		name     string
+		line     string
+		column   int
+		quoted   bool
+		expected string
+		ok       bool
+	}{
+		{"plain", "  node: circleci/node@5", 9, false, "  node: mirror-circleci/node@5", true},
+		{"quoted", "  node: \"circleci/node@5\"", 9, true, "  node: \"mirror-circleci/node@5\"", true},
+		{"second on a line", "{a: circleci/node@5, b: circleci/node@5}", 25, false, "{a: circleci/node@5, b: mirror-circleci/node@5}", true},
+		{"multibyte characters", "{説明: circleci/node@5}", 6, false, "{説明: mirror-circleci/node@5}", true},
+		{"column off", "  node: circleci/node@5", 8, false, "  node: circleci/node@5", false},
+		{"column beyond the line", "  node: circleci/node@5", 40, false, "  node: circleci/node@5", false},
+		{"namespace mismatch", "  node: circle/node@5", 9, false, "  node: circle/node@5", false},
+	}
+
+	for _, c := range cases {
+		node := &yaml.Node{Kind: yaml.ScalarNode, Line: 2, Column: c.column}
+		if c.quoted {
+			node.Style = yaml.DoubleQuotedStyle
+		}
+
+		lines := toLines("orbs:", c.line)
+		ok := spliceNamespace(lines, node, "circleci", "mirror-circleci")
+		if actual := string(lines[1]); actual != c.expected || ok != c.ok {
+			t.Errorf("%s: spliceNamespace(%q) = (%q, %v); expected (%q, %v)", c.name, c.line, actual, ok, c.expected, c.ok)
+		}
+	}
+
+	if spliceNamespace(toLines("orbs:"), &yaml.Node{Kind: yaml.ScalarNode, Line: 3, Column: 1}, "circleci", "mirror-circleci") {
+		t.Errorf("spliceNamespace succeeded beyond the last line")
+	}
+}
+
+func TestNewMapping(t *testing.T) {
+	cases := []struct {
+		pairs map[string]string
+		valid bool
+	}{
+		{map[string]string{"circleci": "mirror-circleci", "ns": "mirror-ns"}, true},
+		{map[string]string{"circleci": "mirror", "ns": "mirror"}, false},
+		{map[string]string{"circleci": ""}, false},
+		{map[string]string{"circleci/node": "mirror"}, false},
+	}
+
+	for _, c := range cases {
+		if _, err := NewMapping(c.pairs); (err == nil) != c.valid {
+			t.Errorf("NewMapping(%q) returned %v; expected valid: %v", c.pairs, err, c.valid)
+		}
+	}
+}
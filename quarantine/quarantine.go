@@ -0,0 +1,168 @@
+package quarantine
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	circleapi "github.com/CircleCI-Public/circleci-cli/api"
+	circleql "github.com/CircleCI-Public/circleci-cli/api/graphql"
+
+	apicall "github.com/circle-makotom/orbs-sync/api-call"
+	atomicfile "github.com/circle-makotom/orbs-sync/atomic-file"
+	"github.com/circle-makotom/orbs-sync/logging"
+)
+
+var logger = logging.NewSwappable(logging.New("quarantine"))
+
+// Replace the logger of the quarantine, e.g., to route entries on expired and released orbs to the logger of the programme using it
+func SetLogger(l logging.Printer) {
+	logger.Set(l)
+}
+
+// Entry records an orb dropped because of a failure which would never go away on the same server version
+type Entry struct {
+	Ref           string    `json:"ref"`
+	Category      string    `json:"category"`
+	ServerVersion string    `json:"serverVersion"`
+	QuarantinedAt time.Time `json:"quarantinedAt"`
+	ExpiresAt     time.Time `json:"expiresAt"`
+}
+
+// Active entries are those not expired yet and recorded against the same server version
+func (e *Entry) IsActive(serverVersion string, now time.Time) bool {
+	return e.ServerVersion == serverVersion && now.Before(e.ExpiresAt)
+}
+
+type Quarantine struct {
+	Entries []*Entry `json:"entries"`
+}
+
+// Load the quarantine from the file; return an empty one if the file does not exist
+func Load(filename string) (*Quarantine, error) {
+	q := &Quarantine{Entries: []*Entry{}}
+
+	contents, err := ioutil.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(contents, q); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+func (q *Quarantine) Save(filename string) error {
+	contents, err := json.MarshalIndent(q, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.WriteFile(filename, contents, 0644)
+}
+
+// Return refs of active entries
+func (q *Quarantine) ActiveRefs(serverVersion string) []string {
+	ret := []string{}
+	now := time.Now()
+
+	for _, entry := range q.Entries {
+		if entry.IsActive(serverVersion, now) {
+			ret = append(ret, entry.Ref)
+		}
+	}
+
+	return ret
+}
+
+// Drop inactive entries, so that those orbs are retried
+func (q *Quarantine) Prune(serverVersion string) {
+	active := []*Entry{}
+	now := time.Now()
+
+	for _, entry := range q.Entries {
+		if entry.IsActive(serverVersion, now) {
+			active = append(active, entry)
+		} else {
+			logger.Infof("releasing %q from quarantine", entry.Ref)
+		}
+	}
+
+	q.Entries = active
+}
+
+// Quarantine an orb, or renew the entry if it is quarantined already
+func (q *Quarantine) Add(ref, category, serverVersion string, ttl time.Duration) {
+	now := time.Now()
+	entry := &Entry{
+		Ref:           ref,
+		Category:      category,
+		ServerVersion: serverVersion,
+		QuarantinedAt: now,
+		ExpiresAt:     now.Add(ttl),
+	}
+
+	for idx, existing := range q.Entries {
+		if existing.Ref == ref {
+			q.Entries[idx] = entry
+			return
+		}
+	}
+
+	logger.Infof("quarantining %q (%s)", ref, category)
+	q.Entries = append(q.Entries, entry)
+}
+
+func (q *Quarantine) Remove(ref string) {
+	for idx, entry := range q.Entries {
+		if entry.Ref == ref {
+			logger.Infof("releasing %q from quarantine", ref)
+			q.Entries = append(q.Entries[:idx], q.Entries[idx+1:]...)
+			return
+		}
+	}
+}
+
+// Fingerprint the server version by the GraphQL schema, as servers do not tell their versions
+// Any change in types or fields of the schema is regarded as a new server version
+func FetchServerVersion(ctx context.Context, cl *circleql.Client) (string, error) {
+	var response *circleapi.IntrospectionResponse
+	err := apicall.Run(ctx, "IntrospectionQuery", func() (err error) {
+		response, err = circleapi.IntrospectionQuery(cl)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	lines := []string{}
+	for _, schemaType := range response.Schema.Types {
+		fields := []string{}
+		for _, field := range schemaType.Fields {
+			fields = append(fields, field.Name)
+		}
+		sort.Strings(fields)
+
+		lines = append(lines, fmt.Sprintf("%s %s %q %s", schemaType.Kind, schemaType.Name, schemaType.Description, strings.Join(fields, ",")))
+	}
+	sort.Strings(lines)
+
+	return fmt.Sprintf("schema-%x", sha256.Sum256([]byte(strings.Join(lines, "\n"))))[:len("schema-")+16], nil
+}
+
+func FetchServerVersionWithNewClient(ctx context.Context, hostname, apiEndpoint, token string, debug bool) (string, error) {
+	return FetchServerVersion(ctx, circleql.NewClient(&http.Client{}, hostname, apiEndpoint, token, debug))
+}
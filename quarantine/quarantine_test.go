@@ -0,0 +1,182 @@
+package quarantine
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	circleql "github.com/CircleCI-Public/circleci-cli/api/graphql"
+
+	"github.com/circle-makotom/orbs-sync/logging"
+)
+
+func init() {
+	SetLogger(logging.NewWithWriter("quarantine", ioutil.Discard, logging.FormatText, logging.LevelError))
+}
+
+func TestIsActive(t *testing.T) {
+	now := time.Date(2021, 12, 1, 0, 0, 0, 0, time.UTC)
+	entry := &Entry{Ref: "ns/orb@1.0.0", ServerVersion: "v1", QuarantinedAt: now.Add(-time.Hour), ExpiresAt: now.Add(time.Hour)}
+
+	cases := []struct {
+		name          string
+		serverVersion string
+		now           time.Time
+		active        bool
+	}{
+		{"within the TTL", "v1", now, true},
+		{"right before the expiry", "v1", now.Add(time.Hour - time.Nanosecond), true},
+		{"at the expiry", "v1", now.Add(time.Hour), false},
+		{"after the expiry", "v1", now.Add(2 * time.Hour), false},
+		{"on another server version", "v2", now, false},
+	}
+
+	for _, c := range cases {
+		if active := entry.IsActive(c.serverVersion, c.now); active != c.active {
+			t.Errorf("%s: active = %t; expected %t", c.name, active, c.active)
+		}
+	}
+}
+
+// Entries expired or recorded against other server versions are released, so that those orbs are retried
+func TestPrune(t *testing.T) {
+	now := time.Now()
+	q := &Quarantine{Entries: []*Entry{
+		{Ref: "ns/active@1.0.0", ServerVersion: "v1", ExpiresAt: now.Add(time.Hour)},
+		{Ref: "ns/expired@1.0.0", ServerVersion: "v1", ExpiresAt: now.Add(-time.Second)},
+		{Ref: "ns/upgraded@1.0.0", ServerVersion: "v0", ExpiresAt: now.Add(time.Hour)},
+	}}
+
+	if refs := q.ActiveRefs("v1"); !reflect.DeepEqual(refs, []string{"ns/active@1.0.0"}) {
+		t.Errorf("active = %q; expected only the active entry", refs)
+	}
+
+	q.Prune("v1")
+	if len(q.Entries) != 1 || q.Entries[0].Ref != "ns/active@1.0.0" {
+		t.Errorf("%d entries left after pruning; expected only the active one", len(q.Entries))
+	}
+
+	// All of them go away once the server version changes
+	q.Prune("v2")
+	if len(q.Entries) != 0 {
+		t.Errorf("%d entries left after the server version changed", len(q.Entries))
+	}
+}
+
+func TestAddAndRemove(t *testing.T) {
+	q := &Quarantine{Entries: []*Entry{}}
+
+	q.Add("ns/a@1.0.0", "unsupported-syntax", "v1", time.Hour)
+	q.Add("ns/b@1.0.0", "size-limit", "v1", time.Hour)
+	if refs := q.ActiveRefs("v1"); !reflect.DeepEqual(refs, []string{"ns/a@1.0.0", "ns/b@1.0.0"}) {
+		t.Fatalf("active = %q; expected both orbs", refs)
+	}
+
+	// Adding an orb again renews the entry rather than duplicating it
+	q.Add("ns/a@1.0.0", "size-limit", "v2", time.Hour)
+	if len(q.Entries) != 2 || q.Entries[0].Category != "size-limit" || q.Entries[0].ServerVersion != "v2" {
+		t.Errorf("entries after renewal = %+v, %+v; expected the first one renewed", q.Entries[0], q.Entries[1])
+	}
+
+	q.Remove("ns/a@1.0.0")
+	q.Remove("ns/missing@1.0.0")
+	if refs := q.ActiveRefs("v1"); !reflect.DeepEqual(refs, []string{"ns/b@1.0.0"}) {
+		t.Errorf("active = %q after the removal; expected the other orb", refs)
+	}
+}
+
+func TestLoadAndSave(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "orbs-quarantine.json")
+
+	q, err := Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(q.Entries) != 0 {
+		t.Errorf("loaded %d entries from a missing file; expected none", len(q.Entries))
+	}
+
+	q.Add("ns/a@1.0.0", "unsupported-syntax", "v1", time.Hour)
+	if err := q.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Entries) != 1 || loaded.Entries[0].Ref != "ns/a@1.0.0" || !loaded.Entries[0].ExpiresAt.Equal(q.Entries[0].ExpiresAt) {
+		t.Errorf("loaded %+v; expected the saved entry", loaded.Entries)
+	}
+
+	if err := ioutil.WriteFile(filename, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(filename); err == nil {
+		t.Error("a broken file was loaded")
+	}
+}
+
+// Serve the schema with types mapped to their fields, or fail with the status if not 200
+func newSchemaServer(t *testing.T, status int, types map[string][]string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+
+		schemaTypes := []map[string]interface{}{}
+		for name, fieldNames := range types {
+			fields := []map[string]string{}
+			for _, fieldName := range fieldNames {
+				fields = append(fields, map[string]string{"name": fieldName})
+			}
+			schemaTypes = append(schemaTypes, map[string]interface{}{"kind": "OBJECT", "name": name, "description": "", "fields": fields})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"__schema": map[string]interface{}{"types": schemaTypes}}})
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func fetchTestServerVersion(server *httptest.Server) (string, error) {
+	return FetchServerVersion(context.Background(), circleql.NewClient(server.Client(), server.URL, "graphql-unstable", "token", false))
+}
+
+func TestFetchServerVersion(t *testing.T) {
+	version, err := fetchTestServerVersion(newSchemaServer(t, http.StatusOK, map[string][]string{"Orb": {"id", "name"}, "Namespace": {"id"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The order of types and fields does not matter
+	same, err := fetchTestServerVersion(newSchemaServer(t, http.StatusOK, map[string][]string{"Namespace": {"id"}, "Orb": {"name", "id"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same != version {
+		t.Errorf("got %q and %q for the same schema", version, same)
+	}
+
+	// A new field is a new server version
+	upgraded, err := fetchTestServerVersion(newSchemaServer(t, http.StatusOK, map[string][]string{"Orb": {"id", "name", "statistics"}, "Namespace": {"id"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upgraded == version {
+		t.Errorf("got %q for a schema with a new field; expected another version", upgraded)
+	}
+
+	if _, err := fetchTestServerVersion(newSchemaServer(t, http.StatusInternalServerError, nil)); err == nil {
+		t.Error("the server version was fingerprinted without the schema")
+	}
+}
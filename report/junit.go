@@ -0,0 +1,160 @@
+package report
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+
+	atomicfile "github.com/circle-makotom/orbs-sync/atomic-file"
+	bulkimporter "github.com/circle-makotom/orbs-sync/bulk-importer"
+)
+
+// JUnit XML in the common form understood by CircleCI and other CI tools
+type junitTestSuites struct {
+	XMLName  xml.Name          `xml:"testsuites"`
+	Name     string            `xml:"name,attr"`
+	Tests    int               `xml:"tests,attr"`
+	Failures int               `xml:"failures,attr"`
+	Skipped  int               `xml:"skipped,attr"`
+	Time     string            `xml:"time,attr"`
+	Suites   []*junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string           `xml:"name,attr"`
+	Tests     int              `xml:"tests,attr"`
+	Failures  int              `xml:"failures,attr"`
+	Skipped   int              `xml:"skipped,attr"`
+	Time      string           `xml:"time,attr"`
+	Timestamp string           `xml:"timestamp,attr"`
+	TestCases []*junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+func formatSeconds(seconds float64) string {
+	return fmt.Sprintf("%.3f", seconds)
+}
+
+// Describe why the orb failed in detail, for the body of the failure
+func (entry *Entry) failureDetail() string {
+	lines := []string{fmt.Sprintf("status: %s", entry.Status)}
+
+	if entry.Category != "" {
+		lines = append(lines, fmt.Sprintf("category: %s", entry.Category))
+	}
+	if entry.Dependency != "" {
+		lines = append(lines, fmt.Sprintf("dependency: %s", entry.Dependency))
+	}
+	if entry.Attempts > 0 {
+		lines = append(lines, fmt.Sprintf("attempts: %d", entry.Attempts))
+	}
+	if entry.LastError != "" {
+		lines = append(lines, fmt.Sprintf("error: %s", entry.LastError))
+	}
+	if entry.VerificationDetail != "" {
+		lines = append(lines, fmt.Sprintf("verification: %s", entry.VerificationDetail))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Turn the entry into a test case; orbs not available in the end fail, and remaining ones are skipped
+func (entry *Entry) junitTestCase() *junitTestCase {
+	testCase := &junitTestCase{
+		ClassName: strings.Split(entry.Ref, "@")[0],
+		Name:      entry.Ref,
+		Time:      formatSeconds(entry.DurationSeconds),
+	}
+
+	switch entry.Status {
+	case StatusDropped, StatusSkipped, StatusUnresolved, StatusIllegible:
+		message := entry.LastError
+		if message == "" {
+			message = string(entry.Status)
+		}
+
+		failureType := entry.Category
+		if failureType == "" {
+			failureType = string(entry.Status)
+		}
+
+		testCase.Failure = &junitFailure{Message: message, Type: failureType, Text: entry.failureDetail()}
+	case StatusRemaining:
+		testCase.Skipped = &junitSkipped{Message: "not attempted because of the deadline or cancellation"}
+	default:
+		// Imported orbs not matching on the destination fail as well
+		if entry.Verification == string(bulkimporter.Mismatched) {
+			testCase.Failure = &junitFailure{Message: entry.VerificationDetail, Type: entry.Verification, Text: entry.failureDetail()}
+		} else {
+			testCase.SystemOut = fmt.Sprintf("status: %s", entry.Status)
+		}
+	}
+
+	return testCase
+}
+
+// Render the report in the JUnit XML format, with a test case for each orb in a test suite of the given name
+// Dropped, skipped, unresolved and illegible orbs are failures, and remaining ones are skipped
+func (r *Report) JUnit(suiteName string) ([]byte, error) {
+	suite := &junitTestSuite{
+		Name:      suiteName,
+		Time:      formatSeconds(r.FinishedAt.Sub(r.StartedAt).Seconds()),
+		Timestamp: r.StartedAt.Format("2006-01-02T15:04:05"),
+		TestCases: []*junitTestCase{},
+	}
+
+	for _, entry := range r.Orbs {
+		testCase := entry.junitTestCase()
+
+		suite.Tests += 1
+		if testCase.Failure != nil {
+			suite.Failures += 1
+		}
+		if testCase.Skipped != nil {
+			suite.Skipped += 1
+		}
+
+		suite.TestCases = append(suite.TestCases, testCase)
+	}
+
+	contents, err := xml.MarshalIndent(&junitTestSuites{
+		Name:     suiteName,
+		Tests:    suite.Tests,
+		Failures: suite.Failures,
+		Skipped:  suite.Skipped,
+		Time:     suite.Time,
+		Suites:   []*junitTestSuite{suite},
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), append(contents, '\n')...), nil
+}
+
+func (r *Report) WriteJUnitFile(filename, suiteName string) error {
+	contents, err := r.JUnit(suiteName)
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.WriteFile(filename, contents, 0644)
+}
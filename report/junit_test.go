@@ -0,0 +1,67 @@
+package report
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func TestJUnit(t *testing.T) {
+	contents, err := newTestReport().JUnit("sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertGolden(t, "junit.xml", contents)
+}
+
+// Test cases are named after orb refs and classified by orb names; unverified orbs pass, as they may well match
+func TestJUnitTestCases(t *testing.T) {
+	contents, err := newTestReport().JUnit("sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var parsed junitTestSuites
+	if err := xml.Unmarshal(contents, &parsed); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"ns/present@1.0.0":    "passed",
+		"ns/illegible@1.0.0":  "failed",
+		"ns/unresolved@1.0.0": "failed",
+		"ns/imported@1.0.0":   "passed",
+		"ns/mismatched@1.0.0": "failed",
+		"ns/unverified@1.0.0": "passed",
+		"ns/dropped@1.0.0":    "failed",
+		"ns/skipped@1.0.0":    "failed",
+		"ns/remaining@1.0.0":  "skipped",
+	}
+
+	if len(parsed.Suites) != 1 || len(parsed.Suites[0].TestCases) != len(expected) {
+		t.Fatalf("got %d suite(s); expected one with %d test cases", len(parsed.Suites), len(expected))
+	}
+	if parsed.Tests != 9 || parsed.Failures != 5 || parsed.Skipped != 1 {
+		t.Errorf("counted %d tests, %d failures and %d skipped; expected 9, 5 and 1", parsed.Tests, parsed.Failures, parsed.Skipped)
+	}
+
+	for _, testCase := range parsed.Suites[0].TestCases {
+		outcome := "passed"
+		switch {
+		case testCase.Failure != nil && testCase.Skipped != nil:
+			outcome = "failed and skipped"
+		case testCase.Failure != nil:
+			outcome = "failed"
+		case testCase.Skipped != nil:
+			outcome = "skipped"
+		}
+
+		if outcome != expected[testCase.Name] {
+			t.Errorf("%s %s; expected %s", testCase.Name, outcome, expected[testCase.Name])
+		}
+		if testCase.ClassName != strings.TrimSuffix(testCase.Name, "@1.0.0") {
+			t.Errorf("%s is classified by %q; expected the orb name", testCase.Name, testCase.ClassName)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	atomicfile "github.com/circle-makotom/orbs-sync/atomic-file"
+	bulkimporter "github.com/circle-makotom/orbs-sync/bulk-importer"
+)
+
+type Status string
+
+const (
+	StatusAlreadyPresent Status = Status(bulkimporter.StatusAlreadyPresent)
+	StatusImported       Status = Status(bulkimporter.StatusImported)
+	StatusDropped        Status = Status(bulkimporter.StatusDropped)
+	StatusSkipped        Status = Status(bulkimporter.StatusSkipped)
+	StatusUnresolved     Status = "unresolved"
+	StatusIllegible      Status = "illegible"
+
+	// Orbs are remaining if the import stopped at the deadline before attempting them
+	StatusRemaining Status = "remaining"
+
+	// Orbs are resolved if their dependencies are resolved, before any import
+	StatusResolved Status = "resolved"
+)
+
+// Entry describes what happened to an orb
+type Entry struct {
+	Ref      string `json:"ref"`
+	Status   Status `json:"status"`
+	Attempts int    `json:"attempts"`
+
+	// LastError and Category are given if the orb is not available in the end
+	LastError string `json:"lastError,omitempty"`
+	Category  string `json:"category,omitempty"`
+
+	// Dependency is the dropped dependency for skipped orbs, or the first unresolvable one for unresolved orbs
+	Dependency string `json:"dependency,omitempty"`
+
+	DurationSeconds  float64 `json:"durationSeconds"`
+	NamespaceCreated bool    `json:"namespaceCreated"`
+	OrbCreated       bool    `json:"orbCreated"`
+
+	// Verification and VerificationDetail are given for imported orbs if they are verified
+	Verification       string `json:"verification,omitempty"`
+	VerificationDetail string `json:"verificationDetail,omitempty"`
+}
+
+type Report struct {
+	StartedAt  time.Time      `json:"startedAt"`
+	FinishedAt time.Time      `json:"finishedAt"`
+	Summary    map[Status]int `json:"summary"`
+	Orbs       []*Entry       `json:"orbs"`
+
+	entries map[string]*Entry
+}
+
+func New() *Report {
+	return &Report{
+		StartedAt: time.Now(),
+		Summary:   make(map[Status]int),
+		Orbs:      []*Entry{},
+		entries:   make(map[string]*Entry),
+	}
+}
+
+// Add an entry, overwriting the existing one for the same orb
+func (r *Report) add(entry *Entry) {
+	if existing, ok := r.entries[entry.Ref]; ok {
+		*existing = *entry
+		return
+	}
+
+	r.entries[entry.Ref] = entry
+	r.Orbs = append(r.Orbs, entry)
+}
+
+func (r *Report) AddAlreadyPresent(orbRefs []string) {
+	for _, orbRef := range orbRefs {
+		r.add(&Entry{Ref: orbRef, Status: StatusAlreadyPresent})
+	}
+}
+
+func (r *Report) AddResolved(orbRefs []string) {
+	for _, orbRef := range orbRefs {
+		r.add(&Entry{Ref: orbRef, Status: StatusResolved})
+	}
+}
+
+func (r *Report) AddIllegible(orbRefs []string) {
+	for _, orbRef := range orbRefs {
+		r.add(&Entry{Ref: orbRef, Status: StatusIllegible, LastError: "could not parse the orb source"})
+	}
+}
+
+func (r *Report) AddUnresolved(unresolvedMap map[string][]string) {
+	orbRefs := []string{}
+	for orbRef := range unresolvedMap {
+		orbRefs = append(orbRefs, orbRef)
+	}
+	sort.Strings(orbRefs)
+
+	for _, orbRef := range orbRefs {
+		entry := &Entry{Ref: orbRef, Status: StatusUnresolved}
+
+		if dependencies := unresolvedMap[orbRef]; len(dependencies) > 0 {
+			entry.Dependency = dependencies[0]
+			entry.LastError = fmt.Sprintf("unresolvable dependencies: %s", strings.Join(dependencies, ", "))
+		}
+
+		r.add(entry)
+	}
+}
+
+func (r *Report) AddRemaining(orbRefs []string) {
+	for _, orbRef := range orbRefs {
+		r.add(&Entry{Ref: orbRef, Status: StatusRemaining})
+	}
+}
+
+func (r *Report) AddImportResult(result *bulkimporter.Result) {
+	droppedMap := make(map[string]*bulkimporter.DroppedOrb)
+	for _, droppedOrb := range result.Dropped {
+		droppedMap[droppedOrb.Ref] = droppedOrb
+	}
+
+	verificationMap := make(map[string]*bulkimporter.VerificationResult)
+	for _, verificationResult := range result.Verification {
+		verificationMap[verificationResult.Ref] = verificationResult
+	}
+
+	for _, record := range result.Records {
+		entry := &Entry{
+			Ref:              record.Ref,
+			Status:           Status(record.Status),
+			Attempts:         record.Attempts,
+			DurationSeconds:  record.Duration.Seconds(),
+			NamespaceCreated: record.NamespaceCreated,
+			OrbCreated:       record.OrbCreated,
+		}
+
+		if droppedOrb, ok := droppedMap[record.Ref]; ok {
+			entry.Category = string(droppedOrb.Category)
+			entry.Dependency = droppedOrb.Dependency
+			if droppedOrb.Err != nil {
+				entry.LastError = droppedOrb.Err.Error()
+			}
+		}
+
+		if verificationResult, ok := verificationMap[record.Ref]; ok {
+			entry.Verification = string(verificationResult.Verification)
+			entry.VerificationDetail = verificationResult.Detail
+		}
+
+		r.add(entry)
+	}
+
+	r.AddRemaining(result.Remaining)
+}
+
+// Finish the report by counting orbs by their status
+func (r *Report) Finish() {
+	r.FinishedAt = time.Now()
+
+	r.Summary = make(map[Status]int)
+	for _, entry := range r.Orbs {
+		r.Summary[entry.Status] += 1
+	}
+}
+
+func (r *Report) JSON() ([]byte, error) {
+	return json.MarshalIndent(r, "", "  ")
+}
+
+func (r *Report) WriteFile(filename string) error {
+	contents, err := r.JSON()
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.WriteFile(filename, contents, 0644)
+}
@@ -0,0 +1,101 @@
+package report
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	bulkimporter "github.com/circle-makotom/orbs-sync/bulk-importer"
+)
+
+var update = flag.Bool("update", false, "Update golden files in testdata")
+
+// Compare the output with the golden file in testdata, or update the golden file with -update
+func assertGolden(t *testing.T, name string, actual []byte) {
+	t.Helper()
+
+	goldenPath := filepath.Join("testdata", name)
+	if *update {
+		if err := ioutil.WriteFile(goldenPath, actual, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected, err := ioutil.ReadFile(goldenPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(actual) != string(expected) {
+		t.Errorf("got\n%s\nexpected the contents of %s\n%s", actual, goldenPath, expected)
+	}
+}
+
+// Build a report of a sync with orbs in every status, finished at a fixed time
+func newTestReport() *Report {
+	r := New()
+
+	r.AddAlreadyPresent([]string{"ns/present@1.0.0"})
+	r.AddIllegible([]string{"ns/illegible@1.0.0"})
+	r.AddUnresolved(map[string][]string{
+		"ns/unresolved@1.0.0": {"gone/lib@1.0.0", "gone/tool@2.0.0"},
+	})
+
+	syntaxErr := errors.New("Error in config file: unknown key")
+	r.AddImportResult(&bulkimporter.Result{
+		Available: []string{"ns/imported@1.0.0", "ns/mismatched@1.0.0", "ns/unverified@1.0.0"},
+		Dropped: []*bulkimporter.DroppedOrb{
+			{Ref: "ns/dropped@1.0.0", Category: bulkimporter.CategoryUnsupportedSyntax, Err: syntaxErr},
+			{Ref: "ns/skipped@1.0.0", Category: bulkimporter.CategoryDependencyDropped, Err: errors.New(`dependency "ns/dropped@1.0.0" (as "ns/dropped@1.0.0") was dropped`), Dependency: "ns/dropped@1.0.0"},
+		},
+		Records: []*bulkimporter.OrbRecord{
+			{Ref: "ns/imported@1.0.0", Status: bulkimporter.StatusImported, Attempts: 1, Duration: 1500 * time.Millisecond, NamespaceCreated: true, OrbCreated: true},
+			{Ref: "ns/mismatched@1.0.0", Status: bulkimporter.StatusImported, Attempts: 2, Duration: 2 * time.Second, OrbCreated: true},
+			{Ref: "ns/unverified@1.0.0", Status: bulkimporter.StatusImported, Attempts: 1, Duration: time.Second},
+			{Ref: "ns/dropped@1.0.0", Status: bulkimporter.StatusDropped, Attempts: 1, Duration: 250 * time.Millisecond},
+			{Ref: "ns/skipped@1.0.0", Status: bulkimporter.StatusSkipped},
+		},
+		Verification: []*bulkimporter.VerificationResult{
+			{Ref: "ns/imported@1.0.0", Verification: bulkimporter.Matched},
+			{Ref: "ns/mismatched@1.0.0", Verification: bulkimporter.Mismatched, Detail: "line 3: \"description: a\" on the destination, \"description: b\" imported"},
+			{Ref: "ns/unverified@1.0.0", Verification: bulkimporter.Unverified, Detail: "failure calling GraphQL API: 503 Service Unavailable"},
+		},
+		Remaining: []string{"ns/remaining@1.0.0"},
+	})
+
+	r.Finish()
+	r.StartedAt = time.Date(2021, 12, 1, 0, 0, 0, 0, time.UTC)
+	r.FinishedAt = time.Date(2021, 12, 1, 1, 0, 0, 0, time.UTC)
+
+	return r
+}
+
+func TestJSON(t *testing.T) {
+	contents, err := newTestReport().JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertGolden(t, "report.json", contents)
+}
+
+// Entries of later stages overwrite those of earlier ones, and the summary counts each orb once
+func TestAddOverwrites(t *testing.T) {
+	r := New()
+	r.AddResolved([]string{"ns/a@1.0.0", "ns/b@1.0.0"})
+	r.AddImportResult(&bulkimporter.Result{
+		Records:   []*bulkimporter.OrbRecord{{Ref: "ns/a@1.0.0", Status: bulkimporter.StatusImported, Attempts: 1}},
+		Remaining: []string{"ns/b@1.0.0"},
+	})
+	r.Finish()
+
+	if len(r.Orbs) != 2 || r.Orbs[0].Status != StatusImported || r.Orbs[1].Status != StatusRemaining {
+		t.Errorf("orbs = %+v, %+v; expected imported and remaining in the order of addition", r.Orbs[0], r.Orbs[1])
+	}
+	if expected := map[Status]int{StatusImported: 1, StatusRemaining: 1}; len(r.Summary) != len(expected) || r.Summary[StatusImported] != 1 || r.Summary[StatusRemaining] != 1 {
+		t.Errorf("summary = %v; expected %v", r.Summary, expected)
+	}
+}
@@ -0,0 +1,199 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Schedule tells when to run next
+type Schedule interface {
+	// Return the first time to run strictly after the given time
+	Next(after time.Time) time.Time
+}
+
+type interval struct {
+	every time.Duration
+}
+
+// Run at the given interval, counted from the end of the last run
+func Every(every time.Duration) (Schedule, error) {
+	if every <= 0 {
+		return nil, fmt.Errorf("invalid interval %v", every)
+	}
+
+	return &interval{every: every}, nil
+}
+
+func (s *interval) Next(after time.Time) time.Time {
+	return after.Add(s.every)
+}
+
+func (s *interval) String() string {
+	return fmt.Sprintf("every %v", s.every)
+}
+
+// cron is a schedule by the standard five fields: minute, hour, day of month, month and day of week
+type cron struct {
+	expr string
+
+	minutes, hours, days, months, weekdays map[int]bool
+
+	// As the standard cron does, either of days or weekdays matching is enough if both are restricted
+	daysRestricted, weekdaysRestricted bool
+}
+
+var cronFieldRanges = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// Parse a field like "*", "*/15", "1,2,5-10" or "1-31/2" into the set of values
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	ret := make(map[int]bool)
+
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[idx+1:]); err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			rangePart = part[:idx]
+		}
+
+		lo, hi := min, max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid value in %q", part)
+			}
+
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid value in %q", part)
+				}
+			} else if step > 1 {
+				// "5/15" means from 5 to the end by 15
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("%q is out of the range from %d to %d", part, min, max)
+		}
+
+		for value := lo; value <= hi; value += step {
+			ret[value] = true
+		}
+	}
+
+	return ret, nil
+}
+
+// Parse a cron expression with the standard five fields, e.g., "0 */6 * * *" for every six hours
+// Times are in the local time zone
+func ParseCron(expr string) (Schedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFieldRanges) {
+		return nil, fmt.Errorf("cron expression %q must have %d fields", expr, len(cronFieldRanges))
+	}
+
+	sets := []map[int]bool{}
+	for idx, field := range fields {
+		fieldRange := cronFieldRanges[idx]
+
+		set, err := parseCronField(field, fieldRange.min, fieldRange.max)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s in cron expression %q", fieldRange.name, expr)
+		}
+
+		sets = append(sets, set)
+	}
+
+	// Sunday can be either 0 or 7
+	if sets[4][7] {
+		sets[4][0] = true
+	}
+
+	return &cron{
+		expr:               expr,
+		minutes:            sets[0],
+		hours:              sets[1],
+		days:               sets[2],
+		months:             sets[3],
+		weekdays:           sets[4],
+		daysRestricted:     !strings.HasPrefix(fields[2], "*"),
+		weekdaysRestricted: !strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+func (s *cron) matchesDay(t time.Time) bool {
+	dayMatches := s.days[t.Day()]
+	weekdayMatches := s.weekdays[int(t.Weekday())]
+
+	if s.daysRestricted && s.weekdaysRestricted {
+		return dayMatches || weekdayMatches
+	}
+
+	return dayMatches && weekdayMatches
+}
+
+// Wall clock times are searched in UTC, which has no daylight saving time, and converted back to the time zone of the given time
+// Times skipped by daylight saving time are skipped, and those repeated match once
+func (s *cron) Next(after time.Time) time.Time {
+	t := time.Date(after.Year(), after.Month(), after.Day(), after.Hour(), after.Minute()+1, 0, 0, time.UTC)
+
+	// Any valid expression matches at least once in a few years, e.g., on 29 February
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		if !s.months[int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !s.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !s.hours[t.Hour()] {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+		if !s.minutes[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		// Skipped wall clock times are resolved to others, and repeated ones to the earlier, which may be before the given time
+		ret := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, after.Location())
+		if !sameWallClock(ret, t) || !ret.After(after) {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return ret
+	}
+
+	// Expressions never matching, e.g., on 31 February
+	return time.Time{}
+}
+
+func sameWallClock(a, b time.Time) bool {
+	return a.Year() == b.Year() && a.Month() == b.Month() && a.Day() == b.Day() && a.Hour() == b.Hour() && a.Minute() == b.Minute()
+}
+
+func (s *cron) String() string {
+	return fmt.Sprintf("cron %q", s.expr)
+}
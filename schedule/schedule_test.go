@@ -0,0 +1,125 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestParseCronNext(t *testing.T) {
+	at := func(value string) time.Time {
+		parsed, err := time.ParseInLocation("2006-01-02 15:04:05", value, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+
+	cases := []struct {
+		expr     string
+		after    string
+		expected string
+	}{
+		{"*/15 * * * *", "2021-03-03 10:07:00", "2021-03-03 10:15:00"},
+		{"0 */6 * * *", "2021-03-03 05:59:30", "2021-03-03 06:00:00"},
+		{"0 */6 * * *", "2021-03-03 06:00:00", "2021-03-03 12:00:00"},
+		{"5/15 * * * *", "2021-03-03 10:21:00", "2021-03-03 10:35:00"},
+		{"1,2,5-10 * * * *", "2021-03-03 10:02:00", "2021-03-03 10:05:00"},
+		{"0 9-17/4 * * *", "2021-03-03 13:00:00", "2021-03-03 17:00:00"},
+		{"0 9-17/4 * * *", "2021-03-03 17:00:00", "2021-03-04 09:00:00"},
+		{"0 0 1 */3 *", "2021-03-03 00:00:00", "2021-04-01 00:00:00"},
+
+		// Sunday is either 0 or 7
+		{"0 0 * * 7", "2021-03-03 00:00:00", "2021-03-07 00:00:00"},
+		{"0 0 * * 0", "2021-03-03 00:00:00", "2021-03-07 00:00:00"},
+		{"0 0 * * 5-7", "2021-03-07 00:00:00", "2021-03-12 00:00:00"},
+
+		// Either of days of month and of week matches if both are restricted
+		{"0 0 13 * 5", "2021-03-01 00:00:00", "2021-03-05 00:00:00"},
+		{"0 0 13 * 5", "2021-03-12 00:00:00", "2021-03-13 00:00:00"},
+
+		// Both match if either starts with an asterisk, as in the standard cron
+		{"0 0 */2 * 1", "2021-03-01 00:00:00", "2021-03-15 00:00:00"},
+		{"0 0 13 * *", "2021-03-01 00:00:00", "2021-03-13 00:00:00"},
+
+		{"0 0 29 2 *", "2021-03-01 00:00:00", "2024-02-29 00:00:00"},
+	}
+
+	for _, c := range cases {
+		sched, err := ParseCron(c.expr)
+		if err != nil {
+			t.Errorf("ParseCron(%q): %v", c.expr, err)
+			continue
+		}
+
+		if actual := sched.Next(at(c.after)); !actual.Equal(at(c.expected)) {
+			t.Errorf("%q: Next(%s) = %s; expected %s", c.expr, c.after, actual, c.expected)
+		}
+	}
+
+	if sched, err := ParseCron("0 0 31 2 *"); err != nil {
+		t.Error(err)
+	} else if actual := sched.Next(at("2021-03-01 00:00:00")); !actual.IsZero() {
+		t.Errorf("Next of an expression never matching = %s; expected zero", actual)
+	}
+}
+
+func TestParseCronNextDST(t *testing.T) {
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		expr     string
+		after    time.Time
+		expected time.Time
+	}{
+		// Clocks go from 02:00 EST to 03:00 EDT on 14 March 2021
+		{"skipped", "30 2 * * *", time.Date(2021, 3, 13, 3, 0, 0, 0, location), time.Date(2021, 3, 15, 2, 30, 0, 0, location)},
+		{"hourly over the skipped hour", "0 * * * *", time.Date(2021, 3, 14, 1, 0, 0, 0, location), time.Date(2021, 3, 14, 3, 0, 0, 0, location)},
+
+		// Clocks go from 02:00 EDT back to 01:00 EST on 7 November 2021
+		{"repeated", "30 1 * * *", time.Date(2021, 11, 7, 5, 30, 0, 0, time.UTC).In(location), time.Date(2021, 11, 8, 1, 30, 0, 0, location)},
+		{"in the repeated hour", "45 1 * * *", time.Date(2021, 11, 7, 6, 30, 0, 0, time.UTC).In(location), time.Date(2021, 11, 8, 1, 45, 0, 0, location)},
+		{"hourly over the repeated hour", "0 * * * *", time.Date(2021, 11, 7, 5, 0, 0, 0, time.UTC).In(location), time.Date(2021, 11, 7, 2, 0, 0, 0, location)},
+		{"daily", "0 12 * * *", time.Date(2021, 11, 6, 12, 0, 0, 0, location), time.Date(2021, 11, 7, 12, 0, 0, 0, location)},
+	}
+
+	for _, c := range cases {
+		sched, err := ParseCron(c.expr)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+
+		if actual := sched.Next(c.after); !actual.Equal(c.expected) {
+			t.Errorf("%s: %q: Next(%s) = %s; expected %s", c.name, c.expr, c.after, actual, c.expected)
+		}
+	}
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{"* * * *", "* * * * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "a * * * *", "1-a * * * *"} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q) succeeded; expected an error", expr)
+		}
+	}
+}
+
+func TestEvery(t *testing.T) {
+	sched, err := Every(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	if actual := sched.Next(now); !actual.Equal(now.Add(time.Hour)) {
+		t.Errorf("Next(%s) = %s; expected an hour later", now, actual)
+	}
+
+	if _, err := Every(0); err == nil {
+		t.Errorf("Every(0) succeeded; expected an error")
+	}
+}